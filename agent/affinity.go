@@ -0,0 +1,96 @@
+/*
+ * 会话亲和表，同一个会话key在有效期内选择同一个dst
+ * Author:slive
+ * DATE:2021/4/13
+ */
+package agent
+
+import (
+	"github.com/slive/gsfly/socket"
+	"sync"
+	"time"
+)
+
+type affinityEntry struct {
+	dstClientConf socket.IClientConf
+	expireTime    time.Time
+}
+
+// AffinityTable 会话亲和表，记录会话key和选中的dst，超过有效期则失效
+type AffinityTable struct {
+	ttl time.Duration
+
+	entries map[string]*affinityEntry
+
+	// 最近一次清理过期记录的时间
+	lastClearTime time.Time
+
+	mut sync.Mutex
+}
+
+// NewAffinityTable 创建会话亲和表
+// ttl 有效期，每次选中或者会话释放时重新计算
+func NewAffinityTable(ttl time.Duration) *AffinityTable {
+	return &AffinityTable{
+		ttl:           ttl,
+		entries:       make(map[string]*affinityEntry),
+		lastClearTime: time.Now(),
+	}
+}
+
+// Get 获取会话key对应的dst，不存在或者已过期返回false
+func (at *AffinityTable) Get(sessionKey string) (socket.IClientConf, bool) {
+	at.mut.Lock()
+	defer at.mut.Unlock()
+	entry, found := at.entries[sessionKey]
+	if !found {
+		return nil, false
+	}
+	if time.Now().After(entry.expireTime) {
+		delete(at.entries, sessionKey)
+		return nil, false
+	}
+	return entry.dstClientConf, true
+}
+
+// Put 记录会话key对应的dst
+func (at *AffinityTable) Put(sessionKey string, dstClientConf socket.IClientConf) {
+	now := time.Now()
+	at.mut.Lock()
+	defer at.mut.Unlock()
+	at.entries[sessionKey] = &affinityEntry{
+		dstClientConf: dstClientConf,
+		expireTime:    now.Add(at.ttl),
+	}
+	at.clearExpired(now)
+}
+
+// Touch 刷新会话key的有效期，如会话释放时，从释放时开始计算有效期
+func (at *AffinityTable) Touch(sessionKey string) {
+	at.mut.Lock()
+	defer at.mut.Unlock()
+	entry, found := at.entries[sessionKey]
+	if found {
+		entry.expireTime = time.Now().Add(at.ttl)
+	}
+}
+
+// Size 记录数，包括未清理的过期记录
+func (at *AffinityTable) Size() int {
+	at.mut.Lock()
+	defer at.mut.Unlock()
+	return len(at.entries)
+}
+
+// clearExpired 每隔一个有效期清理一次过期的记录
+func (at *AffinityTable) clearExpired(now time.Time) {
+	if now.Sub(at.lastClearTime) < at.ttl {
+		return
+	}
+	at.lastClearTime = now
+	for key, entry := range at.entries {
+		if now.After(entry.expireTime) {
+			delete(at.entries, key)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * 异步拨号，agentChannel激活后异步定位upstream并拨号，拨号完成前收到的agent端消息按序缓存，
+ * 拨号成功后按序发送，拨号失败，超时或者缓存已满则关闭agentChannel
+ * Author:slive
+ * DATE:2021/4/21
+ */
+package agent
+
+import (
+	"errors"
+	gch "github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/channel/tcpx"
+	logx "github.com/slive/gsfly/logger"
+	"sync"
+	"time"
+)
+
+const (
+	default_async_buffer_size    = 64
+	default_async_buffer_timeout = 5 * time.Second
+
+	// agentChannel中存放异步拨号会话的附件key
+	PendingSession_Attach_key = "pendingSession"
+)
+
+// AsyncDialConf 异步拨号配置
+type AsyncDialConf struct {
+	// 拨号完成前最多缓存的消息数
+	BufferSize int
+
+	// 拨号完成的最长等待时间，超过则关闭agentChannel
+	BufferTimeout time.Duration
+}
+
+// NewAsyncDialConf 创建异步拨号配置，参数<=0则取默认值
+func NewAsyncDialConf(bufferSize int, bufferTimeout time.Duration) *AsyncDialConf {
+	if bufferSize <= 0 {
+		bufferSize = default_async_buffer_size
+	}
+	if bufferTimeout <= 0 {
+		bufferTimeout = default_async_buffer_timeout
+	}
+	return &AsyncDialConf{
+		BufferSize:    bufferSize,
+		BufferTimeout: bufferTimeout,
+	}
+}
+
+const (
+	pending_dialing = iota
+	pending_ready
+	pending_failed
+)
+
+// pendingSession 拨号中的会话，缓存agent端的消息
+type pendingSession struct {
+	conf *AsyncDialConf
+
+	agentChannel gch.IChannel
+
+	state int
+
+	buffer []gch.IPacket
+
+	timer *time.Timer
+
+	mut sync.Mutex
+}
+
+func newPendingSession(conf *AsyncDialConf, agentChannel gch.IChannel) *pendingSession {
+	return &pendingSession{
+		conf:         conf,
+		agentChannel: agentChannel,
+		state:        pending_dialing,
+	}
+}
+
+// offer 拨号中则缓存消息并返回true，已就绪则返回false由调用方直接转发
+func (ps *pendingSession) offer(packet gch.IPacket) (bool, error) {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+	switch ps.state {
+	case pending_ready:
+		return false, nil
+	case pending_failed:
+		// 已失败，丢弃
+		return true, nil
+	}
+	if len(ps.buffer) >= ps.conf.BufferSize {
+		return true, errors.New("pending buffer is full")
+	}
+	ps.buffer = append(ps.buffer, copyPacket(packet))
+	return true, nil
+}
+
+// ready 拨号成功，按序发送缓存的消息，发送期间新收到的消息等待发送完成
+func (ps *pendingSession) ready(flush func(packet gch.IPacket)) bool {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+	if ps.state != pending_dialing {
+		return false
+	}
+	ps.stopTimer()
+	for _, packet := range ps.buffer {
+		flush(packet)
+	}
+	ps.buffer = nil
+	ps.state = pending_ready
+	return true
+}
+
+// fail 拨号失败，丢弃缓存的消息，返回是否由本次调用置为失败
+func (ps *pendingSession) fail() bool {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+	if ps.state != pending_dialing {
+		return false
+	}
+	ps.stopTimer()
+	ps.buffer = nil
+	ps.state = pending_failed
+	return true
+}
+
+func (ps *pendingSession) stopTimer() {
+	if ps.timer != nil {
+		ps.timer.Stop()
+	}
+}
+
+// copyPacket 复制agent端的消息，原消息在处理后可能被回收
+func copyPacket(packet gch.IPacket) gch.IPacket {
+	data := packet.GetData()
+	copied := make([]byte, len(data))
+	copy(copied, data)
+	ret := packet.GetChannel().NewPacket()
+	ret.SetData(copied)
+	wsPacket, ok := packet.(*tcpx.WsPacket)
+	if ok {
+		ret.(*tcpx.WsPacket).MsgType = wsPacket.MsgType
+	}
+	return ret
+}
+
+// asyncLocationUpstream 异步定位upstream并拨号，拨号完成前的消息由pendingSession缓存
+func (ags *AgServer) asyncLocationUpstream(ctx gch.IChHandleContext, conf *AsyncDialConf) {
+	agentChannel := ctx.GetChannel()
+	session := newPendingSession(conf, agentChannel)
+	agentChannel.AddAttach(PendingSession_Attach_key, session)
+	session.mut.Lock()
+	session.timer = time.AfterFunc(conf.BufferTimeout, func() {
+		ags.failPendingSession(session, errors.New("async dial timeout"))
+	})
+	session.mut.Unlock()
+
+	go func() {
+		defer func() {
+			ret := recover()
+			if ret != nil {
+				logx.Error("async location upstream error:", ret)
+				ags.failPendingSession(session, errors.New("async location upstream error"))
+			}
+		}()
+		dialCtx := gch.NewChHandleContext(agentChannel, nil)
+		ags.locationUpstream(dialCtx)
+		err := dialCtx.GetError()
+		if err != nil {
+			ags.failPendingSession(session, err)
+			return
+		}
+		ok := session.ready(func(packet gch.IPacket) {
+			ags.transferAgentMsg(gch.NewChHandleContext(agentChannel, packet))
+		})
+		if !ok || agentChannel.IsClosed() {
+			// 超时或者agentChannel已关闭，释放已建立的dst端
+			logx.Warn("release dst after async dial, agentChId:", agentChannel.GetId())
+			releaseUpstreams(dialCtx)
+			return
+		}
+		logx.Info("async dial ready, agentChId:", agentChannel.GetId())
+		ags.GetExtension().AfterAgentChannelActive(dialCtx)
+	}()
+}
+
+// failPendingSession 拨号失败，关闭agentChannel
+func (ags *AgServer) failPendingSession(session *pendingSession, err error) {
+	if !session.fail() {
+		return
+	}
+	agentChannel := session.agentChannel
+	logx.Errorf("async dial failed, agentChId:%v, error:%v", agentChannel.GetId(), err)
+	errCtx := gch.NewChHandleContext(agentChannel, nil)
+	gch.NotifyErrorHandle(errCtx, err, gch.ERR_ACTIVE)
+	if isFilterReject(err) {
+		rejectSession(agentChannel, err)
+		return
+	}
+	agentChannel.Release()
+}
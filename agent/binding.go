@@ -0,0 +1,246 @@
+/*
+ * 一个agentChannel绑定多个upstream，agent端的消息按选择器(消息前缀或者json字段)分发到对应的upstream，
+ * 各upstream的dst端响应串行写回同一个agentChannel
+ * Author:slive
+ * DATE:2021/4/24
+ */
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	gch "github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/common"
+	logx "github.com/slive/gsfly/logger"
+	"sort"
+	"sync"
+)
+
+const (
+	// SELECTOR_PREFIX 按消息前缀选择upstream
+	SELECTOR_PREFIX = "prefix"
+	// SELECTOR_JSON 按消息json字段的值选择upstream
+	SELECTOR_JSON = "json"
+
+	// agentChannel中存放多个upstream绑定的附件key
+	Bindings_Attach_key = "bindings"
+
+	// agentChannel中存放写锁的附件key，多个dst端写回同一个agentChannel时使用
+	AgentWriteLock_Attach_key = "agentWriteLock"
+)
+
+// UpstreamSelector 自定义的选择方法，根据agent端的消息返回upstreamId，返回空则使用location的upstreamId
+type UpstreamSelector func(packet gch.IPacket) string
+
+// UpstreamBinding 匹配值和upstream的绑定
+type UpstreamBinding struct {
+	// prefix方式为消息前缀，json方式为字段值
+	Match string
+
+	UpstreamId string
+}
+
+// BindingConf 多个upstream的绑定配置，未匹配的消息使用location的upstreamId
+type BindingConf struct {
+	// 选择方式，SELECTOR_PREFIX或者SELECTOR_JSON
+	SelectorType string
+
+	// json方式的字段名
+	Field string
+
+	// prefix方式转发前是否去掉匹配的前缀
+	StripPrefix bool
+
+	Bindings []*UpstreamBinding
+
+	// 自定义的选择方法，不为空时优先使用
+	Selector UpstreamSelector
+}
+
+// NewBindingConf 创建多个upstream的绑定配置
+// selectorType 选择方式，SELECTOR_PREFIX或者SELECTOR_JSON
+// field json方式的字段名
+// bindings 匹配值和upstream的绑定
+func NewBindingConf(selectorType string, field string, bindings ...*UpstreamBinding) *BindingConf {
+	if selectorType != SELECTOR_PREFIX && selectorType != SELECTOR_JSON {
+		errMsg := "binding selector is invalid:" + selectorType
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	if selectorType == SELECTOR_JSON && len(field) <= 0 {
+		errMsg := "binding json field is nil."
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	for _, binding := range bindings {
+		if len(binding.UpstreamId) <= 0 {
+			errMsg := "binding upstreamId is nil, match:" + binding.Match
+			logx.Error(errMsg)
+			panic(errMsg)
+		}
+	}
+	if selectorType == SELECTOR_PREFIX {
+		// 前缀长的优先匹配
+		sort.SliceStable(bindings, func(i, j int) bool {
+			return len(bindings[i].Match) > len(bindings[j].Match)
+		})
+	}
+	return &BindingConf{
+		SelectorType: selectorType,
+		Field:        field,
+		Bindings:     bindings,
+	}
+}
+
+// GetUpstreamIds 获取绑定的所有upstreamId，已去重
+func (bc *BindingConf) GetUpstreamIds() []string {
+	var ret []string
+	exists := make(map[string]bool)
+	for _, binding := range bc.Bindings {
+		if !exists[binding.UpstreamId] {
+			exists[binding.UpstreamId] = true
+			ret = append(ret, binding.UpstreamId)
+		}
+	}
+	return ret
+}
+
+// Select 根据agent端的消息选择upstreamId，未匹配则返回空；prefix方式配置了StripPrefix时会去掉消息的前缀
+func (bc *BindingConf) Select(packet gch.IPacket) string {
+	if bc.Selector != nil {
+		return bc.Selector(packet)
+	}
+	data := packet.GetData()
+	switch bc.SelectorType {
+	case SELECTOR_PREFIX:
+		for _, binding := range bc.Bindings {
+			if bytes.HasPrefix(data, []byte(binding.Match)) {
+				if bc.StripPrefix {
+					packet.SetData(data[len(binding.Match):])
+				}
+				return binding.UpstreamId
+			}
+		}
+	case SELECTOR_JSON:
+		msg := make(map[string]interface{})
+		err := json.Unmarshal(data, &msg)
+		if err != nil {
+			logx.Debug("binding select json error:", err)
+			return ""
+		}
+		value, found := msg[bc.Field]
+		if !found || value == nil {
+			return ""
+		}
+		match := fmt.Sprintf("%v", value)
+		for _, binding := range bc.Bindings {
+			if binding.Match == match {
+				return binding.UpstreamId
+			}
+		}
+	}
+	return ""
+}
+
+// agentBindings agentChannel已绑定的upstream
+type agentBindings struct {
+	conf *BindingConf
+
+	// 默认的upstream，即location的upstreamId对应的upstream
+	defUpstream IUpstream
+
+	// upstreamId对应的upstream
+	upstreams map[string]IUpstream
+}
+
+// selectUpstream 选择agent端消息对应的upstream，未匹配则使用默认的upstream
+func (ab *agentBindings) selectUpstream(packet gch.IPacket) IUpstream {
+	upstreamId := ab.conf.Select(packet)
+	if len(upstreamId) > 0 {
+		ups, found := ab.upstreams[upstreamId]
+		if found {
+			return ups
+		}
+	}
+	return ab.defUpstream
+}
+
+// bindUpstreams 按location的绑定配置，为agentChannel初始化其他upstream的channelpeer，失败则释放已初始化的upstream
+func (ags *AgServer) bindUpstreams(agentCtx gch.IChHandleContext, location ILocationConf, defUpstream IUpstream, params map[string]interface{}) bool {
+	bindingConf := location.GetBindingConf()
+	if bindingConf == nil {
+		return true
+	}
+	agentChannel := agentCtx.GetChannel()
+	bindings := &agentBindings{
+		conf:        bindingConf,
+		defUpstream: defUpstream,
+		upstreams:   map[string]IUpstream{location.GetUpstreamId(): defUpstream},
+	}
+	upstreams := ags.GetParent().(IService).GetUpstreams()
+	for _, upstreamId := range bindingConf.GetUpstreamIds() {
+		_, found := bindings.upstreams[upstreamId]
+		if found {
+			continue
+		}
+		ups, found := upstreams[upstreamId]
+		var err common.GError
+		if found {
+			bindCtx := gch.NewChHandleContext(agentChannel, nil)
+			ups.InitChannelPeer(bindCtx, params)
+			if bindCtx.GetRet() != nil {
+				bindings.upstreams[upstreamId] = ups
+				continue
+			}
+			err = bindCtx.GetError()
+		}
+		logx.Errorf("bind upstream error, agentChId:%v, upstreamId:%v, error:%v", agentChannel.GetId(), upstreamId, err)
+		for _, bound := range bindings.upstreams {
+			bound.ReleaseOnAgentChannel(agentCtx)
+		}
+		if err != nil {
+			agentCtx.SetError(err)
+		}
+		return false
+	}
+	agentChannel.AddAttach(Bindings_Attach_key, bindings)
+	return true
+}
+
+// selectUpstream 获取agent端消息对应的upstream，绑定了多个upstream则按选择器选择
+func selectUpstream(agentCtx gch.IChHandleContext) (IUpstream, bool) {
+	agentChannel := agentCtx.GetChannel()
+	bindings, ok := agentChannel.GetAttach(Bindings_Attach_key).(*agentBindings)
+	if ok {
+		return bindings.selectUpstream(agentCtx.GetPacket()), true
+	}
+	ups, ok := agentChannel.GetAttach(Upstream_Attach_key).(IUpstream)
+	return ups, ok
+}
+
+// releaseUpstreams agentChannel关闭后，释放所有绑定的upstream的资源
+func releaseUpstreams(agentCtx gch.IChHandleContext) {
+	agentChannel := agentCtx.GetChannel()
+	bindings, ok := agentChannel.GetAttach(Bindings_Attach_key).(*agentBindings)
+	if ok {
+		for _, ups := range bindings.upstreams {
+			ups.ReleaseOnAgentChannel(agentCtx)
+		}
+		return
+	}
+	ups, ok := agentChannel.GetAttach(Upstream_Attach_key).(IUpstream)
+	if ok {
+		ups.ReleaseOnAgentChannel(agentCtx)
+	}
+}
+
+// syncAgentWrite 多个dst端写回同一个agentChannel时串行写入，没有写锁则直接写入
+func syncAgentWrite(agentChannel gch.IChannel, write func()) {
+	writeLock, ok := agentChannel.GetAttach(AgentWriteLock_Attach_key).(*sync.Mutex)
+	if ok {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+	}
+	write()
+}
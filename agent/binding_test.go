@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/slive/gsfly/channel"
+)
+
+func newTestPacket(data string) channel.IPacket {
+	packet := channel.NewPacket(newTestOpenChannel(), channel.NETWORK_TCP)
+	packet.SetData([]byte(data))
+	return packet
+}
+
+func TestBindingConfSelectPrefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		strip    bool
+		data     string
+		want     string
+		wantData string
+	}{
+		{"longest prefix first", false, "chat.room:hello", "room", "chat.room:hello"},
+		{"shorter prefix", false, "chat:hello", "chat", "chat:hello"},
+		{"strip prefix", true, "chat.room:hello", "room", ":hello"},
+		{"unmatched", true, "game:hello", "", "game:hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := NewBindingConf(SELECTOR_PREFIX, "",
+				&UpstreamBinding{Match: "chat", UpstreamId: "chat"},
+				&UpstreamBinding{Match: "chat.room", UpstreamId: "room"})
+			conf.StripPrefix = tt.strip
+			packet := newTestPacket(tt.data)
+			if got := conf.Select(packet); got != tt.want {
+				t.Fatalf("Select() = %q, want %q", got, tt.want)
+			}
+			if got := string(packet.GetData()); got != tt.wantData {
+				t.Fatalf("data = %q, want %q", got, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestBindingConfSelectJson(t *testing.T) {
+	conf := NewBindingConf(SELECTOR_JSON, "type",
+		&UpstreamBinding{Match: "chat", UpstreamId: "chat"},
+		&UpstreamBinding{Match: "2", UpstreamId: "game"})
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"string value", `{"type":"chat","msg":"hi"}`, "chat"},
+		{"number value", `{"type":2}`, "game"},
+		{"unmatched value", `{"type":"other"}`, ""},
+		{"missing field", `{"msg":"hi"}`, ""},
+		{"null field", `{"type":null}`, ""},
+		{"invalid json", `chat`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := conf.Select(newTestPacket(tt.data)); got != tt.want {
+				t.Fatalf("Select() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// 自定义的选择方法优先
+	conf.Selector = func(packet channel.IPacket) string {
+		return "custom"
+	}
+	if got := conf.Select(newTestPacket(`{"type":"chat"}`)); got != "custom" {
+		t.Fatalf("Select() with selector = %q, want custom", got)
+	}
+}
+
+func TestBindingConfGetUpstreamIds(t *testing.T) {
+	conf := NewBindingConf(SELECTOR_JSON, "type",
+		&UpstreamBinding{Match: "a", UpstreamId: "ups1"},
+		&UpstreamBinding{Match: "b", UpstreamId: "ups2"},
+		&UpstreamBinding{Match: "c", UpstreamId: "ups1"})
+	got := conf.GetUpstreamIds()
+	if len(got) != 2 || got[0] != "ups1" || got[1] != "ups2" {
+		t.Fatalf("GetUpstreamIds() = %v, want [ups1 ups2]", got)
+	}
+}
+
+func TestNewBindingConfInvalid(t *testing.T) {
+	tests := []struct {
+		name         string
+		selectorType string
+		field        string
+		binding      *UpstreamBinding
+	}{
+		{"unknown selector", "regex", "", &UpstreamBinding{Match: "a", UpstreamId: "ups1"}},
+		{"json without field", SELECTOR_JSON, "", &UpstreamBinding{Match: "a", UpstreamId: "ups1"}},
+		{"empty upstreamId", SELECTOR_PREFIX, "", &UpstreamBinding{Match: "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("NewBindingConf() did not panic")
+				}
+			}()
+			NewBindingConf(tt.selectorType, tt.field, tt.binding)
+		})
+	}
+}
+
+func TestAgentBindingsSelectUpstream(t *testing.T) {
+	defUps, _ := newTestProxy(t, "default", 1)
+	chatUps, _ := newTestProxy(t, "default", 1)
+	bindings := &agentBindings{
+		conf: NewBindingConf(SELECTOR_PREFIX, "",
+			&UpstreamBinding{Match: "chat:", UpstreamId: "chat"},
+			&UpstreamBinding{Match: "game:", UpstreamId: "game"}),
+		defUpstream: defUps,
+		upstreams:   map[string]IUpstream{"def": defUps, "chat": chatUps},
+	}
+	tests := []struct {
+		name string
+		data string
+		want IUpstream
+	}{
+		{"bound upstream", "chat:hi", chatUps},
+		{"unmatched uses default", "hi", defUps},
+		// 匹配到的upstream未绑定成功，也使用默认的upstream
+		{"unbound upstream uses default", "game:hi", defUps},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bindings.selectUpstream(newTestPacket(tt.data)); got != tt.want {
+				t.Fatalf("selectUpstream() = %p, want %p", got, tt.want)
+			}
+		})
+	}
+
+	// agentChannel绑定了多个upstream时按选择器选择，否则使用location的upstream
+	agentCh := newTestOpenChannel()
+	agentCh.AddAttach(Upstream_Attach_key, defUps)
+	ctx := channel.NewChHandleContext(agentCh, newTestPacket("chat:hi"))
+	if got, ok := selectUpstream(ctx); !ok || got != defUps {
+		t.Fatalf("selectUpstream() without bindings = %p, %v, want %p", got, ok, defUps)
+	}
+	agentCh.AddAttach(Bindings_Attach_key, bindings)
+	if got, ok := selectUpstream(ctx); !ok || got != chatUps {
+		t.Fatalf("selectUpstream() with bindings = %p, %v, want %p", got, ok, chatUps)
+	}
+}
@@ -0,0 +1,230 @@
+/*
+ * 熔断器，包括关闭，打开和半打开三种状态，按错误率和请求量阈值进行熔断
+ * Author:slive
+ * DATE:2021/4/15
+ */
+package agent
+
+import (
+	"errors"
+	"fmt"
+	logx "github.com/slive/gsfly/logger"
+	"sync"
+	"time"
+)
+
+// 熔断拒绝的错误码
+const ERR_BREAKER_OPEN = "ERR_BREAKER_OPEN"
+
+type BreakerState int
+
+const (
+	// BREAKER_CLOSED 关闭状态，正常放行
+	BREAKER_CLOSED = BreakerState(0)
+	// BREAKER_OPEN 打开状态，直接拒绝
+	BREAKER_OPEN = BreakerState(1)
+	// BREAKER_HALF_OPEN 半打开状态，放行少量请求试探是否恢复
+	BREAKER_HALF_OPEN = BreakerState(2)
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BREAKER_CLOSED:
+		return "closed"
+	case BREAKER_OPEN:
+		return "open"
+	case BREAKER_HALF_OPEN:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	default_breaker_error_ratio        = 0.5
+	default_breaker_min_requests       = 20
+	default_breaker_window             = 10 * time.Second
+	default_breaker_open_timeout       = 30 * time.Second
+	default_breaker_half_open_requests = 1
+)
+
+// BreakerConf 熔断配置
+type BreakerConf struct {
+	// 错误率阈值，统计窗口内错误率达到该值则打开
+	ErrorRatio float64
+
+	// 请求量阈值，统计窗口内请求数达到该值才计算错误率
+	MinRequests int
+
+	// 统计窗口
+	Window time.Duration
+
+	// 打开后经过该时长进入半打开状态
+	OpenTimeout time.Duration
+
+	// 半打开状态下最多放行的试探请求数
+	HalfOpenRequests int
+}
+
+// NewBreakerConf 创建熔断配置，参数<=0则取默认值
+func NewBreakerConf(errorRatio float64, minRequests int, window time.Duration, openTimeout time.Duration, halfOpenRequests int) *BreakerConf {
+	if errorRatio <= 0 {
+		errorRatio = default_breaker_error_ratio
+	}
+	if minRequests <= 0 {
+		minRequests = default_breaker_min_requests
+	}
+	if window <= 0 {
+		window = default_breaker_window
+	}
+	if openTimeout <= 0 {
+		openTimeout = default_breaker_open_timeout
+	}
+	if halfOpenRequests <= 0 {
+		halfOpenRequests = default_breaker_half_open_requests
+	}
+	return &BreakerConf{
+		ErrorRatio:       errorRatio,
+		MinRequests:      minRequests,
+		Window:           window,
+		OpenTimeout:      openTimeout,
+		HalfOpenRequests: halfOpenRequests,
+	}
+}
+
+// CircuitBreaker 熔断器
+type CircuitBreaker struct {
+	name string
+
+	conf *BreakerConf
+
+	state BreakerState
+
+	// 统计窗口开始时间
+	windowStart time.Time
+
+	requests int
+
+	failures int
+
+	// 打开的时间
+	openTime time.Time
+
+	// 半打开状态下已放行的试探请求数
+	halfOpenRequests int
+
+	mut sync.Mutex
+}
+
+// NewCircuitBreaker 创建熔断器
+// name 名称，用于日志和错误信息
+// conf 熔断配置
+func NewCircuitBreaker(name string, conf *BreakerConf) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:        name,
+		conf:        conf,
+		state:       BREAKER_CLOSED,
+		windowStart: time.Now(),
+	}
+}
+
+func (cb *CircuitBreaker) GetName() string {
+	return cb.name
+}
+
+// GetState 获取当前状态
+func (cb *CircuitBreaker) GetState() BreakerState {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+	return cb.state
+}
+
+// CanPass 是否可放行，不占用半打开状态的试探名额
+func (cb *CircuitBreaker) CanPass() bool {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+	switch cb.state {
+	case BREAKER_OPEN:
+		return time.Since(cb.openTime) >= cb.conf.OpenTimeout
+	case BREAKER_HALF_OPEN:
+		return cb.halfOpenRequests < cb.conf.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// Allow 放行请求，不可放行则返回错误，可放行的请求完成后需调用OnResult
+func (cb *CircuitBreaker) Allow() error {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+	if cb.state == BREAKER_OPEN {
+		if time.Since(cb.openTime) < cb.conf.OpenTimeout {
+			return errors.New(fmt.Sprintf("circuit breaker is open, name:%v", cb.name))
+		}
+		cb.setState(BREAKER_HALF_OPEN)
+	}
+	if cb.state == BREAKER_HALF_OPEN {
+		if cb.halfOpenRequests >= cb.conf.HalfOpenRequests {
+			return errors.New(fmt.Sprintf("circuit breaker is half-open, name:%v", cb.name))
+		}
+		cb.halfOpenRequests++
+	}
+	return nil
+}
+
+// Cancel 放行后未实际请求，归还半打开状态的试探名额
+func (cb *CircuitBreaker) Cancel() {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+	if cb.state == BREAKER_HALF_OPEN && cb.halfOpenRequests > 0 {
+		cb.halfOpenRequests--
+	}
+}
+
+// OnResult 记录请求结果
+func (cb *CircuitBreaker) OnResult(err error) {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+	switch cb.state {
+	case BREAKER_HALF_OPEN:
+		if err != nil {
+			cb.open()
+		} else {
+			cb.setState(BREAKER_CLOSED)
+		}
+	case BREAKER_CLOSED:
+		now := time.Now()
+		if now.Sub(cb.windowStart) > cb.conf.Window {
+			cb.resetWindow(now)
+		}
+		cb.requests++
+		if err != nil {
+			cb.failures++
+		}
+		if cb.requests >= cb.conf.MinRequests &&
+			float64(cb.failures)/float64(cb.requests) >= cb.conf.ErrorRatio {
+			cb.open()
+		}
+	}
+}
+
+func (cb *CircuitBreaker) open() {
+	cb.openTime = time.Now()
+	cb.setState(BREAKER_OPEN)
+}
+
+func (cb *CircuitBreaker) setState(state BreakerState) {
+	if cb.state != state {
+		logx.Warnf("circuit breaker state changed, name:%v, %v->%v, requests:%v, failures:%v",
+			cb.name, cb.state, state, cb.requests, cb.failures)
+	}
+	cb.state = state
+	cb.halfOpenRequests = 0
+	cb.resetWindow(time.Now())
+}
+
+func (cb *CircuitBreaker) resetWindow(now time.Time) {
+	cb.windowStart = now
+	cb.requests = 0
+	cb.failures = 0
+}
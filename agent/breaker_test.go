@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTestDial = errors.New("dial error")
+
+// expireOpen 使打开状态超过OpenTimeout
+func expireOpen(cb *CircuitBreaker) {
+	cb.mut.Lock()
+	cb.openTime = time.Now().Add(-cb.conf.OpenTimeout)
+	cb.mut.Unlock()
+}
+
+func assertBreakerState(t *testing.T, cb *CircuitBreaker, want BreakerState) {
+	t.Helper()
+	if got := cb.GetState(); got != want {
+		t.Fatalf("state = %v, want %v", got, want)
+	}
+}
+
+func TestCircuitBreakerOpen(t *testing.T) {
+	cb := NewCircuitBreaker("test", NewBreakerConf(0.5, 4, time.Minute, time.Minute, 1))
+	// 未达到请求量阈值时，全部失败也不打开
+	for i := 0; i < 3; i++ {
+		cb.OnResult(errTestDial)
+	}
+	assertBreakerState(t, cb, BREAKER_CLOSED)
+	// 第4个请求达到阈值，错误率3/4超过0.5
+	cb.OnResult(nil)
+	assertBreakerState(t, cb, BREAKER_OPEN)
+	if cb.CanPass() {
+		t.Fatal("CanPass() = true when open")
+	}
+	if err := cb.Allow(); err == nil {
+		t.Fatal("Allow() error = nil when open")
+	}
+}
+
+func TestCircuitBreakerBelowErrorRatio(t *testing.T) {
+	cb := NewCircuitBreaker("test", NewBreakerConf(0.5, 4, time.Minute, time.Minute, 1))
+	results := []error{errTestDial, nil, nil, nil, errTestDial, nil}
+	for _, err := range results {
+		cb.OnResult(err)
+	}
+	assertBreakerState(t, cb, BREAKER_CLOSED)
+}
+
+func TestCircuitBreakerWindowReset(t *testing.T) {
+	cb := NewCircuitBreaker("test", NewBreakerConf(0.5, 4, time.Minute, time.Minute, 1))
+	for i := 0; i < 3; i++ {
+		cb.OnResult(errTestDial)
+	}
+	// 统计窗口过期，之前的失败不再计入
+	cb.mut.Lock()
+	cb.windowStart = time.Now().Add(-2 * time.Minute)
+	cb.mut.Unlock()
+	cb.OnResult(errTestDial)
+	assertBreakerState(t, cb, BREAKER_CLOSED)
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name   string
+		result error
+		want   BreakerState
+	}{
+		{"probe succeeds", nil, BREAKER_CLOSED},
+		{"probe fails", errTestDial, BREAKER_OPEN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := NewCircuitBreaker("test", NewBreakerConf(0.5, 1, time.Minute, time.Minute, 2))
+			cb.OnResult(errTestDial)
+			assertBreakerState(t, cb, BREAKER_OPEN)
+
+			expireOpen(cb)
+			if !cb.CanPass() {
+				t.Fatal("CanPass() = false after open timeout")
+			}
+			// CanPass不改变状态，Allow才进入半打开
+			assertBreakerState(t, cb, BREAKER_OPEN)
+			if err := cb.Allow(); err != nil {
+				t.Fatalf("Allow() error = %v after open timeout", err)
+			}
+			assertBreakerState(t, cb, BREAKER_HALF_OPEN)
+			if err := cb.Allow(); err != nil {
+				t.Fatalf("Allow() of second probe error = %v", err)
+			}
+			// 试探名额用完
+			if cb.CanPass() || cb.Allow() == nil {
+				t.Fatal("half-open allows more than HalfOpenRequests")
+			}
+			// 归还名额后可再放行
+			cb.Cancel()
+			if err := cb.Allow(); err != nil {
+				t.Fatalf("Allow() after Cancel() error = %v", err)
+			}
+
+			cb.OnResult(tt.result)
+			assertBreakerState(t, cb, tt.want)
+		})
+	}
+}
+
+func TestCircuitBreakerReopenAfterHalfOpenFailure(t *testing.T) {
+	cb := NewCircuitBreaker("test", NewBreakerConf(0.5, 1, time.Minute, time.Minute, 1))
+	cb.OnResult(errTestDial)
+	expireOpen(cb)
+	cb.Allow()
+	cb.OnResult(errTestDial)
+	assertBreakerState(t, cb, BREAKER_OPEN)
+	// 重新打开后重新计时
+	if cb.CanPass() {
+		t.Fatal("CanPass() = true right after reopen")
+	}
+}
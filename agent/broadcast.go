@@ -0,0 +1,295 @@
+/*
+ * 广播方式的upstream，一个agentChannel对应多个dstChannel，
+ * agent端的消息写到所有的dstChannel，任意dstChannel的消息写回agentChannel
+ * Author:slive
+ * DATE:2021/4/17
+ */
+package agent
+
+import (
+	"github.com/slive/gsfly/channel"
+	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
+	"sync"
+)
+
+const (
+	// BROADCAST_DROP_CLOSE 任意dstChannel断开，则关闭agentChannel和其他的dstChannel
+	BROADCAST_DROP_CLOSE = "close"
+
+	// BROADCAST_DROP_CONTINUE dstChannel断开后，继续使用剩下的dstChannel，都断开后才关闭agentChannel
+	BROADCAST_DROP_CONTINUE = "continue"
+)
+
+type IBroadcastConf interface {
+	IUpstreamConf
+
+	// GetDstClientConfs 广播的dst客户端配置列表
+	GetDstClientConfs() []socket.IClientConf
+
+	// GetDropPolicy dstChannel断开时的处理方式，见BROADCAST_DROP_XXX
+	GetDropPolicy() string
+}
+
+// BroadcastConf 广播方式的upstream配置
+type BroadcastConf struct {
+	UpstreamConf
+
+	// dst客户端配置列表
+	DstClientConfs []socket.IClientConf
+
+	// dstChannel断开时的处理方式
+	DropPolicy string
+}
+
+func NewBroadcastConf(id string, dropPolicy string, dstClientConfs ...socket.IClientConf) *BroadcastConf {
+	if len(dstClientConfs) <= 0 {
+		errMsg := "dstClientConfs are nil"
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	if len(dropPolicy) <= 0 {
+		dropPolicy = BROADCAST_DROP_CLOSE
+	}
+	if dropPolicy != BROADCAST_DROP_CLOSE && dropPolicy != BROADCAST_DROP_CONTINUE {
+		errMsg := "dropPolicy is invalid:" + dropPolicy
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	b := &BroadcastConf{
+		DstClientConfs: dstClientConfs,
+		DropPolicy:     dropPolicy,
+	}
+	b.UpstreamConf = *NewUpstreamConf(id, UPSTREAM_BROADCAST)
+	return b
+}
+
+func (bc *BroadcastConf) GetDstClientConfs() []socket.IClientConf {
+	return bc.DstClientConfs
+}
+
+func (bc *BroadcastConf) GetDropPolicy() string {
+	return bc.DropPolicy
+}
+
+// Broadcast 广播方式的upstream，InitChannelPeer时拨号所有的dstclient，
+// 每个dstChannel和agentChannel组成一个channelpeer，dstChId作为主键
+type Broadcast struct {
+	Upstream
+
+	BroadcastConf IBroadcastConf
+
+	// agentChId对应的所有dstChId
+	agentMapperDstChs map[string][]string
+
+	mapperMut sync.RWMutex
+}
+
+func NewBroadcast(parent interface{}, broadcastConf IBroadcastConf, extension IExtension) *Broadcast {
+	b := &Broadcast{
+		BroadcastConf:     broadcastConf,
+		agentMapperDstChs: make(map[string][]string),
+	}
+	b.Upstream = *NewUpstream(parent, broadcastConf, extension)
+	return b
+}
+
+// InitChannelPeer 拨号所有的dstclient，BROADCAST_DROP_CLOSE方式需全部拨号成功，
+// BROADCAST_DROP_CONTINUE方式至少一个拨号成功，成功后ret为所有的dstChannel
+func (bc *Broadcast) InitChannelPeer(agentCtx channel.IChHandleContext, params map[string]interface{}) {
+	agentCh := agentCtx.GetChannel()
+	agentChId := agentCh.GetId()
+	dropPolicy := bc.BroadcastConf.GetDropPolicy()
+	var dstChs []channel.IChannel
+	var chPeers []*ChannelPeer
+	if agentCh.GetAttach(AgentWriteLock_Attach_key) == nil {
+		// 多个dstChannel的响应串行写回agentChannel
+		agentCh.AddAttach(AgentWriteLock_Attach_key, &sync.Mutex{})
+	}
+	for _, dstClientConf := range bc.BroadcastConf.GetDstClientConfs() {
+		handle := channel.NewDefChHandle(bc.onDstChannelReadHandle)
+		handle.SetOnConnect(onChannelConnectHandle)
+		handle.SetOnRelease(bc.onDstChannelInActiveHandle)
+		handle.SetOnError(onChannelErrorHandle)
+		clientConn := socket.NewClientSocket(bc, dstClientConf, handle, params)
+		err := clientConn.Dial()
+		if err != nil {
+			logx.Errorf("dial broadcast dst error, agentChId:%v, dst:%v, error:%v", agentChId, dstClientConf.GetAddrStr(), err)
+			if dropPolicy == BROADCAST_DROP_CLOSE {
+				break
+			}
+			continue
+		}
+		dstCh := clientConn.GetChannel()
+		dstChs = append(dstChs, dstCh)
+		chPeer := NewChannelPeer(agentCh, dstCh)
+		chPeer.SetDstClientConf(dstClientConf)
+		chPeers = append(chPeers, chPeer)
+	}
+
+	dstSize := len(bc.BroadcastConf.GetDstClientConfs())
+	if len(dstChs) <= 0 || (dropPolicy == BROADCAST_DROP_CLOSE && len(dstChs) < dstSize) {
+		logx.Errorf("dial broadcast dsts error, agentChId:%v, success:%v, total:%v", agentChId, len(dstChs), dstSize)
+		for _, dstCh := range dstChs {
+			dstCh.Release()
+		}
+		return
+	}
+
+	dstChIds := make([]string, len(chPeers))
+	for index, chPeer := range chPeers {
+		dstCh := chPeer.GetDstChannel()
+		dstChId := dstCh.GetId()
+		dstChIds[index] = dstChId
+		bc.GetChannelPeers().Put(dstChId, chPeer)
+		bc.GetDstChannels().Put(dstChId, dstCh)
+		bc.GetDstStatis(chPeer.GetDstClientConf()).IncInflight()
+	}
+	bc.mapperMut.Lock()
+	bc.agentMapperDstChs[agentChId] = dstChIds
+	bc.mapperMut.Unlock()
+	agentCtx.SetRet(dstChs)
+	logx.Infof("finish broadcast initChannelPeer, agentChId:%v, dstChIds:%v", agentChId, dstChIds)
+}
+
+// GetChannelPeer 获取channelpeer，agent端返回第一个可用的channelpeer
+func (bc *Broadcast) GetChannelPeer(ctx channel.IChHandleContext, isAgent bool) IChannelPeer {
+	chId := ctx.GetChannel().GetId()
+	if isAgent {
+		chPeers := bc.getChannelPeers(chId)
+		if len(chPeers) > 0 {
+			return chPeers[0]
+		}
+		return nil
+	}
+	ret, found := bc.GetChannelPeers().Get(chId)
+	if found {
+		return ret.(IChannelPeer)
+	}
+	return nil
+}
+
+// getChannelPeers 获取agentChId对应的所有channelpeer
+func (bc *Broadcast) getChannelPeers(agentChId string) []IChannelPeer {
+	bc.mapperMut.RLock()
+	dstChIds := bc.agentMapperDstChs[agentChId]
+	bc.mapperMut.RUnlock()
+	chPeers := make([]IChannelPeer, 0, len(dstChIds))
+	for _, dstChId := range dstChIds {
+		ret, found := bc.GetChannelPeers().Get(dstChId)
+		if found {
+			chPeers = append(chPeers, ret.(IChannelPeer))
+		}
+	}
+	return chPeers
+}
+
+// QueryDstChannel 查询agentChannel对应的所有dstChannel，ret为[]channel.IChannel
+func (bc *Broadcast) QueryDstChannel(ctx channel.IChHandleContext) {
+	chPeers := bc.getChannelPeers(ctx.GetChannel().GetId())
+	if len(chPeers) <= 0 {
+		logx.Warn("query broadcast dst is not existed.")
+		return
+	}
+	dstChs := make([]channel.IChannel, len(chPeers))
+	for index, chPeer := range chPeers {
+		dstChs[index] = chPeer.GetDstChannel()
+	}
+	ctx.SetRet(dstChs)
+}
+
+func (bc *Broadcast) QueryAgentChannel(ctx channel.IChHandleContext) {
+	InnerQueryAgentChannel(bc, ctx)
+}
+
+// onDstChannelReadHandle 任意dstChannel收到的消息都写回agentChannel
+func (bc *Broadcast) onDstChannelReadHandle(dstCtx channel.IChHandleContext) {
+	bc.QueryAgentChannel(dstCtx)
+	agentCh := dstCtx.GetRet()
+	if agentCh != nil {
+		agentChannel := agentCh.(channel.IChannel)
+		syncAgentWrite(agentChannel, func() {
+			bc.GetExtension().Transfer(dstCtx, agentChannel)
+		})
+		return
+	}
+	logx.Warn("unknown broadcast dst Transfer.")
+}
+
+func (bc *Broadcast) onDstChannelInActiveHandle(dstCtx channel.IChHandleContext) {
+	dstChId := dstCtx.GetChannel().GetId()
+	defer func() {
+		ret := recover()
+		logx.Infof("finish to broadcast onDstChannelInActiveHandle, chId:%v, ret:%v", dstChId, ret)
+	}()
+	bc.ReleaseOnDstChannel(dstCtx)
+}
+
+// ReleaseOnAgentChannel 释放agentChannel对应的所有dstChannel
+func (bc *Broadcast) ReleaseOnAgentChannel(agentCtx channel.IChHandleContext) {
+	agentChId := agentCtx.GetChannel().GetId()
+	bc.mapperMut.Lock()
+	dstChIds, found := bc.agentMapperDstChs[agentChId]
+	delete(bc.agentMapperDstChs, agentChId)
+	bc.mapperMut.Unlock()
+	logx.Infof("broadcast dstChs found:%v, agentChId:%v", found, agentChId)
+	for _, dstChId := range dstChIds {
+		chPeer := bc.removeChannelPeer(dstChId)
+		if chPeer != nil {
+			closePeer(bc.GetExtension(), agentCtx.GetChannel(), chPeer.GetDstChannel())
+		}
+	}
+}
+
+// ReleaseOnDstChannel dstChannel断开后，按DropPolicy处理agentChannel
+func (bc *Broadcast) ReleaseOnDstChannel(dstCtx channel.IChHandleContext) {
+	dstChId := dstCtx.GetChannel().GetId()
+	chPeer := bc.removeChannelPeer(dstChId)
+	if chPeer == nil {
+		return
+	}
+	agentCh := chPeer.GetAgentChannel()
+	agentChId := agentCh.GetId()
+	bc.mapperMut.Lock()
+	dstChIds, found := bc.agentMapperDstChs[agentChId]
+	if !found {
+		// agentChannel已在释放中，其dstChannel由ReleaseOnAgentChannel处理
+		bc.mapperMut.Unlock()
+		return
+	}
+	remains := make([]string, 0, len(dstChIds))
+	for _, id := range dstChIds {
+		if id != dstChId {
+			remains = append(remains, id)
+		}
+	}
+	if len(remains) > 0 {
+		bc.agentMapperDstChs[agentChId] = remains
+	} else {
+		delete(bc.agentMapperDstChs, agentChId)
+	}
+	bc.mapperMut.Unlock()
+
+	dropPolicy := bc.BroadcastConf.GetDropPolicy()
+	logx.Infof("broadcast dst dropped, agentChId:%v, dstChId:%v, remains:%v, dropPolicy:%v",
+		agentChId, dstChId, len(remains), dropPolicy)
+	if dropPolicy == BROADCAST_DROP_CLOSE || len(remains) <= 0 {
+		// 释放agentChannel，进而通过ReleaseOnAgentChannel释放剩下的dstChannel
+		closePeer(bc.GetExtension(), dstCtx.GetChannel(), agentCh)
+	}
+}
+
+// removeChannelPeer 移除channelpeer和dstchannel记录
+func (bc *Broadcast) removeChannelPeer(dstChId string) IChannelPeer {
+	ret, found := bc.GetChannelPeers().Get(dstChId)
+	if !found {
+		return nil
+	}
+	bc.GetChannelPeers().Remove(dstChId)
+	bc.GetDstChannels().Remove(dstChId)
+	chPeer := ret.(IChannelPeer)
+	if chPeer.GetDstClientConf() != nil {
+		bc.GetDstStatis(chPeer.GetDstClientConf()).DecInflight()
+	}
+	return chPeer
+}
@@ -0,0 +1,354 @@
+/*
+ * 按ip段(CIDR)的访问控制过滤器，在BeforeAgentChannelActive时检查agent端的ip：
+ *  1、规则为"allow 10.0.0.0/8"或者"deny 2001:db8::/32"，单个ip视为/32或者/128，按顺序匹配，第一个匹配的规则生效
+ *  2、规则文件中的规则先于rules配置的规则匹配，都未匹配则按default处理
+ *  3、规则文件按reloadInterval检查修改时间，有修改则重新加载，无需重启，加载失败则保留原有规则
+ *  4、按pattern限定location，按ports限定连接到达的监听端口，"tunnel"表示tunnel监听的会话，为空则不限定
+ * Author:slive
+ * DATE:2021/4/30
+ */
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	gch "github.com/slive/gsfly/channel"
+	logx "github.com/slive/gsfly/logger"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FILTER_CIDR 按ip段的访问控制
+	FILTER_CIDR = "cidr"
+
+	// 规则，多个用";"或者","分割
+	cidr_key_rules = "rules"
+
+	// 未匹配时的处理，allow或者deny
+	cidr_key_default = "default"
+
+	// 规则文件，一行一个规则，"#"开头为注释
+	cidr_key_file = "file"
+
+	// 检查规则文件的间隔，单位ms
+	cidr_key_reloadInterval = "reloadInterval"
+
+	// 限定连接到达的监听端口，多个用";"或者","分割
+	cidr_key_ports = "ports"
+
+	// ports中表示tunnel监听的会话
+	cidr_port_tunnel = "tunnel"
+
+	cidr_action_allow = "allow"
+	cidr_action_deny  = "deny"
+
+	default_cidr_reload_interval = 5 * time.Second
+)
+
+// CidrRule ip段规则
+type CidrRule struct {
+	Allow bool
+
+	IpNet *net.IPNet
+}
+
+// ParseCidrRule 解析规则，如"allow 10.0.0.0/8"，"deny 192.168.1.1"
+func ParseCidrRule(rule string) (*CidrRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) != 2 {
+		return nil, errors.New("cidr rule is invalid:" + rule)
+	}
+	var allow bool
+	switch strings.ToLower(fields[0]) {
+	case cidr_action_allow:
+		allow = true
+	case cidr_action_deny:
+		allow = false
+	default:
+		return nil, errors.New("cidr rule action is invalid:" + rule)
+	}
+	cidr := fields[1]
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, errors.New("cidr rule ip is invalid:" + rule)
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("cidr rule is invalid:%v, error:%v", rule, err)
+	}
+	return &CidrRule{Allow: allow, IpNet: ipNet}, nil
+}
+
+func (rule *CidrRule) String() string {
+	if rule.Allow {
+		return cidr_action_allow + " " + rule.IpNet.String()
+	}
+	return cidr_action_deny + " " + rule.IpNet.String()
+}
+
+// parseCidrRules 解析多个规则，忽略空行和"#"开头的注释
+func parseCidrRules(lines []string) ([]*CidrRule, error) {
+	var rules []*CidrRule
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) <= 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseCidrRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// splitCidrConf 多个值支持";"或者","分割
+func splitCidrConf(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ';' || r == ','
+	})
+}
+
+// CidrFilter 按ip段的访问控制过滤器
+type CidrFilter struct {
+	Filter
+
+	// rules配置的规则
+	rules []*CidrRule
+
+	// 未匹配时是否允许
+	defAllow bool
+
+	// 限定的监听端口，为空且未限定tunnel则不限定
+	ports map[int]bool
+
+	// 是否限定tunnel监听的会话
+	tunnel bool
+
+	file string
+
+	reloadInterval time.Duration
+
+	// 规则文件中的规则
+	fileRules []*CidrRule
+
+	fileModTime time.Time
+
+	lastCheck time.Time
+
+	mut sync.RWMutex
+}
+
+// NewCidrFilter 创建按ip段的访问控制过滤器，配置无效则panic
+func NewCidrFilter(parent interface{}, conf IFilterConf) *CidrFilter {
+	f := &CidrFilter{}
+	f.Filter = *NewFilter(parent, conf)
+	extConf := conf.GetExtConf()
+
+	rules, err := parseCidrRules(splitCidrConf(cidrExtString(extConf, cidr_key_rules)))
+	if err != nil {
+		logx.Error(err)
+		panic(err.Error())
+	}
+	f.rules = rules
+
+	defAction := strings.ToLower(cidrExtString(extConf, cidr_key_default))
+	switch defAction {
+	case "", cidr_action_allow:
+		f.defAllow = true
+	case cidr_action_deny:
+		f.defAllow = false
+	default:
+		errMsg := "cidr filter default is invalid:" + defAction
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+
+	ports := splitCidrConf(cidrExtString(extConf, cidr_key_ports))
+	if len(ports) > 0 {
+		f.ports = make(map[int]bool, len(ports))
+		for _, portStr := range ports {
+			portStr = strings.TrimSpace(portStr)
+			if strings.ToLower(portStr) == cidr_port_tunnel {
+				f.tunnel = true
+				continue
+			}
+			port, err := strconv.Atoi(portStr)
+			if err != nil {
+				errMsg := "cidr filter port is invalid:" + portStr
+				logx.Error(errMsg)
+				panic(errMsg)
+			}
+			f.ports[port] = true
+		}
+	}
+
+	f.reloadInterval = default_cidr_reload_interval
+	intervalStr := cidrExtString(extConf, cidr_key_reloadInterval)
+	if len(intervalStr) > 0 {
+		interval, err := strconv.Atoi(intervalStr)
+		if err != nil || interval <= 0 {
+			errMsg := "cidr filter reloadInterval is invalid:" + intervalStr
+			logx.Error(errMsg)
+			panic(errMsg)
+		}
+		f.reloadInterval = time.Duration(interval) * time.Millisecond
+	}
+
+	f.file = cidrExtString(extConf, cidr_key_file)
+	if len(f.file) > 0 {
+		err = f.Reload()
+		if err != nil {
+			logx.Error(err)
+			panic(err.Error())
+		}
+	}
+	logx.Infof("new cidr filter, id:%v, rules:%v, fileRules:%v, defAllow:%v", conf.GetId(), f.rules, f.fileRules, f.defAllow)
+	return f
+}
+
+// cidrExtString 获取扩展配置的字符串值
+func cidrExtString(extConf map[string]interface{}, key string) string {
+	value, found := extConf[key]
+	if !found || value == nil {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprintf("%v", value))
+}
+
+// BeforeAgentChannelActive 检查agent端的ip，拒绝则关闭会话
+func (f *CidrFilter) BeforeAgentChannelActive(ctx gch.IChHandleContext, pattern string, params map[string]interface{}) error {
+	agentChannel := ctx.GetChannel()
+	if !f.matchPort(agentChannel) {
+		return nil
+	}
+	f.checkReload()
+	ip := GetRemoteIp(agentChannel)
+	if f.IsAllowed(ip) {
+		return nil
+	}
+	logx.Warnf("cidr filter deny, chId:%v, ip:%v", agentChannel.GetId(), ip)
+	return NewFilterReject(0, "access denied")
+}
+
+// matchPort 连接是否到达限定的监听端口，tunnel会话只按"tunnel"限定，无法获取本地端口的按限定处理
+func (f *CidrFilter) matchPort(agentChannel gch.IChannel) bool {
+	if len(f.ports) <= 0 && !f.tunnel {
+		return true
+	}
+	_, ok := agentChannel.(*TunnelChannel)
+	if ok {
+		return f.tunnel
+	}
+	addr := agentChannel.LocalAddr()
+	if addr == nil {
+		return true
+	}
+	_, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return true
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return true
+	}
+	return f.ports[port]
+}
+
+// IsAllowed ip是否允许访问，先匹配规则文件中的规则，再匹配rules配置的规则，无效的ip按default处理
+func (f *CidrFilter) IsAllowed(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return f.defAllow
+	}
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	for _, rules := range [][]*CidrRule{f.fileRules, f.rules} {
+		for _, rule := range rules {
+			if rule.IpNet.Contains(ip) {
+				return rule.Allow
+			}
+		}
+	}
+	return f.defAllow
+}
+
+// checkReload 超过检查间隔则检查规则文件的修改时间，有修改则重新加载
+func (f *CidrFilter) checkReload() {
+	if len(f.file) <= 0 {
+		return
+	}
+	f.mut.Lock()
+	now := time.Now()
+	if now.Sub(f.lastCheck) < f.reloadInterval {
+		f.mut.Unlock()
+		return
+	}
+	f.lastCheck = now
+	modTime := f.fileModTime
+	f.mut.Unlock()
+
+	info, err := os.Stat(f.file)
+	if err != nil {
+		logx.Errorf("stat cidr file error, file:%v, error:%v", f.file, err)
+		return
+	}
+	if info.ModTime().Equal(modTime) {
+		return
+	}
+	err = f.Reload()
+	if err != nil {
+		// 保留原有规则
+		logx.Error(err)
+	}
+}
+
+// Reload 重新加载规则文件，加载失败则保留原有规则
+func (f *CidrFilter) Reload() error {
+	if len(f.file) <= 0 {
+		return nil
+	}
+	file, err := os.Open(f.file)
+	if err != nil {
+		return fmt.Errorf("open cidr file error, file:%v, error:%v", f.file, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat cidr file error, file:%v, error:%v", f.file, err)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("read cidr file error, file:%v, error:%v", f.file, err)
+	}
+	rules, err := parseCidrRules(lines)
+	if err != nil {
+		return fmt.Errorf("parse cidr file error, file:%v, error:%v", f.file, err)
+	}
+	f.mut.Lock()
+	f.fileRules = rules
+	f.fileModTime = info.ModTime()
+	f.lastCheck = time.Now()
+	f.mut.Unlock()
+	logx.Infof("reload cidr file, file:%v, rules:%v", f.file, rules)
+	return nil
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestParseCidrRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		want    string
+		wantErr bool
+	}{
+		{"ipv4 cidr", "allow 10.0.0.0/8", "allow 10.0.0.0/8", false},
+		{"ipv4 host bits masked", "deny 192.168.1.77/24", "deny 192.168.1.0/24", false},
+		{"ipv4 single ip", "deny 192.168.1.1", "deny 192.168.1.1/32", false},
+		{"ipv6 cidr", "deny 2001:db8::/32", "deny 2001:db8::/32", false},
+		{"ipv6 single ip", "allow ::1", "allow ::1/128", false},
+		{"action case and spaces", "  ALLOW \t 10.1.0.0/16 ", "allow 10.1.0.0/16", false},
+		{"unknown action", "permit 10.0.0.0/8", "", true},
+		{"missing cidr", "allow", "", true},
+		{"extra field", "allow 10.0.0.0/8 now", "", true},
+		{"invalid ip", "allow 10.0.0.256", "", true},
+		{"invalid mask", "allow 10.0.0.0/33", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCidrRule(tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCidrRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Fatalf("ParseCidrRule() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCidrRules(t *testing.T) {
+	rules, err := parseCidrRules([]string{"# comment", "", "allow 10.0.0.0/8", "  ", "deny ::/0"})
+	if err != nil {
+		t.Fatalf("parseCidrRules() error = %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("parseCidrRules() = %v, want 2 rules", rules)
+	}
+	_, err = parseCidrRules([]string{"allow 10.0.0.0/8", "bad"})
+	if err == nil {
+		t.Fatal("parseCidrRules() error = nil, want error")
+	}
+}
+
+func TestCidrFilterIsAllowed(t *testing.T) {
+	mustRules := func(lines ...string) []*CidrRule {
+		rules, err := parseCidrRules(lines)
+		if err != nil {
+			t.Fatalf("parseCidrRules() error = %v", err)
+		}
+		return rules
+	}
+	filter := &CidrFilter{
+		fileRules: mustRules("deny 10.0.0.1", "allow 2001:db8::1"),
+		rules:     mustRules("allow 10.0.0.0/8", "deny 2001:db8::/32", "allow 192.168.0.0/16"),
+		defAllow:  false,
+	}
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{"ipv4 allowed", "10.1.2.3", true},
+		{"ipv4 file rule first", "10.0.0.1", false},
+		{"ipv4 default", "172.16.0.1", false},
+		{"ipv6 denied", "2001:db8::2", false},
+		{"ipv6 file rule first", "2001:db8::1", true},
+		{"ipv6 default", "2001:db9::1", false},
+		{"4-in-6 allowed", "::ffff:10.1.2.3", true},
+		{"4-in-6 file rule first", "::ffff:10.0.0.1", false},
+		{"4-in-6 second rule", "::ffff:192.168.1.1", true},
+		{"invalid ip", "not-an-ip", false},
+		{"empty ip", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filter.IsAllowed(tt.ip); got != tt.want {
+				t.Fatalf("IsAllowed(%q) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	// 无规则时按default处理
+	allowAll := &CidrFilter{defAllow: true}
+	if !allowAll.IsAllowed("10.0.0.1") || !allowAll.IsAllowed("::1") || !allowAll.IsAllowed("") {
+		t.Fatal("IsAllowed() = false, want default allow")
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * 关闭码和关闭原因的跨协议传递，一端关闭时记录关闭信息(ws关闭帧，tcp FIN/RST，kcp超时等)，
+ * 经IExtension.MapCloseInfo转换后，以对应协议的方式关闭另一端
+ * Author:slive
+ * DATE:2021/4/23
+ */
+package agent
+
+import (
+	"errors"
+	"fmt"
+	gws "github.com/gorilla/websocket"
+	gch "github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/channel/tcpx"
+	"github.com/slive/gsfly/common"
+	logx "github.com/slive/gsfly/logger"
+	"io"
+	"net"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// channel中存放关闭信息的附件key
+	CloseInfo_Attach_key = "closeInfo"
+
+	// ws关闭帧中reason的最大长度
+	max_close_reason_len = 123
+
+	// 发送ws关闭帧的超时时间
+	close_write_timeout = time.Second
+)
+
+// CloseCause 关闭原因分类，用于不同协议间的转换
+type CloseCause int
+
+const (
+	// CLOSE_CAUSE_NORMAL 正常关闭，如ws正常关闭帧，tcp FIN
+	CLOSE_CAUSE_NORMAL CloseCause = iota
+	// CLOSE_CAUSE_RESET 异常断开，如tcp RST，ws未收到关闭帧即断开
+	CLOSE_CAUSE_RESET
+	// CLOSE_CAUSE_TIMEOUT 读超时，如kcp长时间未收到数据
+	CLOSE_CAUSE_TIMEOUT
+	// CLOSE_CAUSE_ERROR 其他异常，如ws非正常关闭码，读写异常
+	CLOSE_CAUSE_ERROR
+)
+
+func (cause CloseCause) String() string {
+	switch cause {
+	case CLOSE_CAUSE_NORMAL:
+		return "normal"
+	case CLOSE_CAUSE_RESET:
+		return "reset"
+	case CLOSE_CAUSE_TIMEOUT:
+		return "timeout"
+	case CLOSE_CAUSE_ERROR:
+		return "error"
+	default:
+		return fmt.Sprintf("unknown(%v)", int(cause))
+	}
+}
+
+// CloseInfo 关闭信息
+type CloseInfo struct {
+	// 关闭端的协议
+	Network gch.Network
+
+	// 关闭原因分类
+	Cause CloseCause
+
+	// ws关闭码，非ws协议按Cause取默认的关闭码
+	Code int
+
+	// 关闭原因
+	Reason string
+}
+
+// NewCloseInfo 创建关闭信息，code<=0则按cause取默认的ws关闭码
+func NewCloseInfo(network gch.Network, cause CloseCause, code int, reason string) *CloseInfo {
+	if code <= 0 {
+		code = defaultCloseCode(cause)
+	}
+	return &CloseInfo{
+		Network: network,
+		Cause:   cause,
+		Code:    code,
+		Reason:  reason,
+	}
+}
+
+func (info *CloseInfo) String() string {
+	return fmt.Sprintf("network:%v, cause:%v, code:%v, reason:%v", info.Network, info.Cause, info.Code, info.Reason)
+}
+
+// defaultCloseCode 按原因分类取默认的ws关闭码
+func defaultCloseCode(cause CloseCause) int {
+	switch cause {
+	case CLOSE_CAUSE_NORMAL:
+		return gws.CloseNormalClosure
+	case CLOSE_CAUSE_RESET:
+		return gws.CloseAbnormalClosure
+	case CLOSE_CAUSE_TIMEOUT:
+		return gws.CloseGoingAway
+	default:
+		return gws.CloseInternalServerErr
+	}
+}
+
+// isSendableCloseCode 是否是可以在ws关闭帧中发送的关闭码，1005，1006，1015只用于本地标识
+func isSendableCloseCode(code int) bool {
+	switch code {
+	case gws.CloseNoStatusReceived, gws.CloseAbnormalClosure, gws.CloseTLSHandshake:
+		return false
+	}
+	return code >= gws.CloseNormalClosure && code < 5000
+}
+
+// onChannelConnectHandle channel建立后，ws协议记录收到的关闭帧
+func onChannelConnectHandle(ctx gch.IChHandleContext) {
+	watchClose(ctx.GetChannel())
+}
+
+// watchClose ws协议收到关闭帧时记录关闭码和原因，和默认处理一致回复关闭帧
+func watchClose(ch gch.IChannel) {
+	wsCh, ok := ch.(*tcpx.WsChannel)
+	if !ok {
+		return
+	}
+	conn := wsCh.Conn
+	conn.SetCloseHandler(func(code int, text string) error {
+		cause := CLOSE_CAUSE_ERROR
+		if code == gws.CloseNormalClosure || code == gws.CloseGoingAway {
+			cause = CLOSE_CAUSE_NORMAL
+		}
+		recordCloseInfo(ch, NewCloseInfo(gch.NETWORK_WS, cause, code, text))
+		message := []byte{}
+		if code != gws.CloseNoStatusReceived {
+			message = gws.FormatCloseMessage(code, "")
+		}
+		conn.WriteControl(gws.CloseMessage, message, time.Now().Add(close_write_timeout))
+		return nil
+	})
+}
+
+// onChannelErrorHandle channel出错时记录关闭信息，出错后channel一般会被释放
+func onChannelErrorHandle(ctx gch.IChHandleContext) {
+	err := ctx.GetError()
+	logx.Errorf("channel error, chId:%v, error:%v", ctx.GetChannel().GetId(), err)
+	if err == nil {
+		return
+	}
+	ch := ctx.GetChannel()
+	recordCloseInfo(ch, closeInfoFromError(ch.GetConf().GetNetwork(), err))
+}
+
+// recordCloseInfo 记录关闭信息，只保留第一次的记录
+func recordCloseInfo(ch gch.IChannel, info *CloseInfo) {
+	if ch.GetAttach(CloseInfo_Attach_key) != nil {
+		return
+	}
+	ch.AddAttach(CloseInfo_Attach_key, info)
+}
+
+// closeInfoFromError 根据异常得到关闭信息
+func closeInfoFromError(network gch.Network, err error) *CloseInfo {
+	gerr, ok := err.(common.GError)
+	if ok && gerr.GetErr() != nil {
+		err = gerr.GetErr()
+	}
+	closeErr, ok := err.(*gws.CloseError)
+	if ok {
+		cause := CLOSE_CAUSE_ERROR
+		if closeErr.Code == gws.CloseNormalClosure || closeErr.Code == gws.CloseGoingAway {
+			cause = CLOSE_CAUSE_NORMAL
+		} else if closeErr.Code == gws.CloseAbnormalClosure {
+			cause = CLOSE_CAUSE_RESET
+		}
+		return NewCloseInfo(network, cause, closeErr.Code, closeErr.Text)
+	}
+	reject, ok := err.(*FilterReject)
+	if ok {
+		return NewCloseInfo(network, CLOSE_CAUSE_ERROR, reject.Code, reject.Reason)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return NewCloseInfo(network, CLOSE_CAUSE_NORMAL, 0, string(network)+" closed")
+	}
+	netErr, ok := err.(net.Error)
+	if ok && netErr.Timeout() {
+		return NewCloseInfo(network, CLOSE_CAUSE_TIMEOUT, 0, string(network)+" timeout")
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return NewCloseInfo(network, CLOSE_CAUSE_RESET, 0, string(network)+" reset")
+	}
+	return NewCloseInfo(network, CLOSE_CAUSE_ERROR, 0, err.Error())
+}
+
+// GetCloseInfo 获取channel的关闭信息，没有记录则按读取统计推断：连续读失败且耗时达到读超时的视为超时，
+// ws未收到关闭帧视为异常断开，其他视为正常关闭
+func GetCloseInfo(ch gch.IChannel) *CloseInfo {
+	info, ok := ch.GetAttach(CloseInfo_Attach_key).(*CloseInfo)
+	if ok {
+		return info
+	}
+	network := ch.GetConf().GetNetwork()
+	readTimeout := ch.GetConf().GetReadTimeout()
+	revStatis := ch.GetChStatis().RevStatics
+	if readTimeout > 0 && revStatis.FailTimes > 0 && revStatis.Current.SpendTime >= float64(readTimeout) {
+		return NewCloseInfo(network, CLOSE_CAUSE_TIMEOUT, 0, string(network)+" timeout")
+	}
+	if network == gch.NETWORK_WS {
+		return NewCloseInfo(network, CLOSE_CAUSE_RESET, 0, "ws closed without close frame")
+	}
+	return NewCloseInfo(network, CLOSE_CAUSE_NORMAL, 0, string(network)+" closed")
+}
+
+// closePeer fromChannel关闭后，按映射后的关闭信息关闭toChannel
+func closePeer(extension IExtension, fromChannel gch.IChannel, toChannel gch.IChannel) {
+	if toChannel.IsClosed() {
+		return
+	}
+	info := mapCloseInfoBy(extension, fromChannel, toChannel, GetCloseInfo(fromChannel))
+	if info != nil {
+		logx.Infof("close peer, fromChId:%v, toChId:%v, %v", fromChannel.GetId(), toChannel.GetId(), info)
+		closeWithInfo(toChannel, info)
+	}
+	toChannel.Release()
+}
+
+// closeWithInfo 释放前按协议发送关闭信息：ws发送关闭帧，tcp非正常关闭时发送RST，kcp和udp无关闭信令
+func closeWithInfo(ch gch.IChannel, info *CloseInfo) {
+	recordCloseInfo(ch, info)
+	switch ch.GetConf().GetNetwork() {
+	case gch.NETWORK_WS:
+		wsCh, ok := ch.(*tcpx.WsChannel)
+		if !ok || !isSendableCloseCode(info.Code) {
+			return
+		}
+		reason := info.Reason
+		if len(reason) > max_close_reason_len {
+			// 按utf8字符截断
+			end := max_close_reason_len
+			for end > 0 && !utf8.RuneStart(reason[end]) {
+				end--
+			}
+			reason = reason[:end]
+		}
+		message := gws.FormatCloseMessage(info.Code, reason)
+		err := wsCh.Conn.WriteControl(gws.CloseMessage, message, time.Now().Add(close_write_timeout))
+		if err != nil {
+			logx.Warnf("write close message error, chId:%v, error:%v", ch.GetId(), err)
+		}
+	case gch.NETWORK_TCP:
+		if info.Cause == CLOSE_CAUSE_NORMAL {
+			return
+		}
+		tcpCh, ok := ch.(*tcpx.TcpChannel)
+		if ok && tcpCh.Conn != nil {
+			// linger为0时关闭会发送RST
+			tcpCh.Conn.SetLinger(0)
+		}
+	}
+}
+
+// mapCloseInfo 默认的关闭信息映射：
+// 1、到ws端，来源也是ws且关闭码可发送则保持关闭码和原因，否则按原因分类：正常1000，超时1001，异常断开和其他异常1011
+// 2、到tcp端，正常关闭则FIN，其他则RST，ws来源的1000和1001视为正常关闭
+// 3、到kcp和udp端，无关闭信令，直接释放
+func mapCloseInfo(fromChannel gch.IChannel, toChannel gch.IChannel, info *CloseInfo) *CloseInfo {
+	toNetwork := toChannel.GetConf().GetNetwork()
+	ret := &CloseInfo{Network: info.Network, Cause: info.Cause, Code: info.Code, Reason: info.Reason}
+	if toNetwork != gch.NETWORK_WS {
+		return ret
+	}
+	if info.Network == gch.NETWORK_WS && isSendableCloseCode(info.Code) {
+		return ret
+	}
+	switch info.Cause {
+	case CLOSE_CAUSE_NORMAL:
+		ret.Code = gws.CloseNormalClosure
+	case CLOSE_CAUSE_TIMEOUT:
+		ret.Code = gws.CloseGoingAway
+	default:
+		ret.Code = gws.CloseInternalServerErr
+	}
+	return ret
+}
@@ -9,6 +9,7 @@ import (
 	logx "github.com/slive/gsfly/logger"
 	"github.com/slive/gsfly/socket"
 	"sync"
+	"time"
 )
 
 type IServiceConf interface {
@@ -86,12 +87,29 @@ func (sc *ServiceConf) GetFilterConfs() map[string]IFilterConf {
 	return sc.FilterConfs
 }
 
+// AddFilterConf 添加过滤器配置，id相同则覆盖
+func (sc *ServiceConf) AddFilterConf(filterConfs ...IFilterConf) {
+	for _, filterConf := range filterConfs {
+		filterConf.SetParent(sc)
+		sc.FilterConfs[filterConf.GetId()] = filterConf
+	}
+}
+
 type IAgServerConf interface {
 	socket.IServerConf
 
 	GetServerConf() socket.IServerConf
 
 	GetLocationConfs() map[string]ILocationConf
+
+	// GetTags 获取server的标签，如zone=a
+	GetTags() map[string]string
+
+	// GetAsyncDialConf 异步拨号配置，为nil则在agentChannel激活时同步拨号
+	GetAsyncDialConf() *AsyncDialConf
+
+	// GetTunnelServerConf 接收边缘agent链路的tunnel监听配置，为nil则不监听
+	GetTunnelServerConf() *TunnelServerConf
 }
 
 type AgServerConf struct {
@@ -100,6 +118,15 @@ type AgServerConf struct {
 
 	LocationConfs []ILocationConf
 
+	// 标签，如zone=a，用于就近(同zone)负载均衡等
+	Tags map[string]string
+
+	// 异步拨号配置
+	AsyncDialConf *AsyncDialConf
+
+	// tunnel监听配置
+	TunnelServerConf *TunnelServerConf
+
 	locationConfMap map[string]ILocationConf
 
 	locationOne sync.Once
@@ -123,6 +150,7 @@ func NewAgServerConf(id string, serverConf socket.IServerConf, locationConfs ...
 	b := &AgServerConf{
 		IServerConf:  serverConf,
 		LocationConfs: locationConfs,
+		Tags:          make(map[string]string),
 	}
 
 	b.SetId(id)
@@ -150,14 +178,33 @@ func (asc *AgServerConf) GetLocationConfs() map[string]ILocationConf {
 	return asc.locationConfMap
 }
 
+func (asc *AgServerConf) GetTags() map[string]string {
+	return asc.Tags
+}
+
+func (asc *AgServerConf) GetAsyncDialConf() *AsyncDialConf {
+	return asc.AsyncDialConf
+}
+
+func (asc *AgServerConf) GetTunnelServerConf() *TunnelServerConf {
+	return asc.TunnelServerConf
+}
+
 // IFilterConf 过滤器的配置，根据pattern找到对应的filter，然后获取到filter进行处理
 type IFilterConf interface {
 	common.IParent
 
 	common.IId
 
+	// GetFilterType 过滤器类型，由IExtension.CreateFilter按类型创建
+	GetFilterType() string
+
+	// GetPattern 匹配location的pattern，为空匹配所有，"*"结尾则按前缀匹配，否则全匹配
 	GetPattern() string
 
+	// GetOrder 执行顺序，小的先执行
+	GetOrder() int
+
 	GetExtConf() map[string]interface{}
 }
 
@@ -167,39 +214,55 @@ type FilterConf struct {
 
 	common.Id
 
+	FilterType string
+
 	Pattern string
 
+	Order int
+
 	// 可变配置
 	ExtConf map[string]interface{}
 }
 
-func NewFilterConf(id string, pattern string, extConf map[string]interface{}) *FilterConf {
+func NewFilterConf(id string, filterType string, pattern string, extConf map[string]interface{}) *FilterConf {
 	if len(id) <= 0 {
-		errMsg := "service id is nil"
+		errMsg := "filter id is nil"
 		logx.Error(errMsg)
 		panic(errMsg)
 	}
 
-	if &pattern == nil {
-		errMsg := "Pattern id is nil"
+	if len(filterType) <= 0 {
+		errMsg := "filter type is nil"
 		logx.Error(errMsg)
 		panic(errMsg)
 	}
 
 	logx.Info("start to NewFilterConf, id:", id)
+	if extConf == nil {
+		extConf = make(map[string]interface{})
+	}
 	b := &FilterConf{
-		Pattern: pattern,
-		ExtConf: extConf,
+		FilterType: filterType,
+		Pattern:    pattern,
+		ExtConf:    extConf,
 	}
 	b.SetId(id)
 	logx.Info("finish to NewFilterConf, conf:", b)
 	return b
 }
 
+func (fc *FilterConf) GetFilterType() string {
+	return fc.FilterType
+}
+
 func (fc *FilterConf) GetPattern() string {
 	return fc.Pattern
 }
 
+func (fc *FilterConf) GetOrder() int {
+	return fc.Order
+}
+
 func (fc *FilterConf) GetExtConf() map[string]interface{} {
 	return fc.ExtConf
 }
@@ -213,6 +276,15 @@ type ILocationConf interface {
 	GetUpstreamId() string
 
 	GetExtConf() map[string]interface{}
+
+	// GetMirrorUpstreamId 流量镜像的upstreamId，为空则不镜像
+	GetMirrorUpstreamId() string
+
+	// GetMirrorPercent 流量镜像的会话比例，0-100，0则不镜像，未配置则为MIRROR_PERCENT_UNSET
+	GetMirrorPercent() float64
+
+	// GetBindingConf 多个upstream的绑定配置，为空则只使用UpstreamId
+	GetBindingConf() *BindingConf
 }
 
 type LocationConf struct {
@@ -222,6 +294,15 @@ type LocationConf struct {
 
 	UpstreamId string
 
+	// 流量镜像的upstreamId
+	MirrorUpstreamId string
+
+	// 流量镜像的会话比例，未配置则为MIRROR_PERCENT_UNSET
+	MirrorPercent float64
+
+	// 多个upstream的绑定配置
+	BindingConf *BindingConf
+
 	// 可变配置
 	ExtConf map[string]interface{}
 }
@@ -241,9 +322,10 @@ func NewLocationConf(pattern string, upstreamId string, extConf map[string]inter
 
 	logx.Info("start to NewLocationConf, id:", upstreamId)
 	b := &LocationConf{
-		Pattern:    pattern,
-		UpstreamId: upstreamId,
-		ExtConf:    extConf,
+		Pattern:       pattern,
+		UpstreamId:    upstreamId,
+		MirrorPercent: MIRROR_PERCENT_UNSET,
+		ExtConf:       extConf,
 	}
 	logx.Info("finish to NewLocationConf, conf:", b)
 	return b
@@ -257,6 +339,18 @@ func (lc *LocationConf) GetPattern() string {
 	return lc.Pattern
 }
 
+func (lc *LocationConf) GetMirrorUpstreamId() string {
+	return lc.MirrorUpstreamId
+}
+
+func (lc *LocationConf) GetMirrorPercent() float64 {
+	return lc.MirrorPercent
+}
+
+func (lc *LocationConf) GetBindingConf() *BindingConf {
+	return lc.BindingConf
+}
+
 func (lc *LocationConf) GetExtConf() map[string]interface{} {
 	return lc.ExtConf
 }
@@ -264,8 +358,14 @@ func (lc *LocationConf) GetExtConf() map[string]interface{} {
 type UpstreamType string
 
 const (
-	UPSTREAM_PROXY = "proxy"
-	UPSTREAM_ROUTE = "route"
+	UPSTREAM_PROXY     = "proxy"
+	UPSTREAM_ROUTE     = "route"
+	UPSTREAM_BROADCAST = "broadcast"
+	UPSTREAM_MULTIPLEX = "mux"
+	UPSTREAM_RPC       = "rpc"
+	UPSTREAM_HUB       = "hub"
+	UPSTREAM_MOCK      = "mock"
+	UPSTREAM_TUNNEL    = "tunnel"
 )
 
 // IUpstreamConf upstream包括如下几种场景：
@@ -323,6 +423,48 @@ type IProxyConf interface {
 	GetDstClientConfs() []socket.IClientConf
 
 	GetLoadBalanceType() LoadBalanceType
+
+	// GetLoadBalanceName 负载均衡名称，用于创建ILoadBalance，见RegisterLoadBalance
+	GetLoadBalanceName() string
+
+	// GetSlowStart 慢启动时长，新增或者恢复健康的dst在此时长内权重从很小线性增长到配置的权重，<=0则不启用
+	GetSlowStart() time.Duration
+
+	// GetZoneTag 就近负载均衡使用的标签名，默认为"zone"
+	GetZoneTag() string
+
+	// GetZoneThreshold 就近负载均衡的阈值，同zone可用的dst比例低于该值时，溢出到其他zone
+	GetZoneThreshold() float64
+
+	// GetHealthCheckConf 健康检查配置，为nil则不启用主动健康检查
+	GetHealthCheckConf() *HealthCheckConf
+
+	// GetOutlierConf 异常检测配置，为nil则不启用被动异常检测
+	GetOutlierConf() *OutlierConf
+
+	// GetBreakerConf 熔断配置，为nil则不启用熔断
+	GetBreakerConf() *BreakerConf
+
+	// GetRetryConf 拨号重试配置，为nil则不重试
+	GetRetryConf() *RetryConf
+
+	// GetDstPoolConf 空闲连接池配置，为nil则不启用连接池
+	GetDstPoolConf() *DstPoolConf
+
+	// GetReconnectConf dst端断开后的重连配置，为nil则直接关闭agentChannel
+	GetReconnectConf() *ReconnectConf
+
+	// GetAffinityKey 会话亲和的key，默认从agent端的参数(如ws的query参数)中获取对应的值作为会话key，为空则不启用
+	GetAffinityKey() string
+
+	// GetAffinityTtl 会话亲和的有效期，从会话选中或者释放时开始计算
+	GetAffinityTtl() time.Duration
+
+	// GetDstClientAttr 获取dstClient的附加属性，未设置则返回默认属性
+	GetDstClientAttr(dstClientConf socket.IClientConf) *DstClientAttr
+
+	// SetDstClientAttr 设置dstClient的附加属性
+	SetDstClientAttr(dstClientConf socket.IClientConf, attr *DstClientAttr)
 }
 
 // 常规的（agentChannel）一对(dstChannel)一对等代理方式
@@ -335,6 +477,45 @@ type ProxyConf struct {
 
 	// 负载均衡规则
 	LoadBalanceType LoadBalanceType
+
+	// 负载均衡名称，可以是自定义注册的负载均衡
+	LoadBalanceName string
+
+	// dstClient的附加属性，dstClientConf作为主键
+	DstClientAttrs map[socket.IClientConf]*DstClientAttr
+
+	// 慢启动时长
+	SlowStart time.Duration
+
+	// 会话亲和的key
+	AffinityKey string
+
+	// 会话亲和的有效期
+	AffinityTtl time.Duration
+
+	// 就近负载均衡使用的标签名
+	ZoneTag string
+
+	// 就近负载均衡的阈值
+	ZoneThreshold float64
+
+	// 健康检查配置
+	HealthCheckConf *HealthCheckConf
+
+	// 异常检测配置
+	OutlierConf *OutlierConf
+
+	// 熔断配置
+	BreakerConf *BreakerConf
+
+	// 拨号重试配置
+	RetryConf *RetryConf
+
+	// 空闲连接池配置
+	DstPoolConf *DstPoolConf
+
+	// 重连配置
+	ReconnectConf *ReconnectConf
 }
 
 func NewProxyConf(id string, loadBalanceType LoadBalanceType, dstClientConfs ...socket.IClientConf) *ProxyConf {
@@ -343,15 +524,29 @@ func NewProxyConf(id string, loadBalanceType LoadBalanceType, dstClientConfs ...
 		logx.Error(errMsg)
 		panic(errMsg)
 	}
-	p := &ProxyConf{DstClientConfs: make([]socket.IClientConf, len(dstClientConfs))}
+	p := &ProxyConf{
+		DstClientConfs: make([]socket.IClientConf, len(dstClientConfs)),
+		DstClientAttrs: make(map[socket.IClientConf]*DstClientAttr, len(dstClientConfs)),
+	}
 	for index, conf := range dstClientConfs {
 		p.DstClientConfs[index] = conf
 	}
 	p.UpstreamConf = *NewUpstreamConf(id, UPSTREAM_PROXY)
 	p.LoadBalanceType = loadBalanceType
+	p.LoadBalanceName = loadBalanceType.String()
+	p.ZoneTag = default_zone_tag
+	p.ZoneThreshold = default_zone_threshold
 	return p
 }
 
+const (
+	// 默认的就近负载均衡标签名
+	default_zone_tag = "zone"
+
+	// 默认的就近负载均衡阈值
+	default_zone_threshold = 0.5
+)
+
 func (pc *ProxyConf) GetDstClientConfs() []socket.IClientConf {
 	return pc.DstClientConfs
 }
@@ -359,3 +554,106 @@ func (pc *ProxyConf) GetDstClientConfs() []socket.IClientConf {
 func (pc *ProxyConf) GetLoadBalanceType() LoadBalanceType {
 	return pc.LoadBalanceType
 }
+
+func (pc *ProxyConf) GetLoadBalanceName() string {
+	return pc.LoadBalanceName
+}
+
+func (pc *ProxyConf) GetSlowStart() time.Duration {
+	return pc.SlowStart
+}
+
+func (pc *ProxyConf) GetZoneTag() string {
+	return pc.ZoneTag
+}
+
+func (pc *ProxyConf) GetZoneThreshold() float64 {
+	return pc.ZoneThreshold
+}
+
+func (pc *ProxyConf) GetHealthCheckConf() *HealthCheckConf {
+	return pc.HealthCheckConf
+}
+
+func (pc *ProxyConf) GetOutlierConf() *OutlierConf {
+	return pc.OutlierConf
+}
+
+func (pc *ProxyConf) GetBreakerConf() *BreakerConf {
+	return pc.BreakerConf
+}
+
+func (pc *ProxyConf) GetRetryConf() *RetryConf {
+	return pc.RetryConf
+}
+
+func (pc *ProxyConf) GetDstPoolConf() *DstPoolConf {
+	return pc.DstPoolConf
+}
+
+func (pc *ProxyConf) GetReconnectConf() *ReconnectConf {
+	return pc.ReconnectConf
+}
+
+func (pc *ProxyConf) GetAffinityKey() string {
+	return pc.AffinityKey
+}
+
+func (pc *ProxyConf) GetAffinityTtl() time.Duration {
+	return pc.AffinityTtl
+}
+
+func (pc *ProxyConf) GetDstClientAttr(dstClientConf socket.IClientConf) *DstClientAttr {
+	attr, found := pc.DstClientAttrs[dstClientConf]
+	if found {
+		return attr
+	}
+	return defaultDstClientAttr
+}
+
+func (pc *ProxyConf) SetDstClientAttr(dstClientConf socket.IClientConf, attr *DstClientAttr) {
+	if attr != nil {
+		pc.DstClientAttrs[dstClientConf] = attr
+	}
+}
+
+// DstClientAttr dstClient的附加属性，用于负载均衡时分组选择和按比例选择
+type DstClientAttr struct {
+	// 权重，默认为1
+	Weight int
+
+	// 优先级，值越小越优先，默认为0
+	Priority int
+
+	// 是否为备用，备用的dstClient在所有非备用的都不可用时才会被选用
+	Backup bool
+
+	// 最大连接数，<=0则不限制，达到最大连接数视为不可用
+	MaxChannelSize int
+
+	// 标签，如zone=a，用于就近(同zone)负载均衡等
+	Tags map[string]string
+}
+
+func NewDstClientAttr(weight int, priority int, backup bool, maxChannelSize int) *DstClientAttr {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &DstClientAttr{
+		Weight:         weight,
+		Priority:       priority,
+		Backup:         backup,
+		MaxChannelSize: maxChannelSize,
+		Tags:           make(map[string]string),
+	}
+}
+
+// HigherThan 是否比other优先，非备用优先于备用，然后比较Priority
+func (attr *DstClientAttr) HigherThan(other *DstClientAttr) bool {
+	if attr.Backup != other.Backup {
+		return !attr.Backup
+	}
+	return attr.Priority < other.Priority
+}
+
+var defaultDstClientAttr = NewDstClientAttr(1, 0, false, 0)
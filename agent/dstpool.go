@@ -0,0 +1,260 @@
+/*
+ * dst端预先拨号的空闲连接池，InitChannelPeer时直接取出空闲连接，不再阻塞在拨号上，
+ * 空闲连接拨号时没有agent端的参数，带参数的会话(如ws的query参数需转发到dst)不使用连接池
+ * Author:slive
+ * DATE:2021/4/20
+ */
+package agent
+
+import (
+	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
+	"sync"
+	"time"
+)
+
+const (
+	default_pool_min_idle     = 1
+	default_pool_max_lifetime = 5 * time.Minute
+
+	// 未配置拨号超时时，空闲连接的拨号超时
+	default_pool_dial_timeout = 5 * time.Second
+
+	// 空闲连接的维护间隔
+	pool_maintain_interval = time.Second
+)
+
+// DstPoolConf dst连接池配置
+type DstPoolConf struct {
+	// 最少空闲连接数，不足时后台补充
+	MinIdle int
+
+	// 最多空闲连接数，超过则释放
+	MaxIdle int
+
+	// 空闲连接的最长存活时间，超过则释放，已绑定会话的连接不受限制
+	MaxLifetime time.Duration
+}
+
+// NewDstPoolConf 创建dst连接池配置，参数<=0则取默认值，maxIdle不小于minIdle
+func NewDstPoolConf(minIdle int, maxIdle int, maxLifetime time.Duration) *DstPoolConf {
+	if minIdle <= 0 {
+		minIdle = default_pool_min_idle
+	}
+	if maxIdle < minIdle {
+		maxIdle = minIdle
+	}
+	if maxLifetime <= 0 {
+		maxLifetime = default_pool_max_lifetime
+	}
+	return &DstPoolConf{
+		MinIdle:     minIdle,
+		MaxIdle:     maxIdle,
+		MaxLifetime: maxLifetime,
+	}
+}
+
+// DstDialer 拨号到dst，连接池使用
+type DstDialer func(dstClientConf socket.IClientConf) (*socket.ClientSocket, error)
+
+// DstAvailable dst是否可以拨号，如不健康则不补充空闲连接
+type DstAvailable func(dstClientConf socket.IClientConf) bool
+
+type idleConn struct {
+	clientConn *socket.ClientSocket
+	createTime time.Time
+}
+
+// DstPool 单个dst的空闲连接池
+type DstPool struct {
+	dstClientConf socket.IClientConf
+
+	conf *DstPoolConf
+
+	dialer DstDialer
+
+	available DstAvailable
+
+	idles []*idleConn
+
+	// 正在拨号的连接数
+	dialing int
+
+	mut sync.Mutex
+
+	// 取出连接后，通知后台补充
+	refill chan bool
+
+	exit chan bool
+
+	startOnce sync.Once
+
+	stopOnce sync.Once
+}
+
+// NewDstPool 创建dst空闲连接池
+// dstClientConf dst配置
+// conf 连接池配置
+// dialer 拨号方法
+// available dst是否可以拨号，可为nil
+func NewDstPool(dstClientConf socket.IClientConf, conf *DstPoolConf, dialer DstDialer, available DstAvailable) *DstPool {
+	if dialer == nil {
+		errMsg := "pool dialer is nil."
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	return &DstPool{
+		dstClientConf: dstClientConf,
+		conf:          conf,
+		dialer:        dialer,
+		available:     available,
+		refill:        make(chan bool, 1),
+		exit:          make(chan bool),
+	}
+}
+
+// Start 启动后台维护，补充空闲连接和释放过期连接
+func (pool *DstPool) Start() {
+	pool.startOnce.Do(func() {
+		go pool.loop()
+	})
+}
+
+// Stop 停止后台维护并释放所有空闲连接
+func (pool *DstPool) Stop() {
+	pool.stopOnce.Do(func() {
+		close(pool.exit)
+		pool.mut.Lock()
+		idles := pool.idles
+		pool.idles = nil
+		pool.mut.Unlock()
+		for _, idle := range idles {
+			pool.release(idle)
+		}
+	})
+}
+
+// Get 取出一个可用的空闲连接，没有则返回nil
+func (pool *DstPool) Get() *socket.ClientSocket {
+	now := time.Now()
+	var expired []*idleConn
+	var ret *socket.ClientSocket
+	pool.mut.Lock()
+	for len(pool.idles) > 0 {
+		// 优先取最新的连接
+		last := len(pool.idles) - 1
+		idle := pool.idles[last]
+		pool.idles = pool.idles[:last]
+		if idle.clientConn.GetChannel().IsClosed() {
+			continue
+		}
+		if now.Sub(idle.createTime) >= pool.conf.MaxLifetime {
+			expired = append(expired, idle)
+			continue
+		}
+		ret = idle.clientConn
+		break
+	}
+	pool.mut.Unlock()
+	for _, idle := range expired {
+		pool.release(idle)
+	}
+
+	// 通知后台补充
+	select {
+	case pool.refill <- true:
+	default:
+	}
+	return ret
+}
+
+// GetIdleSize 获取空闲连接数
+func (pool *DstPool) GetIdleSize() int {
+	pool.mut.Lock()
+	defer pool.mut.Unlock()
+	return len(pool.idles)
+}
+
+func (pool *DstPool) loop() {
+	defer func() {
+		ret := recover()
+		if ret != nil {
+			logx.Error("dst pool error:", ret)
+		}
+	}()
+	ticker := time.NewTicker(pool_maintain_interval)
+	defer ticker.Stop()
+	for {
+		pool.maintain()
+		select {
+		case <-pool.exit:
+			return
+		case <-ticker.C:
+		case <-pool.refill:
+		}
+	}
+}
+
+// maintain 释放已关闭，过期和多余的空闲连接，不足MinIdle则补充
+func (pool *DstPool) maintain() {
+	now := time.Now()
+	var releases []*idleConn
+	pool.mut.Lock()
+	idles := pool.idles[:0]
+	for _, idle := range pool.idles {
+		if idle.clientConn.GetChannel().IsClosed() {
+			continue
+		}
+		if now.Sub(idle.createTime) >= pool.conf.MaxLifetime || len(idles) >= pool.conf.MaxIdle {
+			releases = append(releases, idle)
+			continue
+		}
+		idles = append(idles, idle)
+	}
+	pool.idles = idles
+	need := pool.conf.MinIdle - len(pool.idles) - pool.dialing
+	if need > 0 {
+		pool.dialing += need
+	}
+	pool.mut.Unlock()
+
+	for _, idle := range releases {
+		pool.release(idle)
+	}
+	for i := 0; i < need; i++ {
+		pool.dial()
+	}
+}
+
+func (pool *DstPool) dial() {
+	defer func() {
+		pool.mut.Lock()
+		pool.dialing--
+		pool.mut.Unlock()
+	}()
+	if pool.available != nil && !pool.available(pool.dstClientConf) {
+		return
+	}
+	clientConn, err := pool.dialer(pool.dstClientConf)
+	if err != nil {
+		logx.Warnf("dial pool conn error, dst:%v, error:%v", pool.dstClientConf.GetAddrStr(), err)
+		return
+	}
+	pool.mut.Lock()
+	select {
+	case <-pool.exit:
+		// 已停止
+		pool.mut.Unlock()
+		clientConn.GetChannel().Release()
+		return
+	default:
+	}
+	pool.idles = append(pool.idles, &idleConn{clientConn: clientConn, createTime: time.Now()})
+	pool.mut.Unlock()
+}
+
+func (pool *DstPool) release(idle *idleConn) {
+	dstCh := idle.clientConn.GetChannel()
+	logx.Debug("release pool conn, dstChId:", dstCh.GetId())
+	dstCh.Release()
+}
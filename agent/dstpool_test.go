@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/socket"
+)
+
+// testOpenChannel 已打开的channel，记录释放次数
+type testOpenChannel struct {
+	*channel.Channel
+	released int32
+}
+
+func newTestOpenChannel() *testOpenChannel {
+	ch := &testOpenChannel{Channel: channel.NewSimpleChannel(func(ctx channel.IChHandleContext) {})}
+	ch.SetClosed(false)
+	return ch
+}
+
+func (ch *testOpenChannel) Release() {
+	atomic.AddInt32(&ch.released, 1)
+	ch.SetClosed(true)
+}
+
+func (ch *testOpenChannel) getReleased() int32 {
+	return atomic.LoadInt32(&ch.released)
+}
+
+func newTestClientConn() (*socket.ClientSocket, *testOpenChannel) {
+	dstCh := newTestOpenChannel()
+	return &socket.ClientSocket{Channel: dstCh}, dstCh
+}
+
+// testDialer 记录拨号次数和拨出的dstChannel
+type testDialer struct {
+	dials  int
+	dstChs []*testOpenChannel
+	err    error
+}
+
+func (d *testDialer) dial(dstClientConf socket.IClientConf) (*socket.ClientSocket, error) {
+	d.dials++
+	if d.err != nil {
+		return nil, d.err
+	}
+	clientConn, dstCh := newTestClientConn()
+	d.dstChs = append(d.dstChs, dstCh)
+	return clientConn, nil
+}
+
+func newTestPool(conf *DstPoolConf, dialer *testDialer, available DstAvailable) *DstPool {
+	return NewDstPool(socket.NewTcpClientConf("127.0.0.1", 19000), conf, dialer.dial, available)
+}
+
+// addIdle 放入指定创建时间的空闲连接
+func addIdle(pool *DstPool, createTime time.Time) *testOpenChannel {
+	clientConn, dstCh := newTestClientConn()
+	pool.idles = append(pool.idles, &idleConn{clientConn: clientConn, createTime: createTime})
+	return dstCh
+}
+
+func TestDstPoolRefill(t *testing.T) {
+	dialer := &testDialer{}
+	pool := newTestPool(NewDstPoolConf(2, 3, time.Minute), dialer, nil)
+	pool.maintain()
+	if dialer.dials != 2 || pool.GetIdleSize() != 2 {
+		t.Fatalf("dials = %v, idles = %v, want 2, 2", dialer.dials, pool.GetIdleSize())
+	}
+	// 已满足MinIdle，不再拨号
+	pool.maintain()
+	if dialer.dials != 2 {
+		t.Fatalf("dials = %v after refilled, want 2", dialer.dials)
+	}
+
+	// 取出最新的连接
+	got := pool.Get()
+	if got == nil || got.GetChannel() != dialer.dstChs[1] {
+		t.Fatalf("Get() = %v, want newest conn", got)
+	}
+	if pool.GetIdleSize() != 1 {
+		t.Fatalf("idles = %v after Get(), want 1", pool.GetIdleSize())
+	}
+	pool.maintain()
+	if dialer.dials != 3 || pool.GetIdleSize() != 2 {
+		t.Fatalf("dials = %v, idles = %v after checkout, want 3, 2", dialer.dials, pool.GetIdleSize())
+	}
+}
+
+func TestDstPoolRefillSkipped(t *testing.T) {
+	tests := []struct {
+		name      string
+		dialErr   error
+		available DstAvailable
+		wantDials int
+	}{
+		{"dst unavailable", nil, func(dstClientConf socket.IClientConf) bool { return false }, 0},
+		{"dial error", errors.New("refused"), nil, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := &testDialer{err: tt.dialErr}
+			pool := newTestPool(NewDstPoolConf(2, 2, time.Minute), dialer, tt.available)
+			pool.maintain()
+			if dialer.dials != tt.wantDials || pool.GetIdleSize() != 0 {
+				t.Fatalf("dials = %v, idles = %v, want %v, 0", dialer.dials, pool.GetIdleSize(), tt.wantDials)
+			}
+			if pool.dialing != 0 {
+				t.Fatalf("dialing = %v, want 0", pool.dialing)
+			}
+		})
+	}
+}
+
+func TestDstPoolGetSkipsStale(t *testing.T) {
+	pool := newTestPool(NewDstPoolConf(1, 4, time.Minute), &testDialer{}, nil)
+	now := time.Now()
+	valid := addIdle(pool, now)
+	expired := addIdle(pool, now.Add(-2*time.Minute))
+	closed := addIdle(pool, now)
+	closed.SetClosed(true)
+
+	got := pool.Get()
+	if got == nil || got.GetChannel() != valid {
+		t.Fatalf("Get() = %v, want the valid conn", got)
+	}
+	if expired.getReleased() != 1 {
+		t.Fatalf("expired conn released = %v, want 1", expired.getReleased())
+	}
+	if closed.getReleased() != 0 {
+		t.Fatalf("closed conn released = %v, want 0", closed.getReleased())
+	}
+	if got := pool.Get(); got != nil {
+		t.Fatalf("Get() of empty pool = %v, want nil", got)
+	}
+}
+
+func TestDstPoolMaintainEvicts(t *testing.T) {
+	dialer := &testDialer{}
+	pool := newTestPool(NewDstPoolConf(1, 2, time.Minute), dialer, nil)
+	now := time.Now()
+	expired := addIdle(pool, now.Add(-2*time.Minute))
+	closed := addIdle(pool, now)
+	closed.SetClosed(true)
+	kept := []*testOpenChannel{addIdle(pool, now), addIdle(pool, now)}
+	surplus := addIdle(pool, now)
+
+	pool.maintain()
+	if expired.getReleased() != 1 || surplus.getReleased() != 1 {
+		t.Fatalf("released expired = %v, surplus = %v, want 1, 1", expired.getReleased(), surplus.getReleased())
+	}
+	for _, dstCh := range kept {
+		if dstCh.getReleased() != 0 {
+			t.Fatal("kept conn released")
+		}
+	}
+	if pool.GetIdleSize() != 2 || dialer.dials != 0 {
+		t.Fatalf("idles = %v, dials = %v, want 2, 0", pool.GetIdleSize(), dialer.dials)
+	}
+}
+
+func TestDstPoolStop(t *testing.T) {
+	dialer := &testDialer{}
+	pool := newTestPool(NewDstPoolConf(2, 2, time.Minute), dialer, nil)
+	pool.maintain()
+	pool.Stop()
+	for _, dstCh := range dialer.dstChs {
+		if dstCh.getReleased() != 1 {
+			t.Fatal("idle conn not released after Stop()")
+		}
+	}
+	if pool.GetIdleSize() != 0 {
+		t.Fatalf("idles = %v after Stop(), want 0", pool.GetIdleSize())
+	}
+
+	// 停止后拨号成功的连接直接释放
+	pool.dialing++
+	pool.dial()
+	last := dialer.dstChs[len(dialer.dstChs)-1]
+	if last.getReleased() != 1 || pool.GetIdleSize() != 0 {
+		t.Fatalf("released = %v, idles = %v after dial on stopped pool, want 1, 0", last.getReleased(), pool.GetIdleSize())
+	}
+}
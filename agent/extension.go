@@ -9,6 +9,7 @@
 package agent
 
 import (
+	"fmt"
 	gch "github.com/slive/gsfly/channel"
 	"github.com/slive/gsfly/channel/tcpx"
 	"github.com/slive/gsfly/common"
@@ -53,6 +54,70 @@ type IExtension interface {
 	SetExtConf(extConf map[string]string)
 }
 
+// 以下为可选的扩展接口，IExtension的实现按需实现，未实现则使用默认处理，嵌入*Extension即全部实现
+
+// IFilterCreator 可选扩展，创建Filter，未实现则只支持内置的filter
+type IFilterCreator interface {
+	// CreateFilter 实现不同的Filter，如自定义的filter
+	CreateFilter(filterConf IFilterConf) IFilter
+}
+
+// ISessionKeyGetter 可选扩展，获取会话亲和的key，未实现则取参数中affinityKey对应的值
+type ISessionKeyGetter interface {
+	// GetSessionKey 获取会话亲和的key，为空则不使用会话亲和，params为GetLocationPattern获取到的参数
+	GetSessionKey(ctx gch.IChHandleContext, upstream IUpstream, params map[string]interface{}) string
+}
+
+// IDstReconnectListener 可选扩展，dst端重连成功的通知
+type IDstReconnectListener interface {
+	// AfterDstReconnect dst端断开后重连成功，在发送缓存的消息前调用，如向新的dstChannel发送重新同步的消息
+	AfterDstReconnect(agentCtx gch.IChHandleContext, upstream IUpstream, dstChannel gch.IChannel)
+}
+
+// ICloseInfoMapper 可选扩展，转换关闭信息，未实现则按协议映射关闭码
+type ICloseInfoMapper interface {
+	// MapCloseInfo 一端关闭后，转换关闭信息用于关闭另一端，返回nil则直接释放另一端
+	// fromChannel 已关闭的一端
+	// toChannel 待关闭的另一端
+	// info fromChannel的关闭信息
+	MapCloseInfo(fromChannel gch.IChannel, toChannel gch.IChannel, info *CloseInfo) *CloseInfo
+}
+
+// createFilter 由扩展创建Filter，未实现IFilterCreator则创建内置的filter
+func createFilter(extension IExtension, filterConf IFilterConf) IFilter {
+	creator, ok := extension.(IFilterCreator)
+	if ok {
+		return creator.CreateFilter(filterConf)
+	}
+	return newBuiltinFilter(extension.GetParent(), filterConf)
+}
+
+// getSessionKey 由扩展获取会话亲和的key，未实现ISessionKeyGetter则取默认值
+func getSessionKey(extension IExtension, ctx gch.IChHandleContext, upstream IUpstream, params map[string]interface{}) string {
+	getter, ok := extension.(ISessionKeyGetter)
+	if ok {
+		return getter.GetSessionKey(ctx, upstream, params)
+	}
+	return defaultSessionKey(upstream, params)
+}
+
+// afterDstReconnect 通知扩展dst端重连成功，未实现IDstReconnectListener则忽略
+func afterDstReconnect(extension IExtension, agentCtx gch.IChHandleContext, upstream IUpstream, dstChannel gch.IChannel) {
+	listener, ok := extension.(IDstReconnectListener)
+	if ok {
+		listener.AfterDstReconnect(agentCtx, upstream, dstChannel)
+	}
+}
+
+// mapCloseInfoBy 由扩展转换关闭信息，未实现ICloseInfoMapper则按协议映射
+func mapCloseInfoBy(extension IExtension, fromChannel gch.IChannel, toChannel gch.IChannel, info *CloseInfo) *CloseInfo {
+	mapper, ok := extension.(ICloseInfoMapper)
+	if ok {
+		return mapper.MapCloseInfo(fromChannel, toChannel, info)
+	}
+	return mapCloseInfo(fromChannel, toChannel, info)
+}
+
 // Extension 代理扩展实现，所有代理可实现功能，基本都在这里实现
 type Extension struct {
 	common.Parent
@@ -113,6 +178,14 @@ func (e *Extension) GetLocationPattern(ctx gch.IChHandleContext) (localPattern s
 	protocol := agentChannel.GetConf().GetNetwork()
 	localPattern = ""
 	params = make(map[string]interface{})
+	tunnelCh, ok := agentChannel.(*TunnelChannel)
+	if ok {
+		// tunnel的会话使用客户端连接边缘agent时的path和参数
+		params = tunnelCh.GetParams()
+		localPattern = tunnelCh.GetRelativePath()
+		logx.Infof("tunnel channel params:%v, localPattern:%v", params, localPattern)
+		return localPattern, params
+	}
 	switch protocol {
 	case gch.NETWORK_WS:
 		wsChannel := agentChannel.(*tcpx.WsChannel)
@@ -139,6 +212,48 @@ func (e *Extension) CreateUpstream(upsConf IUpstreamConf) IUpstream {
 		} else {
 			panic("upstream conf is invalid.")
 		}
+	} else if upsType == UPSTREAM_BROADCAST {
+		broadcastConf, ok := upsConf.(IBroadcastConf)
+		if ok {
+			ups = NewBroadcast(e.GetParent(), broadcastConf, e)
+		} else {
+			panic("upstream conf is invalid.")
+		}
+	} else if upsType == UPSTREAM_MULTIPLEX {
+		multiplexConf, ok := upsConf.(IMultiplexConf)
+		if ok {
+			ups = NewMultiplex(e.GetParent(), multiplexConf, e)
+		} else {
+			panic("upstream conf is invalid.")
+		}
+	} else if upsType == UPSTREAM_RPC {
+		rpcConf, ok := upsConf.(IRpcConf)
+		if ok {
+			ups = NewRpc(e.GetParent(), rpcConf, e)
+		} else {
+			panic("upstream conf is invalid.")
+		}
+	} else if upsType == UPSTREAM_HUB {
+		hubConf, ok := upsConf.(IHubConf)
+		if ok {
+			ups = NewHub(e.GetParent(), hubConf, e)
+		} else {
+			panic("upstream conf is invalid.")
+		}
+	} else if upsType == UPSTREAM_MOCK {
+		mockConf, ok := upsConf.(IMockConf)
+		if ok {
+			ups = NewMock(e.GetParent(), mockConf, e)
+		} else {
+			panic("upstream conf is invalid.")
+		}
+	} else if upsType == UPSTREAM_TUNNEL {
+		tunnelConf, ok := upsConf.(ITunnelConf)
+		if ok {
+			ups = NewTunnel(e.GetParent(), tunnelConf, e)
+		} else {
+			panic("upstream conf is invalid.")
+		}
 	} else {
 		// TODO
 		panic("upstream type is invalid.")
@@ -146,6 +261,43 @@ func (e *Extension) CreateUpstream(upsConf IUpstreamConf) IUpstream {
 	return ups
 }
 
+// CreateFilter 实现不同的Filter，内置cidr访问控制，自定义的filter需重写该方法
+func (e *Extension) CreateFilter(filterConf IFilterConf) IFilter {
+	return newBuiltinFilter(e.GetParent(), filterConf)
+}
+
+// newBuiltinFilter 创建内置的filter
+func newBuiltinFilter(parent interface{}, filterConf IFilterConf) IFilter {
+	if filterConf.GetFilterType() == FILTER_CIDR {
+		return NewCidrFilter(parent, filterConf)
+	}
+	errMsg := "filter type is invalid, type:" + filterConf.GetFilterType()
+	logx.Error(errMsg)
+	panic(errMsg)
+}
+
+// GetSessionKey 获取会话亲和的key，默认取参数中配置的affinityKey对应的值
+func (e *Extension) GetSessionKey(ctx gch.IChHandleContext, upstream IUpstream, params map[string]interface{}) string {
+	return defaultSessionKey(upstream, params)
+}
+
+// defaultSessionKey 取参数中配置的affinityKey对应的值
+func defaultSessionKey(upstream IUpstream, params map[string]interface{}) string {
+	proxyConf, ok := upstream.GetConf().(IProxyConf)
+	if !ok || params == nil {
+		return ""
+	}
+	affinityKey := proxyConf.GetAffinityKey()
+	if len(affinityKey) <= 0 {
+		return ""
+	}
+	value, found := params[affinityKey]
+	if !found || value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
 // BeforeServerListen 在ServerListen前操作，如果报错，则无法进行ServerListen操作
 func (e *Extension) BeforeServerListen(server IAgServer) error {
 	// 空实现
@@ -169,6 +321,16 @@ func (e *Extension) AfterAgentChannelActive(ctx gch.IChHandleContext){
 	// 空实现
 }
 
+// AfterDstReconnect dst端重连成功后的操作
+func (e *Extension) AfterDstReconnect(agentCtx gch.IChHandleContext, upstream IUpstream, dstChannel gch.IChannel) {
+	// 空实现
+}
+
+// MapCloseInfo 关闭信息的转换，默认按协议映射关闭码，见mapCloseInfo
+func (e *Extension) MapCloseInfo(fromChannel gch.IChannel, toChannel gch.IChannel, info *CloseInfo) *CloseInfo {
+	return mapCloseInfo(fromChannel, toChannel, info)
+}
+
 // GetAgentMsgHandlers 获取agent msg的操作，默认实现
 func (e *Extension) GetAgentMsgHandlers() []IMsgHandler {
 	return e.msgHandles
@@ -0,0 +1,249 @@
+/*
+ * 过滤器，按FilterConf.Pattern匹配location的pattern，按Order先后执行，可实现认证，ip黑白名单，消息改写等：
+ *  1、会话打开，定位location之前，BeforeAgentChannelActive
+ *  2、定位到location和upstream之后，AfterLocation
+ *  3、agent端的消息转发到dst端之前，OnAgentMsg
+ *  4、dst端的消息写回agent端之前，OnDstMsg
+ *  5、会话关闭，OnAgentChannelInActive
+ * 会话相关的方法返回错误则拒绝会话，消息相关的方法返回错误则丢弃消息，返回FilterReject则同时关闭会话
+ * Author:slive
+ * DATE:2021/4/29
+ */
+package agent
+
+import (
+	"fmt"
+	gws "github.com/gorilla/websocket"
+	gch "github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/common"
+	logx "github.com/slive/gsfly/logger"
+	"strings"
+)
+
+const (
+	// agentChannel中存放匹配到的filters的附件key
+	Filters_Attach_key = "filters"
+)
+
+// IFilter 过滤器
+type IFilter interface {
+	common.IParent
+
+	GetConf() IFilterConf
+
+	// BeforeAgentChannelActive 会话打开，定位location之前的操作，返回错误则拒绝会话
+	// pattern和params为IExtension.GetLocationPattern获取到的匹配路径和参数
+	BeforeAgentChannelActive(ctx gch.IChHandleContext, pattern string, params map[string]interface{}) error
+
+	// AfterLocation 定位到location并初始化upstream之后的操作，返回错误则拒绝会话
+	AfterLocation(ctx gch.IChHandleContext, location ILocationConf, upstream IUpstream) error
+
+	// OnAgentMsg agent端的消息转发到dst端之前的操作，可修改packet，返回错误则丢弃消息
+	OnAgentMsg(ctx gch.IChHandleContext) error
+
+	// OnDstMsg 消息写回agent端之前的操作，可修改packet，返回错误则丢弃消息
+	OnDstMsg(ctx gch.IChHandleContext) error
+
+	// OnAgentChannelInActive 会话关闭后的操作，如清理附件
+	OnAgentChannelInActive(ctx gch.IChHandleContext)
+}
+
+// Filter 过滤器的空实现，自定义的过滤器可组合后按需实现
+type Filter struct {
+	common.Parent
+
+	conf IFilterConf
+}
+
+func NewFilter(parent interface{}, conf IFilterConf) *Filter {
+	if conf == nil {
+		errMsg := "filter conf is nil"
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	f := &Filter{conf: conf}
+	f.SetParent(parent)
+	return f
+}
+
+func (f *Filter) GetConf() IFilterConf {
+	return f.conf
+}
+
+func (f *Filter) BeforeAgentChannelActive(ctx gch.IChHandleContext, pattern string, params map[string]interface{}) error {
+	return nil
+}
+
+func (f *Filter) AfterLocation(ctx gch.IChHandleContext, location ILocationConf, upstream IUpstream) error {
+	return nil
+}
+
+func (f *Filter) OnAgentMsg(ctx gch.IChHandleContext) error {
+	return nil
+}
+
+func (f *Filter) OnDstMsg(ctx gch.IChHandleContext) error {
+	return nil
+}
+
+func (f *Filter) OnAgentChannelInActive(ctx gch.IChHandleContext) {
+	// 空实现
+}
+
+// FilterReject 过滤器拒绝，关闭会话时作为ws关闭码和原因发送到agent端
+type FilterReject struct {
+	// ws关闭码，<=0则为1008(policy violation)
+	Code int
+
+	Reason string
+}
+
+func NewFilterReject(code int, reason string) *FilterReject {
+	if code <= 0 {
+		code = gws.ClosePolicyViolation
+	}
+	return &FilterReject{Code: code, Reason: reason}
+}
+
+func (r *FilterReject) Error() string {
+	return fmt.Sprintf("filter reject, code:%v, reason:%v", r.Code, r.Reason)
+}
+
+// matchFilterPattern filter的pattern是否匹配location的pattern
+func matchFilterPattern(filterPattern string, pattern string) bool {
+	if len(filterPattern) <= 0 {
+		return true
+	}
+	if strings.HasSuffix(filterPattern, "*") {
+		return strings.HasPrefix(pattern, strings.TrimSuffix(filterPattern, "*"))
+	}
+	return filterPattern == pattern
+}
+
+// matchFilters 按顺序取出匹配pattern的filters
+func matchFilters(filters []IFilter, pattern string) []IFilter {
+	var ret []IFilter
+	for _, filter := range filters {
+		if matchFilterPattern(filter.GetConf().GetPattern(), pattern) {
+			ret = append(ret, filter)
+		}
+	}
+	return ret
+}
+
+// getChannelFilters 获取agentChannel匹配到的filters
+func getChannelFilters(agentChannel gch.IChannel) []IFilter {
+	filters, ok := agentChannel.GetAttach(Filters_Attach_key).([]IFilter)
+	if ok {
+		return filters
+	}
+	return nil
+}
+
+// beforeFilters 会话打开时匹配filters并执行BeforeAgentChannelActive
+func (ags *AgServer) beforeFilters(ctx gch.IChHandleContext) error {
+	filters := ags.GetParent().(IService).GetFilters()
+	if len(filters) <= 0 {
+		return nil
+	}
+	agentChannel := ctx.GetChannel()
+	pattern, params := ags.GetExtension().GetLocationPattern(ctx)
+	filters = matchFilters(filters, pattern)
+	if len(filters) <= 0 {
+		return nil
+	}
+	agentChannel.AddAttach(Filters_Attach_key, filters)
+	for _, filter := range filters {
+		err := filter.BeforeAgentChannelActive(ctx, pattern, params)
+		if err != nil {
+			logx.Warnf("filter before active error, chId:%v, filterId:%v, error:%v", agentChannel.GetId(), filter.GetConf().GetId(), err)
+			return toFilterReject(err)
+		}
+	}
+	return nil
+}
+
+// afterLocationFilters 定位到location和upstream之后，执行filters的AfterLocation
+func afterLocationFilters(ctx gch.IChHandleContext, location ILocationConf, upstream IUpstream) error {
+	agentChannel := ctx.GetChannel()
+	for _, filter := range getChannelFilters(agentChannel) {
+		err := filter.AfterLocation(ctx, location, upstream)
+		if err != nil {
+			logx.Warnf("filter after location error, chId:%v, filterId:%v, error:%v", agentChannel.GetId(), filter.GetConf().GetId(), err)
+			return toFilterReject(err)
+		}
+	}
+	return nil
+}
+
+// filterAgentMsg agent端的消息转发前执行filters，返回false则丢弃消息
+func filterAgentMsg(ctx gch.IChHandleContext) bool {
+	agentChannel := ctx.GetChannel()
+	for _, filter := range getChannelFilters(agentChannel) {
+		err := filter.OnAgentMsg(ctx)
+		if err != nil {
+			logx.Warnf("filter agent msg error, chId:%v, filterId:%v, error:%v", agentChannel.GetId(), filter.GetConf().GetId(), err)
+			rejectMsg(agentChannel, err)
+			return false
+		}
+	}
+	return true
+}
+
+// onAgentChannelPreWrite 写回agentChannel之前执行filters，出错则终止写
+func onAgentChannelPreWrite(ctx gch.IChHandleContext) {
+	agentChannel := ctx.GetChannel()
+	for _, filter := range getChannelFilters(agentChannel) {
+		err := filter.OnDstMsg(ctx)
+		if err != nil {
+			logx.Warnf("filter dst msg error, chId:%v, filterId:%v, error:%v", agentChannel.GetId(), filter.GetConf().GetId(), err)
+			ctx.SetError(common.NewError1(gch.ERR_WRITE, err))
+			rejectMsg(agentChannel, err)
+			return
+		}
+	}
+}
+
+// closeFilters 会话关闭后执行filters的OnAgentChannelInActive
+func closeFilters(ctx gch.IChHandleContext) {
+	for _, filter := range getChannelFilters(ctx.GetChannel()) {
+		filter.OnAgentChannelInActive(ctx)
+	}
+}
+
+// toFilterReject 会话相关的方法返回的错误都视为拒绝会话
+func toFilterReject(err error) *FilterReject {
+	reject, ok := err.(*FilterReject)
+	if ok {
+		return reject
+	}
+	return NewFilterReject(0, err.Error())
+}
+
+// isFilterReject 是否是过滤器拒绝，兼容GError的包装
+func isFilterReject(err error) bool {
+	gerr, ok := err.(common.GError)
+	if ok && gerr.GetErr() != nil {
+		err = gerr.GetErr()
+	}
+	_, ok = err.(*FilterReject)
+	return ok
+}
+
+// rejectMsg 消息被拒绝，是FilterReject则关闭会话
+func rejectMsg(agentChannel gch.IChannel, err error) {
+	if isFilterReject(err) {
+		rejectSession(agentChannel, err)
+	}
+}
+
+// rejectSession 按FilterReject的关闭码和原因关闭会话
+func rejectSession(agentChannel gch.IChannel, err error) {
+	if agentChannel.IsClosed() {
+		return
+	}
+	info := closeInfoFromError(agentChannel.GetConf().GetNetwork(), err)
+	logx.Infof("reject session, chId:%v, %v", agentChannel.GetId(), info)
+	closeWithInfo(agentChannel, info)
+	agentChannel.Release()
+}
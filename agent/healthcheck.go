@@ -0,0 +1,298 @@
+/*
+ * dst端的主动健康检查，按dst的协议类型进行探测，如tcp连接，ws握手，kcp/udp收发探测包，
+ * kcp/udp无连接，拨号不能说明dst可用，未配置探测内容时不探测，保持原有的健康状态
+ * Author:slive
+ * DATE:2021/4/14
+ */
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	gch "github.com/slive/gsfly/channel"
+	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
+	"github.com/xtaci/kcp-go"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	default_health_interval = 5 * time.Second
+	default_health_timeout  = 2 * time.Second
+	default_health_rise     = 2
+	default_health_fall     = 3
+)
+
+// ErrHealthUnprobed kcp/udp未配置探测内容，无法探测
+var ErrHealthUnprobed = errors.New("health check payload is nil, kcp/udp dst is unprobed")
+
+// HealthCheckConf 健康检查配置
+type HealthCheckConf struct {
+	// 探测间隔
+	Interval time.Duration
+
+	// 每次探测的超时时间
+	Timeout time.Duration
+
+	// 连续成功多少次后标记为健康
+	Rise int
+
+	// 连续失败多少次后标记为不健康
+	Fall int
+
+	// kcp/udp发送的探测内容，为空则不探测kcp/udp的dst
+	Payload string
+
+	// kcp/udp期望收到的响应内容，为空则收到任意响应即可
+	Expect string
+}
+
+// NewHealthCheckConf 创建健康检查配置，参数<=0则取默认值
+func NewHealthCheckConf(interval time.Duration, timeout time.Duration, rise int, fall int) *HealthCheckConf {
+	if interval <= 0 {
+		interval = default_health_interval
+	}
+	if timeout <= 0 {
+		timeout = default_health_timeout
+	}
+	if rise <= 0 {
+		rise = default_health_rise
+	}
+	if fall <= 0 {
+		fall = default_health_fall
+	}
+	return &HealthCheckConf{
+		Interval: interval,
+		Timeout:  timeout,
+		Rise:     rise,
+		Fall:     fall,
+	}
+}
+
+// healthCounter 连续成功或失败的次数
+type healthCounter struct {
+	successes int
+	failures  int
+}
+
+// HealthChecker 健康检查，定时探测upstream中的所有dst，根据rise/fall阈值标记健康状态
+type HealthChecker struct {
+	upstream IUpstream
+
+	conf *HealthCheckConf
+
+	targets []socket.IClientConf
+
+	counters map[socket.IClientConf]*healthCounter
+
+	exit chan bool
+
+	startOnce sync.Once
+
+	stopOnce sync.Once
+}
+
+// NewHealthChecker 创建健康检查
+// upstream 所属的upstream，健康状态记录在upstream的DstStatis中
+// conf 健康检查配置
+// targets 需要探测的dst列表
+func NewHealthChecker(upstream IUpstream, conf *HealthCheckConf, targets []socket.IClientConf) *HealthChecker {
+	hc := &HealthChecker{
+		upstream: upstream,
+		conf:     conf,
+		targets:  targets,
+		counters: make(map[socket.IClientConf]*healthCounter, len(targets)),
+		exit:     make(chan bool, 1),
+	}
+	for _, target := range targets {
+		hc.counters[target] = &healthCounter{}
+		if isUnprobed(target, conf) {
+			logx.Warnf("health check payload is nil, dst is unprobed, upstreamId:%v, dst:%v",
+				upstream.GetConf().GetId(), target.GetAddrStr())
+		}
+	}
+	return hc
+}
+
+// Start 启动定时探测
+func (hc *HealthChecker) Start() {
+	hc.startOnce.Do(func() {
+		logx.Info("start to health check, upstreamId:", hc.upstream.GetConf().GetId())
+		go hc.loop()
+	})
+}
+
+// Stop 停止定时探测
+func (hc *HealthChecker) Stop() {
+	hc.stopOnce.Do(func() {
+		logx.Info("stop health check, upstreamId:", hc.upstream.GetConf().GetId())
+		close(hc.exit)
+	})
+}
+
+func (hc *HealthChecker) loop() {
+	ticker := time.NewTicker(hc.conf.Interval)
+	defer ticker.Stop()
+	for {
+		hc.checkAll()
+		select {
+		case <-hc.exit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll 并发探测所有的dst，单次探测的异常不影响后续的定时探测
+func (hc *HealthChecker) checkAll() {
+	defer func() {
+		ret := recover()
+		if ret != nil {
+			logx.Error("health check error:", ret)
+		}
+	}()
+	var wg sync.WaitGroup
+	results := make([]error, len(hc.targets))
+	for index, target := range hc.targets {
+		wg.Add(1)
+		go func(index int, target socket.IClientConf) {
+			defer wg.Done()
+			results[index] = hc.probe(target)
+		}(index, target)
+	}
+	wg.Wait()
+
+	for index, target := range hc.targets {
+		hc.onResult(target, results[index])
+	}
+}
+
+// probe 探测一次，异常视为探测失败
+func (hc *HealthChecker) probe(target socket.IClientConf) (err error) {
+	defer func() {
+		ret := recover()
+		if ret != nil {
+			logx.Error("probe dst error:", ret)
+			err = fmt.Errorf("probe panic:%v", ret)
+		}
+	}()
+	return ProbeDst(target, hc.conf)
+}
+
+// onResult 根据探测结果和rise/fall阈值，更新健康状态，未探测的保持原有状态
+func (hc *HealthChecker) onResult(target socket.IClientConf, err error) {
+	if err == ErrHealthUnprobed {
+		return
+	}
+	counter := hc.counters[target]
+	dstStatis := hc.upstream.GetDstStatis(target)
+	healthy := dstStatis.IsHealthy()
+	if err == nil {
+		counter.failures = 0
+		counter.successes++
+		if !healthy && counter.successes >= hc.conf.Rise {
+			logx.Infof("dst is up, upstreamId:%v, dst:%v", hc.upstream.GetConf().GetId(), target.GetAddrStr())
+			dstStatis.SetHealthy(true)
+		}
+	} else {
+		counter.successes = 0
+		counter.failures++
+		logx.Debugf("probe dst error, dst:%v, failures:%v, error:%v", target.GetAddrStr(), counter.failures, err)
+		if healthy && counter.failures >= hc.conf.Fall {
+			logx.Warnf("dst is down, upstreamId:%v, dst:%v, error:%v", hc.upstream.GetConf().GetId(), target.GetAddrStr(), err)
+			dstStatis.SetHealthy(false)
+		}
+	}
+}
+
+// ProbeDst 按dst的协议类型探测一次，返回nil则为成功，kcp/udp未配置探测内容则返回ErrHealthUnprobed
+func ProbeDst(dstClientConf socket.IClientConf, conf *HealthCheckConf) error {
+	if isUnprobed(dstClientConf, conf) {
+		return ErrHealthUnprobed
+	}
+	timeout := conf.Timeout
+	addr := dstClientConf.GetAddrStr()
+	switch dstClientConf.GetNetwork() {
+	case gch.NETWORK_WS, gch.NETWORK_HTTP:
+		wsConf, ok := dstClientConf.(socket.IWsClientConf)
+		if !ok {
+			return probeTcp(addr, timeout)
+		}
+		return probeWs(wsConf.GetUrl(), timeout)
+	case gch.NETWORK_KCP:
+		return probeKcp(addr, conf)
+	case gch.NETWORK_UDP:
+		return probeUdp(addr, conf)
+	default:
+		return probeTcp(addr, timeout)
+	}
+}
+
+// isUnprobed kcp/udp未配置探测内容
+func isUnprobed(dstClientConf socket.IClientConf, conf *HealthCheckConf) bool {
+	network := dstClientConf.GetNetwork()
+	return (network == gch.NETWORK_KCP || network == gch.NETWORK_UDP) && len(conf.Payload) <= 0
+}
+
+// probeTcp tcp连接探测
+func probeTcp(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeWs ws握手探测，使用配置的path
+func probeWs(url string, timeout time.Duration) error {
+	dialer := websocket.Dialer{HandshakeTimeout: timeout}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeKcp kcp收发探测包
+func probeKcp(addr string, conf *HealthCheckConf) error {
+	conn, err := kcp.DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return exchangePayload(conn, conf)
+}
+
+// probeUdp udp收发探测包
+func probeUdp(addr string, conf *HealthCheckConf) error {
+	conn, err := net.DialTimeout("udp", addr, conf.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return exchangePayload(conn, conf)
+}
+
+// exchangePayload 发送探测内容并等待响应
+func exchangePayload(conn net.Conn, conf *HealthCheckConf) error {
+	err := conn.SetDeadline(time.Now().Add(conf.Timeout))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte(conf.Payload))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if len(conf.Expect) > 0 && string(buf[:n]) != conf.Expect {
+		return errors.New("unexpected response:" + string(buf[:n]))
+	}
+	return nil
+}
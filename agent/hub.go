@@ -0,0 +1,464 @@
+/*
+ * 发布/订阅方式的upstream，适用于只推送通知的后端：
+ *  1、agentChannel按握手参数或者订阅消息订阅topic
+ *  2、后端长连接或者进程内接口(IService.Publish)发布消息到topic，转发到所有订阅的agentChannel
+ *  3、agentChannel释放时取消其所有订阅
+ * Author:slive
+ * DATE:2021/4/26
+ */
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/channel/tcpx"
+	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	default_hub_topic_param  = "topic"
+	default_hub_topic_field  = "topic"
+	default_hub_action_field = "action"
+
+	// HUB_ACTION_SUBSCRIBE agent端的订阅消息
+	HUB_ACTION_SUBSCRIBE = "subscribe"
+	// HUB_ACTION_UNSUBSCRIBE agent端的取消订阅消息
+	HUB_ACTION_UNSUBSCRIBE = "unsubscribe"
+
+	// 补充后端长连接的间隔
+	hub_maintain_interval = time.Second
+)
+
+type IHubConf interface {
+	IUpstreamConf
+
+	// GetDstClientConfs 发布消息的后端配置列表，可为空，只使用进程内发布
+	GetDstClientConfs() []socket.IClientConf
+
+	// GetTopicParam 握手参数中的topic参数名，多个topic用逗号分隔
+	GetTopicParam() string
+
+	// GetTopicField 订阅消息和后端发布消息中的topic字段名
+	GetTopicField() string
+
+	// GetActionField 订阅消息中的动作字段名，值为HUB_ACTION_SUBSCRIBE或者HUB_ACTION_UNSUBSCRIBE
+	GetActionField() string
+}
+
+// HubConf 发布/订阅方式的upstream配置
+type HubConf struct {
+	UpstreamConf
+
+	DstClientConfs []socket.IClientConf
+
+	// 握手参数中的topic参数名
+	TopicParam string
+
+	// topic字段名
+	TopicField string
+
+	// 动作字段名
+	ActionField string
+}
+
+// NewHubConf 创建发布/订阅方式的upstream配置，字段名取默认值，可再设置
+// id upstreamId
+// dstClientConfs 发布消息的后端配置列表，可为空
+func NewHubConf(id string, dstClientConfs ...socket.IClientConf) *HubConf {
+	h := &HubConf{
+		DstClientConfs: dstClientConfs,
+		TopicParam:     default_hub_topic_param,
+		TopicField:     default_hub_topic_field,
+		ActionField:    default_hub_action_field,
+	}
+	h.UpstreamConf = *NewUpstreamConf(id, UPSTREAM_HUB)
+	return h
+}
+
+func (hc *HubConf) GetDstClientConfs() []socket.IClientConf {
+	return hc.DstClientConfs
+}
+
+func (hc *HubConf) GetTopicParam() string {
+	return hc.TopicParam
+}
+
+func (hc *HubConf) GetTopicField() string {
+	return hc.TopicField
+}
+
+func (hc *HubConf) GetActionField() string {
+	return hc.ActionField
+}
+
+// IHub 发布/订阅方式的upstream
+type IHub interface {
+	IUpstream
+
+	// Publish 发布消息到topic，返回收到消息的agentChannel数
+	Publish(topic string, data []byte) int
+
+	// GetSubscribers 获取topic的订阅数
+	GetSubscribers(topic string) int
+}
+
+// hubConn 发布消息的后端长连接
+type hubConn struct {
+	dstClientConf socket.IClientConf
+
+	dstChannel channel.IChannel
+}
+
+// Hub 发布/订阅方式的upstream
+type Hub struct {
+	Upstream
+
+	HubConf IHubConf
+
+	// topic -> agentChId -> agentChannel
+	topics map[string]map[string]channel.IChannel
+
+	// agentChId -> 已订阅的topic
+	agentTopics map[string]map[string]bool
+
+	topicMut sync.RWMutex
+
+	conns []*hubConn
+
+	connMut sync.RWMutex
+
+	exit chan bool
+
+	startOnce sync.Once
+
+	stopOnce sync.Once
+}
+
+func NewHub(parent interface{}, hubConf IHubConf, extension IExtension) *Hub {
+	h := &Hub{
+		HubConf:     hubConf,
+		topics:      make(map[string]map[string]channel.IChannel),
+		agentTopics: make(map[string]map[string]bool),
+		exit:        make(chan bool),
+	}
+	h.Upstream = *NewUpstream(parent, hubConf, extension)
+	return h
+}
+
+// Start 连接所有的后端，并在后台补充断开的长连接
+func (h *Hub) Start() error {
+	if len(h.HubConf.GetDstClientConfs()) <= 0 {
+		return nil
+	}
+	h.startOnce.Do(func() {
+		h.maintain()
+		go h.loop()
+	})
+	return nil
+}
+
+// Stop 停止后台补充长连接
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.exit)
+	})
+}
+
+func (h *Hub) loop() {
+	defer func() {
+		ret := recover()
+		if ret != nil {
+			logx.Error("hub maintain error:", ret)
+		}
+	}()
+	ticker := time.NewTicker(hub_maintain_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.exit:
+			return
+		case <-ticker.C:
+			h.maintain()
+		}
+	}
+}
+
+// maintain 每个后端保持一个长连接
+func (h *Hub) maintain() {
+	for _, dstClientConf := range h.HubConf.GetDstClientConfs() {
+		if h.hasConn(dstClientConf) {
+			continue
+		}
+		err := h.dial(dstClientConf)
+		h.GetDstStatis(dstClientConf).SetHealthy(err == nil)
+		if err != nil {
+			logx.Warnf("dial hub dst error, dst:%v, error:%v", dstClientConf.GetAddrStr(), err)
+		}
+	}
+}
+
+func (h *Hub) hasConn(dstClientConf socket.IClientConf) bool {
+	h.connMut.RLock()
+	defer h.connMut.RUnlock()
+	for _, conn := range h.conns {
+		if conn.dstClientConf == dstClientConf && !conn.dstChannel.IsClosed() {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hub) dial(dstClientConf socket.IClientConf) error {
+	handle := channel.NewDefChHandle(h.onDstChannelReadHandle)
+	handle.SetOnConnect(onChannelConnectHandle)
+	handle.SetOnRelease(h.onDstChannelInActiveHandle)
+	handle.SetOnError(onChannelErrorHandle)
+	clientConn := socket.NewClientSocket(h, dstClientConf, handle, nil)
+	err := clientConn.Dial()
+	if err != nil {
+		return err
+	}
+	dstCh := clientConn.GetChannel()
+	h.connMut.Lock()
+	h.conns = append(h.conns, &hubConn{dstClientConf: dstClientConf, dstChannel: dstCh})
+	h.connMut.Unlock()
+	h.GetDstChannels().Put(dstCh.GetId(), dstCh)
+	logx.Info("open hub conn, dstChId:", dstCh.GetId())
+	return nil
+}
+
+// InitChannelPeer 按握手参数订阅topic，不需要dst端，ret为已订阅的topic
+func (h *Hub) InitChannelPeer(agentCtx channel.IChHandleContext, params map[string]interface{}) {
+	agentCh := agentCtx.GetChannel()
+	agentChId := agentCh.GetId()
+	var topics []string
+	if params != nil {
+		topics = parseTopics(params[h.HubConf.GetTopicParam()])
+	}
+	h.topicMut.Lock()
+	_, found := h.agentTopics[agentChId]
+	if !found {
+		h.agentTopics[agentChId] = make(map[string]bool)
+	}
+	h.topicMut.Unlock()
+	h.Subscribe(agentCh, topics...)
+	agentCtx.SetRet(topics)
+	logx.Infof("finish hub initChannelPeer, agentChId:%v, topics:%v", agentChId, topics)
+}
+
+// parseTopics 解析topic，支持逗号分隔的字符串和数组
+func parseTopics(value interface{}) []string {
+	var ret []string
+	switch val := value.(type) {
+	case nil:
+	case string:
+		for _, topic := range strings.Split(val, ",") {
+			topic = strings.TrimSpace(topic)
+			if len(topic) > 0 {
+				ret = append(ret, topic)
+			}
+		}
+	case []string:
+		for _, topic := range val {
+			ret = append(ret, parseTopics(topic)...)
+		}
+	case []interface{}:
+		for _, topic := range val {
+			ret = append(ret, parseTopics(topic)...)
+		}
+	default:
+		ret = append(ret, fmt.Sprintf("%v", val))
+	}
+	return ret
+}
+
+// Subscribe agentChannel订阅topic，agentChannel需已通过InitChannelPeer建立会话
+func (h *Hub) Subscribe(agentCh channel.IChannel, topics ...string) {
+	agentChId := agentCh.GetId()
+	h.topicMut.Lock()
+	defer h.topicMut.Unlock()
+	subscribed, found := h.agentTopics[agentChId]
+	if !found {
+		logx.Warn("hub session is not existed, agentChId:", agentChId)
+		return
+	}
+	for _, topic := range topics {
+		subscribers, found := h.topics[topic]
+		if !found {
+			subscribers = make(map[string]channel.IChannel)
+			h.topics[topic] = subscribers
+		}
+		subscribers[agentChId] = agentCh
+		subscribed[topic] = true
+	}
+}
+
+// Unsubscribe agentChannel取消订阅topic
+func (h *Hub) Unsubscribe(agentCh channel.IChannel, topics ...string) {
+	agentChId := agentCh.GetId()
+	h.topicMut.Lock()
+	defer h.topicMut.Unlock()
+	subscribed := h.agentTopics[agentChId]
+	for _, topic := range topics {
+		h.removeSubscriber(topic, agentChId)
+		if subscribed != nil {
+			delete(subscribed, topic)
+		}
+	}
+}
+
+// removeSubscriber 移除topic的订阅者，没有订阅者则移除topic，需在topicMut中调用
+func (h *Hub) removeSubscriber(topic string, agentChId string) {
+	subscribers, found := h.topics[topic]
+	if !found {
+		return
+	}
+	delete(subscribers, agentChId)
+	if len(subscribers) <= 0 {
+		delete(h.topics, topic)
+	}
+}
+
+// Publish 发布消息到topic，转发到所有订阅的agentChannel，ws协议按文本消息发送
+func (h *Hub) Publish(topic string, data []byte) int {
+	return h.publish(topic, data, websocket.TextMessage)
+}
+
+func (h *Hub) publish(topic string, data []byte, msgType int) int {
+	h.topicMut.RLock()
+	subscribers := make([]channel.IChannel, 0, len(h.topics[topic]))
+	for _, agentCh := range h.topics[topic] {
+		subscribers = append(subscribers, agentCh)
+	}
+	h.topicMut.RUnlock()
+	count := 0
+	for _, agentCh := range subscribers {
+		if agentCh.IsClosed() {
+			continue
+		}
+		packet := agentCh.NewPacket()
+		packet.SetData(data)
+		wsPacket, ok := packet.(*tcpx.WsPacket)
+		if ok {
+			wsPacket.MsgType = msgType
+		}
+		syncAgentWrite(agentCh, func() {
+			agentCh.Write(packet)
+		})
+		count++
+	}
+	logx.Debugf("hub publish, topic:%v, subscribers:%v", topic, count)
+	return count
+}
+
+// GetSubscribers 获取topic的订阅数
+func (h *Hub) GetSubscribers(topic string) int {
+	h.topicMut.RLock()
+	defer h.topicMut.RUnlock()
+	return len(h.topics[topic])
+}
+
+// TransferAgentMsg 处理agent端的订阅和取消订阅消息，其他消息忽略，见IAgentMsgTransfer
+func (h *Hub) TransferAgentMsg(agentCtx channel.IChHandleContext) bool {
+	agentCh := agentCtx.GetChannel()
+	msg := make(map[string]interface{})
+	err := json.Unmarshal(agentCtx.GetPacket().GetData(), &msg)
+	if err != nil {
+		logx.Debugf("ignore hub msg, agentChId:%v, error:%v", agentCh.GetId(), err)
+		return true
+	}
+	action := fmt.Sprintf("%v", msg[h.HubConf.GetActionField()])
+	topics := parseTopics(msg[h.HubConf.GetTopicField()])
+	switch action {
+	case HUB_ACTION_SUBSCRIBE:
+		h.Subscribe(agentCh, topics...)
+	case HUB_ACTION_UNSUBSCRIBE:
+		h.Unsubscribe(agentCh, topics...)
+	default:
+		logx.Debugf("ignore hub msg, agentChId:%v, action:%v", agentCh.GetId(), action)
+	}
+	return true
+}
+
+// onDstChannelReadHandle 后端发布的消息按topic字段转发，消息原样发送
+func (h *Hub) onDstChannelReadHandle(dstCtx channel.IChHandleContext) {
+	packet := dstCtx.GetPacket()
+	data := packet.GetData()
+	msg := make(map[string]interface{})
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		logx.Warnf("invalid hub publish msg, dstChId:%v, error:%v", dstCtx.GetChannel().GetId(), err)
+		return
+	}
+	msgType := websocket.TextMessage
+	wsPacket, ok := packet.(*tcpx.WsPacket)
+	if ok {
+		msgType = wsPacket.MsgType
+	}
+	for _, topic := range parseTopics(msg[h.HubConf.GetTopicField()]) {
+		h.publish(topic, data, msgType)
+	}
+}
+
+func (h *Hub) onDstChannelInActiveHandle(dstCtx channel.IChHandleContext) {
+	h.ReleaseOnDstChannel(dstCtx)
+}
+
+// GetChannelPeer 订阅不绑定dst端，没有channelpeer
+func (h *Hub) GetChannelPeer(ctx channel.IChHandleContext, isAgent bool) IChannelPeer {
+	return nil
+}
+
+func (h *Hub) QueryDstChannel(ctx channel.IChHandleContext) {
+	logx.Warn("hub agent channel is not bound to dst channel.")
+}
+
+func (h *Hub) QueryAgentChannel(ctx channel.IChHandleContext) {
+	logx.Warn("hub dst channel is shared, agent channel can not be queried.")
+}
+
+// ReleaseOnAgentChannel agentChannel关闭，取消其所有订阅
+func (h *Hub) ReleaseOnAgentChannel(agentCtx channel.IChHandleContext) {
+	agentChId := agentCtx.GetChannel().GetId()
+	h.topicMut.Lock()
+	subscribed := h.agentTopics[agentChId]
+	delete(h.agentTopics, agentChId)
+	for topic := range subscribed {
+		h.removeSubscriber(topic, agentChId)
+	}
+	h.topicMut.Unlock()
+	logx.Infof("release hub session, agentChId:%v, topics:%v", agentChId, len(subscribed))
+}
+
+// ReleaseOnDstChannel 后端长连接断开，移除该连接，订阅保留，由后台重新连接
+func (h *Hub) ReleaseOnDstChannel(dstCtx channel.IChHandleContext) {
+	dstChId := dstCtx.GetChannel().GetId()
+	h.connMut.Lock()
+	for index, conn := range h.conns {
+		if conn.dstChannel.GetId() == dstChId {
+			h.conns = append(h.conns[:index], h.conns[index+1:]...)
+			break
+		}
+	}
+	h.connMut.Unlock()
+	h.GetDstChannels().Remove(dstChId)
+	logx.Info("hub conn closed, dstChId:", dstChId)
+}
+
+// ReleaseChannelPeers 清除所有订阅和后端长连接
+func (h *Hub) ReleaseChannelPeers() {
+	h.topicMut.Lock()
+	h.topics = make(map[string]map[string]channel.IChannel)
+	h.agentTopics = make(map[string]map[string]bool)
+	h.topicMut.Unlock()
+	h.connMut.Lock()
+	h.conns = nil
+	h.connMut.Unlock()
+	h.Upstream.ReleaseChannelPeers()
+}
@@ -6,8 +6,14 @@ package agent
 
 import (
 	"github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/common"
+	logx "github.com/slive/gsfly/logger"
 	"github.com/slive/gsfly/socket"
-	"time"
+	"github.com/slive/gsfly/util"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
 )
 
 type LoadBalanceType int
@@ -17,31 +23,99 @@ const (
 	LOADBALANCE_WEIGHT        = LoadBalanceType(1)
 	LOADBALANCE_IPHASH        = LoadBalanceType(2)
 	LOADBALANCE_IPHASH_WEIGHT = LoadBalanceType(3)
+	LOADBALANCE_P2C           = LoadBalanceType(4)
+	LOADBALANCE_ZONE          = LoadBalanceType(5)
 )
 
-// ILoadBalance 负载均衡接口
+// ILoadBalance 负载均衡接口，每个upstream创建一个实例，可保存自身的状态
 type ILoadBalance interface {
-	GetType() LoadBalanceType
+	// GetName 负载均衡名称，见RegisterLoadBalance
+	GetName() string
+
+	// GetUpstream 所属的upstream
+	GetUpstream() IUpstream
+
+	// Select 从lbcontext.Targets中选择dst目标，结果放到lbcontext.Result中
+	Select(lbcontext *LoadBalanceContext)
+
+	// OnConnect 选择的dst目标连接成功后的回调
+	OnConnect(lbcontext *LoadBalanceContext, dstChannel channel.IChannel)
+
+	// OnRelease dst目标对应的channel释放后的回调
+	OnRelease(dstClientConf socket.IClientConf, dstChannel channel.IChannel)
+
+	// UpdateTargets 更新所有的dst目标列表
+	UpdateTargets(targets []socket.IClientConf)
+
+	// GetTargets 获取所有的dst目标列表
+	GetTargets() []socket.IClientConf
 }
 
+// LoadBalance 负载均衡基类，记录dst目标列表，Select由具体实现类实现
 type LoadBalance struct {
-	Type LoadBalanceType
+	name string
+
+	upstream IUpstream
+
+	targets []socket.IClientConf
+
+	targetMut sync.RWMutex
+}
+
+// NewLoadBalance 创建负载均衡基类
+// name 负载均衡名称
+// upstream 所属的upstream
+func NewLoadBalance(name string, upstream IUpstream) *LoadBalance {
+	return &LoadBalance{name: name, upstream: upstream}
+}
+
+func (lb *LoadBalance) GetName() string {
+	return lb.name
+}
+
+func (lb *LoadBalance) GetUpstream() IUpstream {
+	return lb.upstream
+}
+
+// OnConnect 默认空实现
+func (lb *LoadBalance) OnConnect(lbcontext *LoadBalanceContext, dstChannel channel.IChannel) {
+}
+
+// OnRelease 默认空实现
+func (lb *LoadBalance) OnRelease(dstClientConf socket.IClientConf, dstChannel channel.IChannel) {
 }
 
-func NewLoadBalance(lbtype LoadBalanceType) ILoadBalance {
-	return &LoadBalance{Type: lbtype}
+func (lb *LoadBalance) UpdateTargets(targets []socket.IClientConf) {
+	lb.targetMut.Lock()
+	defer lb.targetMut.Unlock()
+	lb.targets = targets
 }
 
-func (bl *LoadBalance) GetType() LoadBalanceType {
-	return bl.Type
+func (lb *LoadBalance) GetTargets() []socket.IClientConf {
+	lb.targetMut.RLock()
+	defer lb.targetMut.RUnlock()
+	return lb.targets
 }
 
+// 负载均衡拒绝的错误码
+const ERR_LOADBALANCE_REJECT = "ERR_LOADBALANCE_REJECT"
+
 // LoadBalanceContext 负载均衡上下文
 type LoadBalanceContext struct {
 	Agserver     IAgServer
 	Upstream     IUpstream
 	AgentChannel channel.IChannel
-	Result       socket.IClientConf
+	// 匹配到的location，可能为空
+	Location ILocationConf
+	// agent端的参数，见IExtension.GetLocationPattern
+	Params map[string]interface{}
+	// 本次可选的dst目标，已按优先级分组并排除不可用的dst
+	Targets []socket.IClientConf
+	// 所有dst目标的健康和负载快照，dstClientConf作为主键
+	Snapshots map[socket.IClientConf]*DstSnapshot
+	Result    socket.IClientConf
+	// 负载均衡拒绝本次选择的原因，不为空则拒绝新的会话
+	Error common.GError
 }
 
 func NewLoadBalanceContext(agserver IAgServer, agRoute IUpstream, agentChannel channel.IChannel) *LoadBalanceContext {
@@ -53,14 +127,58 @@ func NewLoadBalanceContext(agserver IAgServer, agRoute IUpstream, agentChannel c
 	}
 }
 
-// 负载均衡处理handle
-type LoadBalanceHandle func(lbcontext *LoadBalanceContext)
+// GetSnapshot 获取dst目标的健康和负载快照，不存在则返回nil
+func (lbcontext *LoadBalanceContext) GetSnapshot(dstClientConf socket.IClientConf) *DstSnapshot {
+	return lbcontext.Snapshots[dstClientConf]
+}
+
+// Reject 拒绝本次选择，reason为拒绝原因，会返回给agent端
+func (lbcontext *LoadBalanceContext) Reject(reason string) {
+	lbcontext.Result = nil
+	lbcontext.Error = common.NewError2(ERR_LOADBALANCE_REJECT, reason)
+}
+
+// LoadBalanceCreator 创建负载均衡实例，每个upstream调用一次
+type LoadBalanceCreator func(upstream IUpstream) ILoadBalance
+
+var loadBalanceCreators = make(map[string]LoadBalanceCreator)
+
+var loadBalanceMut sync.RWMutex
+
+// RegisterLoadBalance 按名称注册负载均衡，配置"agent.upstream.X.loadBalance=name"即可选用，
+// 自定义的负载均衡需在NewService前注册
+func RegisterLoadBalance(name string, creator LoadBalanceCreator) {
+	if len(name) <= 0 || creator == nil {
+		errMsg := "loadBalance name or creator is nil."
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	loadBalanceMut.Lock()
+	defer loadBalanceMut.Unlock()
+	loadBalanceCreators[name] = creator
+}
+
+// CreateLoadBalance 根据名称创建负载均衡实例，未注册则返回nil
+func CreateLoadBalance(name string, upstream IUpstream) ILoadBalance {
+	loadBalanceMut.RLock()
+	creator, found := loadBalanceCreators[name]
+	loadBalanceMut.RUnlock()
+	if !found {
+		logx.Warn("loadBalance is not registered, name:", name)
+		return nil
+	}
+	return creator(upstream)
+}
 
 func init() {
-	AddLoadBalanceHandle(LOADBALANCE_DEFAULT, defaultLoadBalanceHandle)
-	AddLoadBalanceHandle(LOADBALANCE_WEIGHT, weighLoadBalanceHandle)
-	AddLoadBalanceHandle(LOADBALANCE_IPHASH, iphashLoadBalanceHandle)
-	AddLoadBalanceHandle(LOADBALANCE_IPHASH_WEIGHT, iphashweighLoadBalanceHandle)
+	RegisterLoadBalance(LOADBALANCE_DEFAULT.String(), newDefaultLoadBalance)
+	RegisterLoadBalance(LOADBALANCE_WEIGHT.String(), newWeightLoadBalance)
+	RegisterLoadBalance(LOADBALANCE_IPHASH.String(), newIphashLoadBalance)
+	RegisterLoadBalance(LOADBALANCE_IPHASH_WEIGHT.String(), newIphashWeightLoadBalance)
+	// 兼容旧的拼写
+	RegisterLoadBalance("ipsh_weight", newIphashWeightLoadBalance)
+	RegisterLoadBalance(LOADBALANCE_P2C.String(), newP2cLoadBalance)
+	RegisterLoadBalance(LOADBALANCE_ZONE.String(), newZoneLoadBalance)
 }
 
 // String 获取协议对应的字符串
@@ -73,7 +191,11 @@ func (p LoadBalanceType) String() string {
 	case LOADBALANCE_IPHASH:
 		return "iphash"
 	case LOADBALANCE_IPHASH_WEIGHT:
-		return "ipsh_weight"
+		return "iphash_weight"
+	case LOADBALANCE_P2C:
+		return "p2c"
+	case LOADBALANCE_ZONE:
+		return "zone"
 	default:
 		return "unknown"
 	}
@@ -87,38 +209,273 @@ func GetLoadBalanceType(lbtype string) (LoadBalanceType, error) {
 		return LOADBALANCE_WEIGHT, nil
 	case LOADBALANCE_IPHASH_WEIGHT.String():
 		return LOADBALANCE_IPHASH_WEIGHT, nil
+	case LOADBALANCE_P2C.String():
+		return LOADBALANCE_P2C, nil
+	case LOADBALANCE_ZONE.String():
+		return LOADBALANCE_ZONE, nil
 	default:
 		return LOADBALANCE_DEFAULT, nil
 
 	}
 }
 
-var localBalanceHandles = make(map[LoadBalanceType]LoadBalanceHandle)
-
-func GetLoadBalanceHandle(lbtype LoadBalanceType) LoadBalanceHandle {
-	return localBalanceHandles[lbtype]
+// defaultLoadBalance 默认轮询方式
+type defaultLoadBalance struct {
+	LoadBalance
+	next uint32
 }
 
-func AddLoadBalanceHandle(lbtype LoadBalanceType, loadBalanceHandle LoadBalanceHandle) {
-	localBalanceHandles[lbtype] = loadBalanceHandle
+func newDefaultLoadBalance(upstream IUpstream) ILoadBalance {
+	lb := &defaultLoadBalance{}
+	lb.LoadBalance = *NewLoadBalance(LOADBALANCE_DEFAULT.String(), upstream)
+	return lb
 }
 
-func defaultLoadBalanceHandle(bcontext *LoadBalanceContext) {
-	upstream := bcontext.Upstream
-	confs := upstream.GetConf().(IProxyConf).GetDstClientConfs()
+func (lb *defaultLoadBalance) Select(bcontext *LoadBalanceContext) {
+	confs := bcontext.Targets
+	if len(confs) <= 0 {
+		return
+	}
 	// 求余
-	index := time.Now().Second() % len(confs)
+	index := atomic.AddUint32(&lb.next, 1) % uint32(len(confs))
 	bcontext.Result = confs[index]
 }
 
-func weighLoadBalanceHandle(bcontext *LoadBalanceContext) {
-	// TODO 按照比例来
+// weightLoadBalance 平滑加权轮询，按有效权重的比例来选择，有效权重见IProxy.GetEffectiveWeight
+type weightLoadBalance struct {
+	LoadBalance
+
+	// 当前权重，dstClientConf作为主键
+	currentWeights map[socket.IClientConf]float64
+
+	mut sync.Mutex
+}
+
+func newWeightLoadBalance(upstream IUpstream) ILoadBalance {
+	lb := &weightLoadBalance{currentWeights: make(map[socket.IClientConf]float64)}
+	lb.LoadBalance = *NewLoadBalance(LOADBALANCE_WEIGHT.String(), upstream)
+	return lb
+}
+
+func (lb *weightLoadBalance) Select(bcontext *LoadBalanceContext) {
+	confs := bcontext.Targets
+	if len(confs) <= 0 {
+		return
+	}
+
+	lb.mut.Lock()
+	defer lb.mut.Unlock()
+	var best socket.IClientConf
+	total := 0.0
+	for _, conf := range confs {
+		weight := getEffectiveWeight(lb.GetUpstream(), conf)
+		total += weight
+		lb.currentWeights[conf] += weight
+		if best == nil || lb.currentWeights[conf] > lb.currentWeights[best] {
+			best = conf
+		}
+	}
+	lb.currentWeights[best] -= total
+	bcontext.Result = best
+}
+
+// getEffectiveWeight 获取有效权重，非IProxy则默认为1
+func getEffectiveWeight(upstream IUpstream, dstClientConf socket.IClientConf) float64 {
+	proxy, ok := upstream.(IProxy)
+	if ok {
+		return proxy.GetEffectiveWeight(dstClientConf)
+	}
+	return 1
+}
+
+// iphashLoadBalance 按agent端ip的hash值选择，同一ip选择同一个dst
+type iphashLoadBalance struct {
+	LoadBalance
 }
 
-func iphashLoadBalanceHandle(bcontext *LoadBalanceContext) {
-	// TODO iphash
+func newIphashLoadBalance(upstream IUpstream) ILoadBalance {
+	lb := &iphashLoadBalance{}
+	lb.LoadBalance = *NewLoadBalance(LOADBALANCE_IPHASH.String(), upstream)
+	return lb
 }
 
-func iphashweighLoadBalanceHandle(bcontext *LoadBalanceContext) {
-	// TODO iphash比重
+func (lb *iphashLoadBalance) Select(bcontext *LoadBalanceContext) {
+	confs := bcontext.Targets
+	if len(confs) <= 0 {
+		return
+	}
+	ip := ""
+	if bcontext.AgentChannel != nil {
+		ip = GetRemoteIp(bcontext.AgentChannel)
+	}
+	bcontext.Result = confs[util.Hashcode(ip)%len(confs)]
+}
+
+// GetRemoteIp 获取channel远端的ip，不包括端口
+func GetRemoteIp(ch channel.IChannel) string {
+	addr := ch.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return ip
+}
+
+// iphashWeightLoadBalance 按agent端ip的hash值在按有效权重展开的区间中选择，同一ip在权重不变时选择同一个dst
+type iphashWeightLoadBalance struct {
+	LoadBalance
+}
+
+func newIphashWeightLoadBalance(upstream IUpstream) ILoadBalance {
+	lb := &iphashWeightLoadBalance{}
+	lb.LoadBalance = *NewLoadBalance(LOADBALANCE_IPHASH_WEIGHT.String(), upstream)
+	return lb
+}
+
+func (lb *iphashWeightLoadBalance) Select(bcontext *LoadBalanceContext) {
+	confs := bcontext.Targets
+	if len(confs) <= 0 {
+		return
+	}
+	ip := ""
+	if bcontext.AgentChannel != nil {
+		ip = GetRemoteIp(bcontext.AgentChannel)
+	}
+	hash := util.Hashcode(ip)
+	weights := make([]float64, len(confs))
+	total := 0.0
+	for index, conf := range confs {
+		weights[index] = getEffectiveWeight(lb.GetUpstream(), conf)
+		total += weights[index]
+	}
+	if total <= 0 {
+		bcontext.Result = confs[hash%len(confs)]
+		return
+	}
+	// hash值映射到[0, total)，落在哪个dst的权重区间即选择哪个
+	point := float64(uint32(hash)) / (1 << 32) * total
+	for index, weight := range weights {
+		point -= weight
+		if point < 0 {
+			bcontext.Result = confs[index]
+			return
+		}
+	}
+	bcontext.Result = confs[len(confs)-1]
+}
+
+// p2cLoadBalance 随机选取两个dst，选择延迟EWMA和会话数综合负载(按有效权重折算后)较低的一个
+type p2cLoadBalance struct {
+	LoadBalance
+}
+
+func newP2cLoadBalance(upstream IUpstream) ILoadBalance {
+	lb := &p2cLoadBalance{}
+	lb.LoadBalance = *NewLoadBalance(LOADBALANCE_P2C.String(), upstream)
+	return lb
+}
+
+func (lb *p2cLoadBalance) Select(bcontext *LoadBalanceContext) {
+	upstream := lb.GetUpstream()
+	confs := bcontext.Targets
+	size := len(confs)
+	if size <= 0 {
+		return
+	} else if size == 1 {
+		bcontext.Result = confs[0]
+		return
+	}
+
+	first := rand.Intn(size)
+	second := rand.Intn(size - 1)
+	if second >= first {
+		second++
+	}
+	firstConf := confs[first]
+	secondConf := confs[second]
+	firstLoad := upstream.GetDstStatis(firstConf).GetLoad() / getEffectiveWeight(upstream, firstConf)
+	secondLoad := upstream.GetDstStatis(secondConf).GetLoad() / getEffectiveWeight(upstream, secondConf)
+	if secondLoad < firstLoad {
+		bcontext.Result = secondConf
+	} else {
+		bcontext.Result = firstConf
+	}
+}
+
+// zoneLoadBalance 就近负载均衡，优先选择与server同zone(标签)的dst，同zone可用的dst比例低于阈值时，
+// 溢出到所有可用的dst，然后在选定的范围内按加权轮询选择
+type zoneLoadBalance struct {
+	LoadBalance
+	weightLb ILoadBalance
+}
+
+func newZoneLoadBalance(upstream IUpstream) ILoadBalance {
+	lb := &zoneLoadBalance{weightLb: newWeightLoadBalance(upstream)}
+	lb.LoadBalance = *NewLoadBalance(LOADBALANCE_ZONE.String(), upstream)
+	return lb
+}
+
+func (lb *zoneLoadBalance) Select(bcontext *LoadBalanceContext) {
+	targets := bcontext.Targets
+	bcontext.Targets = lb.filterZone(bcontext)
+	lb.weightLb.Select(bcontext)
+	bcontext.Targets = targets
+}
+
+// filterZone 过滤出同zone的可用dst，不满足阈值则返回所有可用dst
+func (lb *zoneLoadBalance) filterZone(bcontext *LoadBalanceContext) []socket.IClientConf {
+	targets := bcontext.Targets
+	proxyConf, ok := lb.GetUpstream().GetConf().(IProxyConf)
+	if !ok {
+		return targets
+	}
+	zoneTag := proxyConf.GetZoneTag()
+	localZone := getServerTags(bcontext)[zoneTag]
+	if len(localZone) <= 0 {
+		return targets
+	}
+
+	// 同zone的dst总数
+	total := 0
+	for _, conf := range lb.GetTargets() {
+		if proxyConf.GetDstClientAttr(conf).Tags[zoneTag] == localZone {
+			total++
+		}
+	}
+	if total <= 0 {
+		return targets
+	}
+
+	var sameZones []socket.IClientConf
+	for _, conf := range targets {
+		if proxyConf.GetDstClientAttr(conf).Tags[zoneTag] == localZone {
+			sameZones = append(sameZones, conf)
+		}
+	}
+	ratio := float64(len(sameZones)) / float64(total)
+	if len(sameZones) <= 0 || ratio < proxyConf.GetZoneThreshold() {
+		logx.Debugf("spill over to other zones, zone:%v, ratio:%v", localZone, ratio)
+		return targets
+	}
+	return sameZones
+}
+
+// getServerTags 获取server的标签，优先从上下文的Agserver中获取，否则从upstream所属的service中获取
+func getServerTags(bcontext *LoadBalanceContext) map[string]string {
+	if bcontext.Agserver != nil {
+		agServerConf, ok := bcontext.Agserver.GetConf().(IAgServerConf)
+		if ok {
+			return agServerConf.GetTags()
+		}
+	}
+	if bcontext.Upstream != nil {
+		service, ok := bcontext.Upstream.GetParent().(IService)
+		if ok {
+			return service.GetConf().GetAgServerConf().GetTags()
+		}
+	}
+	return nil
 }
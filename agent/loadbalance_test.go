@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/socket"
+)
+
+// testChannel 只实现RemoteAddr，用于按ip选择的负载均衡
+type testChannel struct {
+	channel.IChannel
+	remoteAddr net.Addr
+}
+
+func (ch *testChannel) RemoteAddr() net.Addr {
+	return ch.remoteAddr
+}
+
+func newTestChannel(ip string) *testChannel {
+	return &testChannel{remoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 10000}}
+}
+
+// newTestProxy 创建带有n个dst的proxy，weights按顺序设置dst的权重
+func newTestProxy(t *testing.T, lbName string, n int, weights ...int) (*Proxy, []socket.IClientConf) {
+	t.Helper()
+	dstClientConfs := make([]socket.IClientConf, n)
+	for i := range dstClientConfs {
+		dstClientConfs[i] = socket.NewTcpClientConf("127.0.0.1", 19000+i)
+	}
+	conf := NewProxyConf("test", LOADBALANCE_DEFAULT, dstClientConfs...)
+	conf.LoadBalanceName = lbName
+	for i, weight := range weights {
+		conf.SetDstClientAttr(dstClientConfs[i], NewDstClientAttr(weight, 0, false, 0))
+	}
+	return NewProxy(nil, conf, nil), dstClientConfs
+}
+
+func selectDst(proxy *Proxy, ch channel.IChannel, targets []socket.IClientConf) socket.IClientConf {
+	lbsCtx := NewLoadBalanceContext(nil, proxy, ch)
+	lbsCtx.Targets = targets
+	proxy.loadBalance.Select(lbsCtx)
+	return lbsCtx.Result
+}
+
+func TestNewProxyWithDocumentedLoadBalance(t *testing.T) {
+	// 配置文件中说明的负载均衡名称，ipsh_weight为旧的拼写
+	names := []string{"default", "weight", "iphash", "iphash_weight", "ipsh_weight", "p2c", "zone"}
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			proxy, dstClientConfs := newTestProxy(t, name, 2)
+			if got := selectDst(proxy, newTestChannel("10.0.0.1"), dstClientConfs); got == nil {
+				t.Fatalf("Select() by %v = nil", name)
+			}
+		})
+	}
+
+	for _, lbType := range []LoadBalanceType{LOADBALANCE_DEFAULT, LOADBALANCE_WEIGHT, LOADBALANCE_IPHASH,
+		LOADBALANCE_IPHASH_WEIGHT, LOADBALANCE_P2C, LOADBALANCE_ZONE} {
+		if CreateLoadBalance(lbType.String(), nil) == nil {
+			t.Fatalf("CreateLoadBalance(%v) = nil", lbType.String())
+		}
+	}
+}
+
+func TestWeightLoadBalance(t *testing.T) {
+	proxy, dstClientConfs := newTestProxy(t, "weight", 3, 5, 1, 1)
+	counts := make(map[socket.IClientConf]int)
+	var seq []int
+	for i := 0; i < 7; i++ {
+		got := selectDst(proxy, nil, dstClientConfs)
+		counts[got]++
+		for index, conf := range dstClientConfs {
+			if conf == got {
+				seq = append(seq, index)
+			}
+		}
+	}
+	want := []int{5, 1, 1}
+	for index, conf := range dstClientConfs {
+		if counts[conf] != want[index] {
+			t.Fatalf("counts of dst%v = %v, want %v, seq:%v", index, counts[conf], want[index], seq)
+		}
+	}
+	// 平滑加权，权重低的dst穿插在中间，而不是连续选择权重高的dst
+	if fmt.Sprint(seq) != "[0 0 1 0 2 0 0]" {
+		t.Fatalf("seq = %v, want [0 0 1 0 2 0 0]", seq)
+	}
+}
+
+func TestIphashLoadBalance(t *testing.T) {
+	proxy, dstClientConfs := newTestProxy(t, "iphash", 4)
+	counts := make(map[socket.IClientConf]int)
+	for i := 0; i < 256; i++ {
+		ch := newTestChannel(fmt.Sprintf("10.0.%v.%v", i/16, i%16))
+		first := selectDst(proxy, ch, dstClientConfs)
+		for j := 0; j < 3; j++ {
+			if got := selectDst(proxy, ch, dstClientConfs); got != first {
+				t.Fatalf("Select() of same ip = %v, want %v", got.GetAddrStr(), first.GetAddrStr())
+			}
+		}
+		counts[first]++
+	}
+	for index, conf := range dstClientConfs {
+		if counts[conf] <= 0 {
+			t.Fatalf("dst%v never selected, counts:%v", index, counts)
+		}
+	}
+}
+
+func TestIphashWeightLoadBalance(t *testing.T) {
+	proxy, dstClientConfs := newTestProxy(t, "iphash_weight", 2, 3, 1)
+	counts := make(map[socket.IClientConf]int)
+	total := 4000
+	for i := 0; i < total; i++ {
+		ch := newTestChannel(fmt.Sprintf("10.%v.%v.%v", i/65536, i/256%256, i%256))
+		first := selectDst(proxy, ch, dstClientConfs)
+		if got := selectDst(proxy, ch, dstClientConfs); got != first {
+			t.Fatalf("Select() of same ip = %v, want %v", got.GetAddrStr(), first.GetAddrStr())
+		}
+		counts[first]++
+	}
+	// 权重3:1，允许一定的hash偏差
+	ratio := float64(counts[dstClientConfs[0]]) / float64(total)
+	if ratio < 0.65 || ratio > 0.85 {
+		t.Fatalf("ratio of dst0 = %v, want about 0.75, counts:%v", ratio, counts)
+	}
+}
+
+func TestP2cLoadBalance(t *testing.T) {
+	proxy, dstClientConfs := newTestProxy(t, "p2c", 2)
+	busy := proxy.GetDstStatis(dstClientConfs[0])
+	for i := 0; i < 10; i++ {
+		busy.IncInflight()
+	}
+	// 只有两个dst时每次都会比较两者，应总是选择负载低的
+	for i := 0; i < 100; i++ {
+		if got := selectDst(proxy, nil, dstClientConfs); got != dstClientConfs[1] {
+			t.Fatalf("Select() = %v, want less loaded %v", got.GetAddrStr(), dstClientConfs[1].GetAddrStr())
+		}
+	}
+
+	// 按权重折算，权重高的dst可以承担更多的负载
+	proxy, dstClientConfs = newTestProxy(t, "p2c", 2, 20, 1)
+	busy = proxy.GetDstStatis(dstClientConfs[0])
+	for i := 0; i < 10; i++ {
+		busy.IncInflight()
+	}
+	for i := 0; i < 100; i++ {
+		if got := selectDst(proxy, nil, dstClientConfs); got != dstClientConfs[0] {
+			t.Fatalf("Select() = %v, want heavier weighted %v", got.GetAddrStr(), dstClientConfs[0].GetAddrStr())
+		}
+	}
+
+	if got := selectDst(proxy, nil, dstClientConfs[1:]); got != dstClientConfs[1] {
+		t.Fatalf("Select() of single target = %v", got)
+	}
+	if got := selectDst(proxy, nil, nil); got != nil {
+		t.Fatalf("Select() of empty targets = %v, want nil", got.GetAddrStr())
+	}
+}
@@ -0,0 +1,227 @@
+/*
+ * 流量镜像，按location将agent端的消息同时发送到另一个upstream的影子dst，影子dst的响应只统计后丢弃，
+ * 影子端的任何异常都不影响主会话
+ * Author:slive
+ * DATE:2021/4/18
+ */
+package agent
+
+import (
+	"github.com/slive/gsfly/channel"
+	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// agentChannel中存放镜像的影子dstChannel的附件key
+	MirrorDstChannel_Attach_key = "mirrorDstChannel"
+
+	// 默认镜像比例
+	default_mirror_percent = 100
+
+	// 镜像比例未配置，取默认镜像比例
+	MIRROR_PERCENT_UNSET = -1
+
+	// 每个影子dstChannel待发送的消息队列长度，队列满则丢弃
+	mirror_queue_size = 128
+
+	// 默认的影子dst拨号超时时间
+	default_mirror_dial_timeout = 5 * time.Second
+)
+
+// MirrorStatis 镜像统计
+type MirrorStatis struct {
+	// 镜像的会话数
+	Sessions int64
+
+	// 影子dst拨号失败数
+	DialErrors int64
+
+	// 发送到影子dst的消息数
+	Sent int64
+
+	// 未能发送到影子dst的消息数，如影子dst未连接、已关闭或者发送队列已满
+	Dropped int64
+
+	// 影子dst响应的消息数，均已丢弃
+	Received int64
+}
+
+// Mirror 流量镜像，按会话进行抽样，被抽中的会话打开一个影子dstChannel，
+// agent端的消息同时发送到影子dstChannel
+type Mirror struct {
+	upstream IProxy
+
+	// 镜像比例，0-100
+	percent float64
+
+	statis MirrorStatis
+}
+
+// mirrorSession 被镜像的会话，消息经队列由独立的协程发送到影子dstChannel，
+// 影子dst的写阻塞不会影响主会话的读协程
+type mirrorSession struct {
+	dstCh channel.IChannel
+
+	queue chan channel.IChHandleContext
+
+	exit chan bool
+
+	closeOnce sync.Once
+}
+
+// NewMirror 创建流量镜像
+// upstream 影子dst所在的upstream，经过其负载均衡选择影子dst
+// percent 镜像的会话比例，0-100，0则不镜像，MIRROR_PERCENT_UNSET(<0)则取默认值100
+func NewMirror(upstream IProxy, percent float64) *Mirror {
+	if upstream == nil {
+		errMsg := "mirror upstream is nil."
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	if percent < 0 {
+		percent = default_mirror_percent
+	}
+	return &Mirror{upstream: upstream, percent: percent}
+}
+
+func (m *Mirror) GetUpstream() IProxy {
+	return m.upstream
+}
+
+// GetStatis 获取镜像统计
+func (m *Mirror) GetStatis() MirrorStatis {
+	return MirrorStatis{
+		Sessions:   atomic.LoadInt64(&m.statis.Sessions),
+		DialErrors: atomic.LoadInt64(&m.statis.DialErrors),
+		Sent:       atomic.LoadInt64(&m.statis.Sent),
+		Dropped:    atomic.LoadInt64(&m.statis.Dropped),
+		Received:   atomic.LoadInt64(&m.statis.Received),
+	}
+}
+
+// Open 按比例抽样，抽中则异步拨号影子dst，连接成功前的消息不会镜像
+func (m *Mirror) Open(agentCh channel.IChannel, params map[string]interface{}) {
+	if rand.Float64()*100 >= m.percent {
+		return
+	}
+	atomic.AddInt64(&m.statis.Sessions, 1)
+	go m.dial(agentCh, params)
+}
+
+func (m *Mirror) dial(agentCh channel.IChannel, params map[string]interface{}) {
+	agentChId := agentCh.GetId()
+	defer func() {
+		ret := recover()
+		if ret != nil {
+			atomic.AddInt64(&m.statis.DialErrors, 1)
+			logx.Errorf("dial mirror error, agentChId:%v, ret:%v", agentChId, ret)
+		}
+	}()
+	dstClientConf := m.upstream.SelectDstClientConf(agentCh, params)
+	if dstClientConf == nil {
+		atomic.AddInt64(&m.statis.DialErrors, 1)
+		logx.Warn("select mirror dst is nil, agentChId:", agentChId)
+		return
+	}
+	handle := channel.NewDefChHandle(m.onDstChannelReadHandle)
+	clientConn := socket.NewClientSocket(m.upstream, dstClientConf, handle, params)
+	err := dialWithTimeout(clientConn, m.getDialTimeout())
+	if err != nil {
+		atomic.AddInt64(&m.statis.DialErrors, 1)
+		logx.Warnf("dial mirror dst error, agentChId:%v, dst:%v, error:%v", agentChId, dstClientConf.GetAddrStr(), err)
+		return
+	}
+	dstCh := clientConn.GetChannel()
+	session := &mirrorSession{
+		dstCh: dstCh,
+		queue: make(chan channel.IChHandleContext, mirror_queue_size),
+		exit:  make(chan bool, 1),
+	}
+	go m.loop(session)
+	agentCh.AddAttach(MirrorDstChannel_Attach_key, session)
+	if agentCh.IsClosed() {
+		// 拨号期间agentChannel已关闭
+		m.Close(agentCh)
+		return
+	}
+	logx.Infof("open mirror, agentChId:%v, mirrorDstChId:%v", agentChId, dstCh.GetId())
+}
+
+// getDialTimeout 影子dst的拨号超时时间，优先使用upstream的重试超时配置
+func (m *Mirror) getDialTimeout() time.Duration {
+	proxyConf, ok := m.upstream.GetConf().(IProxyConf)
+	if ok {
+		retryConf := proxyConf.GetRetryConf()
+		if retryConf != nil && retryConf.Timeout > 0 {
+			return retryConf.Timeout
+		}
+	}
+	return default_mirror_dial_timeout
+}
+
+// loop 将队列中的消息发送到影子dstChannel，直到会话关闭
+func (m *Mirror) loop(session *mirrorSession) {
+	for {
+		select {
+		case <-session.exit:
+			return
+		case fromCtx := <-session.queue:
+			m.write(session.dstCh, fromCtx)
+		}
+	}
+}
+
+func (m *Mirror) write(dstCh channel.IChannel, fromCtx channel.IChHandleContext) {
+	defer func() {
+		ret := recover()
+		if ret != nil {
+			atomic.AddInt64(&m.statis.Dropped, 1)
+			logx.Warn("mirror transfer error:", ret)
+		}
+	}()
+	if dstCh.IsClosed() {
+		atomic.AddInt64(&m.statis.Dropped, 1)
+		return
+	}
+	m.upstream.GetExtension().Transfer(fromCtx, dstCh)
+	atomic.AddInt64(&m.statis.Sent, 1)
+}
+
+// onDstChannelReadHandle 影子dst的响应只统计，然后丢弃
+func (m *Mirror) onDstChannelReadHandle(dstCtx channel.IChHandleContext) {
+	atomic.AddInt64(&m.statis.Received, 1)
+}
+
+// Transfer 将agent端的消息放入影子dstChannel的发送队列，队列满则丢弃，不阻塞主会话
+func (m *Mirror) Transfer(fromCtx channel.IChHandleContext) {
+	session, ok := fromCtx.GetChannel().GetAttach(MirrorDstChannel_Attach_key).(*mirrorSession)
+	if !ok {
+		return
+	}
+	if session.dstCh.IsClosed() {
+		atomic.AddInt64(&m.statis.Dropped, 1)
+		return
+	}
+	select {
+	case session.queue <- fromCtx:
+	default:
+		atomic.AddInt64(&m.statis.Dropped, 1)
+	}
+}
+
+// Close 关闭agentChannel对应的影子dstChannel
+func (m *Mirror) Close(agentCh channel.IChannel) {
+	session, ok := agentCh.GetAttach(MirrorDstChannel_Attach_key).(*mirrorSession)
+	if ok {
+		agentCh.RemoveAttach(MirrorDstChannel_Attach_key)
+		session.closeOnce.Do(func() {
+			session.exit <- true
+			session.dstCh.Release()
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestNewMirrorPercent(t *testing.T) {
+	proxy, _ := newTestProxy(t, "default", 1)
+	tests := []struct {
+		name    string
+		percent float64
+		want    float64
+	}{
+		{"unset", MIRROR_PERCENT_UNSET, default_mirror_percent},
+		{"disabled", 0, 0},
+		{"partial", 30, 30},
+		{"all", 100, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewMirror(proxy, tt.percent).percent; got != tt.want {
+				t.Fatalf("NewMirror() percent = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 比例为0时不抽样任何会话
+	mirror := NewMirror(proxy, 0)
+	for i := 0; i < 100; i++ {
+		mirror.Open(nil, nil)
+	}
+	if sessions := mirror.GetStatis().Sessions; sessions != 0 {
+		t.Fatalf("sessions = %v, want 0", sessions)
+	}
+}
+
+func TestNewLocationConfMirrorPercentUnset(t *testing.T) {
+	if got := NewLocationConf("/ws", "ups", nil).GetMirrorPercent(); got != MIRROR_PERCENT_UNSET {
+		t.Fatalf("GetMirrorPercent() = %v, want %v", got, MIRROR_PERCENT_UNSET)
+	}
+}
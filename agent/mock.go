@@ -0,0 +1,303 @@
+/*
+ * 模拟方式的upstream，不需要后端，按配置的规则应答agent端的消息，用于客户端开发和故障演练：
+ *  1、echo原样返回，fixed返回固定内容，template按模板生成，close关闭agentChannel
+ *  2、规则按正则或者json字段匹配，按顺序匹配第一个，没有匹配条件的规则匹配所有消息
+ *  3、可配置应答的延迟
+ * Author:slive
+ * DATE:2021/4/27
+ */
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/channel/tcpx"
+	logx "github.com/slive/gsfly/logger"
+	"regexp"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	// MOCK_ECHO 原样返回
+	MOCK_ECHO = "echo"
+	// MOCK_FIXED 返回固定内容
+	MOCK_FIXED = "fixed"
+	// MOCK_TEMPLATE 按模板生成应答，见MockTemplateData
+	MOCK_TEMPLATE = "template"
+	// MOCK_CLOSE 关闭agentChannel，Response作为关闭原因
+	MOCK_CLOSE = "close"
+)
+
+// MockRule 模拟应答的规则
+type MockRule struct {
+	// 应答方式
+	Type string
+
+	// 正则匹配消息，为空则不按正则匹配
+	Pattern string
+
+	// json字段名，为空则不按json字段匹配
+	Field string
+
+	// json字段值，为空则字段存在即匹配
+	Value string
+
+	// fixed方式为应答内容，template方式为模板，close方式为关闭原因
+	Response string
+
+	// 应答的延迟
+	Delay time.Duration
+
+	regex *regexp.Regexp
+
+	tmpl *template.Template
+}
+
+// NewMockRule 创建模拟应答的规则，正则和模板无效则panic
+func NewMockRule(ruleType string, pattern string, field string, value string, response string, delay time.Duration) *MockRule {
+	rule := &MockRule{
+		Type:     ruleType,
+		Pattern:  pattern,
+		Field:    field,
+		Value:    value,
+		Response: response,
+		Delay:    delay,
+	}
+	switch ruleType {
+	case MOCK_ECHO, MOCK_FIXED, MOCK_CLOSE:
+	case MOCK_TEMPLATE:
+		tmpl, err := template.New("mock").Parse(response)
+		if err != nil {
+			errMsg := "mock template is invalid:" + err.Error()
+			logx.Error(errMsg)
+			panic(errMsg)
+		}
+		rule.tmpl = tmpl
+	default:
+		errMsg := "mock rule type is invalid:" + ruleType
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	if len(pattern) > 0 {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			errMsg := "mock pattern is invalid:" + err.Error()
+			logx.Error(errMsg)
+			panic(errMsg)
+		}
+		rule.regex = regex
+	}
+	return rule
+}
+
+// MockTemplateData 模板的数据，如{{.Msg}}，{{index .Groups 1}}，{{.Json.id}}，{{.Params.uid}}
+type MockTemplateData struct {
+	// agent端的消息
+	Msg string
+
+	// 正则匹配的分组，0为整个匹配
+	Groups []string
+
+	// 消息解析为json的内容，非json则为nil
+	Json map[string]interface{}
+
+	// 握手参数
+	Params map[string]interface{}
+}
+
+// match 是否匹配，返回模板的数据
+func (rule *MockRule) match(data []byte, params map[string]interface{}) (*MockTemplateData, bool) {
+	tmplData := &MockTemplateData{Msg: string(data), Params: params}
+	if rule.regex != nil {
+		groups := rule.regex.FindStringSubmatch(tmplData.Msg)
+		if groups == nil {
+			return nil, false
+		}
+		tmplData.Groups = groups
+	}
+	msg := make(map[string]interface{})
+	if json.Unmarshal(data, &msg) == nil {
+		tmplData.Json = msg
+	}
+	if len(rule.Field) > 0 {
+		value, found := tmplData.Json[rule.Field]
+		if !found {
+			return nil, false
+		}
+		if len(rule.Value) > 0 && fmt.Sprintf("%v", value) != rule.Value {
+			return nil, false
+		}
+	}
+	return tmplData, true
+}
+
+// respond 生成应答内容
+func (rule *MockRule) respond(data []byte, tmplData *MockTemplateData) ([]byte, error) {
+	switch rule.Type {
+	case MOCK_ECHO:
+		return data, nil
+	case MOCK_TEMPLATE:
+		buf := &bytes.Buffer{}
+		err := rule.tmpl.Execute(buf, tmplData)
+		return buf.Bytes(), err
+	default:
+		return []byte(rule.Response), nil
+	}
+}
+
+type IMockConf interface {
+	IUpstreamConf
+
+	// GetRules 模拟应答的规则，按顺序匹配
+	GetRules() []*MockRule
+}
+
+// MockConf 模拟方式的upstream配置
+type MockConf struct {
+	UpstreamConf
+
+	Rules []*MockRule
+}
+
+// NewMockConf 创建模拟方式的upstream配置，没有规则则默认echo
+func NewMockConf(id string, rules ...*MockRule) *MockConf {
+	if len(rules) <= 0 {
+		rules = []*MockRule{NewMockRule(MOCK_ECHO, "", "", "", "", 0)}
+	}
+	m := &MockConf{Rules: rules}
+	m.UpstreamConf = *NewUpstreamConf(id, UPSTREAM_MOCK)
+	return m
+}
+
+func (mc *MockConf) GetRules() []*MockRule {
+	return mc.Rules
+}
+
+// Mock 模拟方式的upstream
+type Mock struct {
+	Upstream
+
+	MockConf IMockConf
+
+	// agentChId -> 握手参数
+	sessions map[string]map[string]interface{}
+
+	sessionMut sync.RWMutex
+}
+
+func NewMock(parent interface{}, mockConf IMockConf, extension IExtension) *Mock {
+	m := &Mock{
+		MockConf: mockConf,
+		sessions: make(map[string]map[string]interface{}),
+	}
+	m.Upstream = *NewUpstream(parent, mockConf, extension)
+	return m
+}
+
+// InitChannelPeer 记录握手参数，不需要dst端，ret为agentChannel
+func (m *Mock) InitChannelPeer(agentCtx channel.IChHandleContext, params map[string]interface{}) {
+	agentCh := agentCtx.GetChannel()
+	m.sessionMut.Lock()
+	m.sessions[agentCh.GetId()] = params
+	m.sessionMut.Unlock()
+	agentCtx.SetRet(agentCh)
+	logx.Info("finish mock initChannelPeer, agentChId:", agentCh.GetId())
+}
+
+// TransferAgentMsg 按规则应答agent端的消息，没有匹配的规则则忽略，见IAgentMsgTransfer
+func (m *Mock) TransferAgentMsg(agentCtx channel.IChHandleContext) bool {
+	agentCh := agentCtx.GetChannel()
+	m.sessionMut.RLock()
+	params, found := m.sessions[agentCh.GetId()]
+	m.sessionMut.RUnlock()
+	if !found {
+		return false
+	}
+	packet := agentCtx.GetPacket()
+	data := packet.GetData()
+	for _, rule := range m.MockConf.GetRules() {
+		tmplData, ok := rule.match(data, params)
+		if !ok {
+			continue
+		}
+		resp, err := rule.respond(data, tmplData)
+		if err != nil {
+			logx.Warnf("mock respond error, agentChId:%v, error:%v", agentCh.GetId(), err)
+			return true
+		}
+		msgType := 0
+		wsPacket, ok := packet.(*tcpx.WsPacket)
+		if ok {
+			msgType = wsPacket.MsgType
+		}
+		// 原消息在处理后可能被回收，复制应答内容
+		resp = append([]byte(nil), resp...)
+		if rule.Delay > 0 {
+			time.AfterFunc(rule.Delay, func() {
+				m.reply(agentCh, rule, resp, msgType)
+			})
+		} else {
+			m.reply(agentCh, rule, resp, msgType)
+		}
+		return true
+	}
+	logx.Debug("no mock rule matched, agentChId:", agentCh.GetId())
+	return true
+}
+
+func (m *Mock) reply(agentCh channel.IChannel, rule *MockRule, resp []byte, msgType int) {
+	if agentCh.IsClosed() {
+		return
+	}
+	if rule.Type == MOCK_CLOSE {
+		logx.Info("mock close, agentChId:", agentCh.GetId())
+		closeWithInfo(agentCh, NewCloseInfo(agentCh.GetConf().GetNetwork(), CLOSE_CAUSE_ERROR, 0, string(resp)))
+		agentCh.Release()
+		return
+	}
+	packet := agentCh.NewPacket()
+	packet.SetData(resp)
+	wsPacket, ok := packet.(*tcpx.WsPacket)
+	if ok {
+		wsPacket.MsgType = msgType
+	}
+	syncAgentWrite(agentCh, func() {
+		agentCh.Write(packet)
+	})
+}
+
+// GetChannelPeer 没有dst端，没有channelpeer
+func (m *Mock) GetChannelPeer(ctx channel.IChHandleContext, isAgent bool) IChannelPeer {
+	return nil
+}
+
+func (m *Mock) QueryDstChannel(ctx channel.IChHandleContext) {
+	logx.Warn("mock has no dst channel.")
+}
+
+func (m *Mock) QueryAgentChannel(ctx channel.IChHandleContext) {
+	logx.Warn("mock has no dst channel.")
+}
+
+// ReleaseOnAgentChannel agentChannel关闭，清除会话
+func (m *Mock) ReleaseOnAgentChannel(agentCtx channel.IChHandleContext) {
+	m.sessionMut.Lock()
+	delete(m.sessions, agentCtx.GetChannel().GetId())
+	m.sessionMut.Unlock()
+}
+
+// ReleaseOnDstChannel 没有dst端，空实现
+func (m *Mock) ReleaseOnDstChannel(dstCtx channel.IChHandleContext) {
+}
+
+// ReleaseChannelPeers 清除所有会话
+func (m *Mock) ReleaseChannelPeers() {
+	m.sessionMut.Lock()
+	m.sessions = make(map[string]map[string]interface{})
+	m.sessionMut.Unlock()
+	m.Upstream.ReleaseChannelPeers()
+}
@@ -0,0 +1,505 @@
+/*
+ * 多路复用方式的upstream，多个agent端的会话共用少量长连接的dstChannel，
+ * 每个消息按mux包的分帧协议带上会话id，会话打开和关闭时发送控制帧
+ * Author:slive
+ * DATE:2021/4/19
+ */
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/slive/gsfly-agent/mux"
+	"github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/channel/tcpx"
+	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 每个dstclient默认的连接数
+	default_mux_pool_size = 2
+
+	// 补充dst长连接的间隔
+	mux_maintain_interval = time.Second
+)
+
+type IMultiplexConf interface {
+	IUpstreamConf
+
+	// GetDstClientConfs 多路复用的dst客户端配置列表
+	GetDstClientConfs() []socket.IClientConf
+
+	// GetPoolSize 每个dstclient的长连接数
+	GetPoolSize() int
+}
+
+// MultiplexConf 多路复用方式的upstream配置
+type MultiplexConf struct {
+	UpstreamConf
+
+	// dst客户端配置列表
+	DstClientConfs []socket.IClientConf
+
+	// 每个dstclient的长连接数
+	PoolSize int
+}
+
+func NewMultiplexConf(id string, poolSize int, dstClientConfs ...socket.IClientConf) *MultiplexConf {
+	if len(dstClientConfs) <= 0 {
+		errMsg := "dstClientConfs are nil"
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	if poolSize <= 0 {
+		poolSize = default_mux_pool_size
+	}
+	m := &MultiplexConf{
+		DstClientConfs: dstClientConfs,
+		PoolSize:       poolSize,
+	}
+	m.UpstreamConf = *NewUpstreamConf(id, UPSTREAM_MULTIPLEX)
+	return m
+}
+
+func (mc *MultiplexConf) GetDstClientConfs() []socket.IClientConf {
+	return mc.DstClientConfs
+}
+
+func (mc *MultiplexConf) GetPoolSize() int {
+	return mc.PoolSize
+}
+
+// muxConn 多路复用的dst长连接
+type muxConn struct {
+	dstClientConf socket.IClientConf
+
+	dstChannel channel.IChannel
+
+	// 解帧，只在dstChannel的读协程中使用
+	decoder *mux.Decoder
+
+	// 承载的会话数
+	sessions int64
+
+	// 多个会话共用长连接，写帧需串行
+	writeMut sync.Mutex
+}
+
+// muxSession 多路复用的会话
+type muxSession struct {
+	sessionId uint32
+
+	conn *muxConn
+
+	chPeer *ChannelPeer
+
+	// agent端最近一次ws消息类型，dst端的消息按此类型写回agent端
+	msgType int32
+}
+
+// Multiplex 多路复用方式的upstream
+type Multiplex struct {
+	Upstream
+
+	MultiplexConf IMultiplexConf
+
+	conns []*muxConn
+
+	connMut sync.RWMutex
+
+	// 会话id生成，在sessionMut内分配
+	sessionSeq uint32
+
+	// agentChId作为主键
+	agentSessions map[string]*muxSession
+
+	// sessionId作为主键
+	idSessions map[uint32]*muxSession
+
+	sessionMut sync.RWMutex
+
+	exit chan bool
+
+	startOnce sync.Once
+
+	stopOnce sync.Once
+}
+
+func NewMultiplex(parent interface{}, multiplexConf IMultiplexConf, extension IExtension) *Multiplex {
+	m := &Multiplex{
+		MultiplexConf: multiplexConf,
+		agentSessions: make(map[string]*muxSession),
+		idSessions:    make(map[uint32]*muxSession),
+		exit:          make(chan bool),
+	}
+	m.Upstream = *NewUpstream(parent, multiplexConf, extension)
+	return m
+}
+
+// Start 预先建立所有的长连接，并在后台补充断开的长连接
+func (m *Multiplex) Start() error {
+	m.startOnce.Do(func() {
+		m.maintain()
+		go m.loop()
+	})
+	return nil
+}
+
+// Stop 停止后台补充长连接
+func (m *Multiplex) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.exit)
+	})
+}
+
+func (m *Multiplex) loop() {
+	defer func() {
+		ret := recover()
+		if ret != nil {
+			logx.Error("mux maintain error:", ret)
+		}
+	}()
+	ticker := time.NewTicker(mux_maintain_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.exit:
+			return
+		case <-ticker.C:
+			m.maintain()
+		}
+	}
+}
+
+// maintain 每个dstclient补充到PoolSize个长连接
+func (m *Multiplex) maintain() {
+	for _, dstClientConf := range m.MultiplexConf.GetDstClientConfs() {
+		need := m.MultiplexConf.GetPoolSize() - m.countConns(dstClientConf)
+		for i := 0; i < need; i++ {
+			_, err := m.dial(dstClientConf)
+			if err != nil {
+				logx.Warnf("dial mux dst error, dst:%v, error:%v", dstClientConf.GetAddrStr(), err)
+				break
+			}
+		}
+	}
+}
+
+func (m *Multiplex) countConns(dstClientConf socket.IClientConf) int {
+	m.connMut.RLock()
+	defer m.connMut.RUnlock()
+	count := 0
+	for _, conn := range m.conns {
+		if conn.dstClientConf == dstClientConf && !conn.dstChannel.IsClosed() {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *Multiplex) dial(dstClientConf socket.IClientConf) (*muxConn, error) {
+	handle := channel.NewDefChHandle(m.onDstChannelReadHandle)
+	handle.SetOnConnect(onChannelConnectHandle)
+	handle.SetOnRelease(m.onDstChannelInActiveHandle)
+	handle.SetOnError(onChannelErrorHandle)
+	clientConn := socket.NewClientSocket(m, dstClientConf, handle, nil)
+	err := clientConn.Dial()
+	if err != nil {
+		return nil, err
+	}
+	dstCh := clientConn.GetChannel()
+	conn := &muxConn{
+		dstClientConf: dstClientConf,
+		dstChannel:    dstCh,
+		decoder:       mux.NewDecoder(),
+	}
+	m.connMut.Lock()
+	m.conns = append(m.conns, conn)
+	m.connMut.Unlock()
+	m.GetDstChannels().Put(dstCh.GetId(), dstCh)
+	logx.Info("open mux conn, dstChId:", dstCh.GetId())
+	return conn, nil
+}
+
+// selectConn 选择承载会话数最少的长连接，没有可用的连接则重新拨号
+func (m *Multiplex) selectConn() (*muxConn, error) {
+	m.connMut.RLock()
+	var selected *muxConn
+	for _, conn := range m.conns {
+		if conn.dstChannel.IsClosed() {
+			continue
+		}
+		if selected == nil || atomic.LoadInt64(&conn.sessions) < atomic.LoadInt64(&selected.sessions) {
+			selected = conn
+		}
+	}
+	m.connMut.RUnlock()
+	if selected != nil {
+		return selected, nil
+	}
+
+	var err error
+	for _, dstClientConf := range m.MultiplexConf.GetDstClientConfs() {
+		selected, err = m.dial(dstClientConf)
+		if err == nil {
+			return selected, nil
+		}
+		logx.Warnf("dial mux dst error, dst:%v, error:%v", dstClientConf.GetAddrStr(), err)
+	}
+	return nil, err
+}
+
+// InitChannelPeer 为agentChannel分配会话id，并通过长连接发送FRAME_OPEN帧，payload为参数的json
+func (m *Multiplex) InitChannelPeer(agentCtx channel.IChHandleContext, params map[string]interface{}) {
+	agentCh := agentCtx.GetChannel()
+	agentChId := agentCh.GetId()
+	conn, err := m.selectConn()
+	if err != nil || conn == nil {
+		logx.Error("select mux conn error, agentChId:", agentChId)
+		return
+	}
+
+	payload, err := json.Marshal(params)
+	if err != nil {
+		logx.Warn("marshal params error:", err)
+		payload = nil
+	}
+	chPeer := NewChannelPeer(agentCh, conn.dstChannel)
+	chPeer.SetDstClientConf(conn.dstClientConf)
+	session := &muxSession{
+		conn:    conn,
+		chPeer:  chPeer,
+		msgType: websocket.TextMessage,
+	}
+	// 先占用会话id再发送FRAME_OPEN帧，避免并发的会话分配到相同的id
+	m.sessionMut.Lock()
+	sessionId, ok := m.nextSessionId()
+	if !ok {
+		m.sessionMut.Unlock()
+		logx.Error("no free mux session id, agentChId:", agentChId)
+		return
+	}
+	session.sessionId = sessionId
+	m.agentSessions[agentChId] = session
+	m.idSessions[sessionId] = session
+	m.sessionMut.Unlock()
+	atomic.AddInt64(&conn.sessions, 1)
+	m.GetDstStatis(conn.dstClientConf).IncInflight()
+
+	err = m.writeFrame(conn, mux.NewFrame(mux.FRAME_OPEN, sessionId, payload))
+	if err != nil {
+		m.removeSession(agentChId)
+		logx.Errorf("write mux open frame error, agentChId:%v, error:%v", agentChId, err)
+		return
+	}
+	agentCtx.SetRet(conn.dstChannel)
+	logx.Infof("finish mux initChannelPeer, agentChId:%v, sessionId:%v, dstChId:%v", agentChId, sessionId, conn.dstChannel.GetId())
+}
+
+// TransferAgentMsg 将agent端的消息封装为FRAME_DATA帧发送到长连接，见IAgentMsgTransfer
+func (m *Multiplex) TransferAgentMsg(agentCtx channel.IChHandleContext) bool {
+	session := m.getSession(agentCtx.GetChannel().GetId())
+	if session == nil {
+		return false
+	}
+	packet := agentCtx.GetPacket()
+	wsPacket, ok := packet.(*tcpx.WsPacket)
+	if ok {
+		atomic.StoreInt32(&session.msgType, int32(wsPacket.MsgType))
+	}
+	err := m.writeFrame(session.conn, mux.NewFrame(mux.FRAME_DATA, session.sessionId, packet.GetData()))
+	if err != nil {
+		logx.Warnf("write mux data frame error, sessionId:%v, error:%v", session.sessionId, err)
+	}
+	return true
+}
+
+// nextSessionId 分配非0且未被会话占用的会话id，都被占用则返回false，调用方持有sessionMut
+func (m *Multiplex) nextSessionId() (uint32, bool) {
+	if uint64(len(m.idSessions)) >= math.MaxUint32 {
+		return 0, false
+	}
+	for {
+		m.sessionSeq++
+		if m.sessionSeq == 0 {
+			continue
+		}
+		_, found := m.idSessions[m.sessionSeq]
+		if !found {
+			return m.sessionSeq, true
+		}
+	}
+}
+
+func (m *Multiplex) writeFrame(conn *muxConn, frame *mux.Frame) error {
+	conn.writeMut.Lock()
+	defer conn.writeMut.Unlock()
+	dstCh := conn.dstChannel
+	if dstCh.IsClosed() {
+		return errors.New("mux conn is closed, dstChId:" + dstCh.GetId())
+	}
+	packet := dstCh.NewPacket()
+	packet.SetData(frame.Encode())
+	wsPacket, ok := packet.(*tcpx.WsPacket)
+	if ok {
+		wsPacket.MsgType = websocket.BinaryMessage
+	}
+	return dstCh.Write(packet)
+}
+
+func (m *Multiplex) getSession(agentChId string) *muxSession {
+	m.sessionMut.RLock()
+	defer m.sessionMut.RUnlock()
+	return m.agentSessions[agentChId]
+}
+
+// onDstChannelReadHandle 解帧后按会话id写回agentChannel
+func (m *Multiplex) onDstChannelReadHandle(dstCtx channel.IChHandleContext) {
+	conn := m.getConn(dstCtx.GetChannel())
+	if conn == nil {
+		logx.Warn("unknown mux conn, dstChId:", dstCtx.GetChannel().GetId())
+		return
+	}
+	frames, err := conn.decoder.Feed(dstCtx.GetPacket().GetData())
+	if err != nil {
+		logx.Errorf("decode mux frame error, dstChId:%v, error:%v", conn.dstChannel.GetId(), err)
+	}
+	for _, frame := range frames {
+		m.sessionMut.RLock()
+		session := m.idSessions[frame.SessionId]
+		m.sessionMut.RUnlock()
+		if session == nil {
+			logx.Debugf("mux session is not existed, sessionId:%v, type:%v", frame.SessionId, frame.Type)
+			continue
+		}
+		agentCh := session.chPeer.GetAgentChannel()
+		switch frame.Type {
+		case mux.FRAME_DATA:
+			packet := agentCh.NewPacket()
+			packet.SetData(frame.Payload)
+			wsPacket, ok := packet.(*tcpx.WsPacket)
+			if ok {
+				wsPacket.MsgType = int(atomic.LoadInt32(&session.msgType))
+			}
+			syncAgentWrite(agentCh, func() {
+				agentCh.Write(packet)
+			})
+		case mux.FRAME_CLOSE:
+			// dst端关闭会话
+			m.removeSession(agentCh.GetId())
+			agentCh.Release()
+		default:
+			logx.Warnf("unexpected mux frame, sessionId:%v, type:%v", frame.SessionId, frame.Type)
+		}
+	}
+}
+
+func (m *Multiplex) getConn(dstCh channel.IChannel) *muxConn {
+	m.connMut.RLock()
+	defer m.connMut.RUnlock()
+	for _, conn := range m.conns {
+		if conn.dstChannel.GetId() == dstCh.GetId() {
+			return conn
+		}
+	}
+	return nil
+}
+
+// onDstChannelInActiveHandle 长连接断开，关闭其上所有会话的agentChannel
+func (m *Multiplex) onDstChannelInActiveHandle(dstCtx channel.IChHandleContext) {
+	m.ReleaseOnDstChannel(dstCtx)
+}
+
+// GetChannelPeer 获取channelpeer，只支持通过agent端获取，dst端为多个会话共用
+func (m *Multiplex) GetChannelPeer(ctx channel.IChHandleContext, isAgent bool) IChannelPeer {
+	if !isAgent {
+		return nil
+	}
+	session := m.getSession(ctx.GetChannel().GetId())
+	if session == nil {
+		return nil
+	}
+	return session.chPeer
+}
+
+func (m *Multiplex) QueryDstChannel(ctx channel.IChHandleContext) {
+	InnerQueryDstChannel(m, ctx)
+}
+
+func (m *Multiplex) QueryAgentChannel(ctx channel.IChHandleContext) {
+	logx.Warn("mux dst channel is shared, agent channel can not be queried.")
+}
+
+// ReleaseOnAgentChannel agentChannel关闭，发送FRAME_CLOSE帧，长连接保留
+func (m *Multiplex) ReleaseOnAgentChannel(agentCtx channel.IChHandleContext) {
+	session := m.removeSession(agentCtx.GetChannel().GetId())
+	if session != nil {
+		err := m.writeFrame(session.conn, mux.NewFrame(mux.FRAME_CLOSE, session.sessionId, nil))
+		if err != nil {
+			logx.Debugf("write mux close frame error, sessionId:%v, error:%v", session.sessionId, err)
+		}
+	}
+}
+
+// ReleaseOnDstChannel 长连接断开，移除该连接并关闭其上所有会话的agentChannel
+func (m *Multiplex) ReleaseOnDstChannel(dstCtx channel.IChHandleContext) {
+	dstCh := dstCtx.GetChannel()
+	dstChId := dstCh.GetId()
+	m.connMut.Lock()
+	for index, conn := range m.conns {
+		if conn.dstChannel.GetId() == dstChId {
+			m.conns = append(m.conns[:index], m.conns[index+1:]...)
+			break
+		}
+	}
+	m.connMut.Unlock()
+	m.GetDstChannels().Remove(dstChId)
+
+	var agentChs []channel.IChannel
+	m.sessionMut.RLock()
+	for _, session := range m.agentSessions {
+		if session.conn.dstChannel.GetId() == dstChId {
+			agentChs = append(agentChs, session.chPeer.GetAgentChannel())
+		}
+	}
+	m.sessionMut.RUnlock()
+	logx.Infof("mux conn closed, dstChId:%v, sessions:%v", dstChId, len(agentChs))
+	for _, agentCh := range agentChs {
+		m.removeSession(agentCh.GetId())
+		closePeer(m.GetExtension(), dstCh, agentCh)
+	}
+}
+
+func (m *Multiplex) removeSession(agentChId string) *muxSession {
+	m.sessionMut.Lock()
+	session, found := m.agentSessions[agentChId]
+	if found {
+		delete(m.agentSessions, agentChId)
+		delete(m.idSessions, session.sessionId)
+	}
+	m.sessionMut.Unlock()
+	if !found {
+		return nil
+	}
+	atomic.AddInt64(&session.conn.sessions, -1)
+	m.GetDstStatis(session.conn.dstClientConf).DecInflight()
+	return session
+}
+
+// ReleaseChannelPeers 释放所有会话和长连接
+func (m *Multiplex) ReleaseChannelPeers() {
+	m.sessionMut.Lock()
+	m.agentSessions = make(map[string]*muxSession)
+	m.idSessions = make(map[uint32]*muxSession)
+	m.sessionMut.Unlock()
+	m.connMut.Lock()
+	m.conns = nil
+	m.connMut.Unlock()
+	m.Upstream.ReleaseChannelPeers()
+}
@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMultiplexNextSessionId(t *testing.T) {
+	tests := []struct {
+		name  string
+		start uint32
+		inUse []uint32
+		want  []uint32
+	}{
+		{"sequential", 0, nil, []uint32{1, 2, 3}},
+		{"skips in use", 0, []uint32{2, 3}, []uint32{1, 4}},
+		{"wraps skipping zero", math.MaxUint32 - 1, nil, []uint32{math.MaxUint32, 1, 2}},
+		{"wraps skipping in use", math.MaxUint32, []uint32{1, 2}, []uint32{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Multiplex{idSessions: make(map[uint32]*muxSession)}
+			m.sessionSeq = tt.start
+			for _, id := range tt.inUse {
+				m.idSessions[id] = &muxSession{sessionId: id}
+			}
+			for _, want := range tt.want {
+				got, ok := m.nextSessionId()
+				if !ok || got != want {
+					t.Fatalf("nextSessionId() = %v, %v, want %v, true", got, ok, want)
+				}
+				m.idSessions[got] = &muxSession{sessionId: got}
+			}
+		})
+	}
+}
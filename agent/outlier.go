@@ -0,0 +1,239 @@
+/*
+ * 被动的异常dst检测，根据真实流量(拨号失败，dstchannel建立后很快就关闭)摘除异常的dst
+ * Author:slive
+ * DATE:2021/4/15
+ */
+package agent
+
+import (
+	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
+	"sync"
+	"time"
+)
+
+const (
+	default_outlier_consecutive_errors = 5
+	default_outlier_short_lived        = 3 * time.Second
+	default_outlier_base_ejection      = 30 * time.Second
+	default_outlier_max_ejection       = 5 * time.Minute
+
+	// 最多保留的摘除事件数
+	max_ejection_events = 100
+)
+
+const (
+	EJECT_REASON_DIAL  = "dial"
+	EJECT_REASON_CLOSE = "close"
+)
+
+// OutlierConf 异常检测配置
+type OutlierConf struct {
+	// 连续多少次异常后摘除
+	ConsecutiveErrors int
+
+	// dstchannel建立后在该时长内关闭视为异常关闭
+	ShortLived time.Duration
+
+	// 第一次摘除的时长，之后每次摘除时长翻倍
+	BaseEjection time.Duration
+
+	// 最大摘除时长，超过该时长未再摘除则重新从BaseEjection开始
+	MaxEjection time.Duration
+}
+
+// NewOutlierConf 创建异常检测配置，参数<=0则取默认值
+func NewOutlierConf(consecutiveErrors int, shortLived time.Duration, baseEjection time.Duration, maxEjection time.Duration) *OutlierConf {
+	if consecutiveErrors <= 0 {
+		consecutiveErrors = default_outlier_consecutive_errors
+	}
+	if shortLived <= 0 {
+		shortLived = default_outlier_short_lived
+	}
+	if baseEjection <= 0 {
+		baseEjection = default_outlier_base_ejection
+	}
+	if maxEjection <= 0 {
+		maxEjection = default_outlier_max_ejection
+	}
+	if maxEjection < baseEjection {
+		maxEjection = baseEjection
+	}
+	return &OutlierConf{
+		ConsecutiveErrors: consecutiveErrors,
+		ShortLived:        shortLived,
+		BaseEjection:      baseEjection,
+		MaxEjection:       maxEjection,
+	}
+}
+
+// EjectionEvent 摘除事件
+type EjectionEvent struct {
+	// 被摘除的dst
+	DstClientConf socket.IClientConf
+
+	// 摘除原因，见EJECT_REASON_XXX
+	Reason string
+
+	// 连续第几次被摘除
+	EjectCount int
+
+	// 摘除时间
+	EjectTime time.Time
+
+	// 摘除截止时间
+	EjectedUntil time.Time
+}
+
+type outlierState struct {
+	// 连续异常次数
+	consecutive int
+
+	// 连续摘除次数
+	ejectCount int
+
+	// 摘除截止时间
+	ejectedUntil time.Time
+}
+
+// OutlierDetector 异常检测，连续异常达到阈值后，摘除dst一段时间，摘除时长按次数翻倍增长
+type OutlierDetector struct {
+	upstreamId string
+
+	conf *OutlierConf
+
+	states map[socket.IClientConf]*outlierState
+
+	// 最近的摘除事件
+	events []*EjectionEvent
+
+	mut sync.RWMutex
+}
+
+func NewOutlierDetector(upstreamId string, conf *OutlierConf) *OutlierDetector {
+	return &OutlierDetector{
+		upstreamId: upstreamId,
+		conf:       conf,
+		states:     make(map[socket.IClientConf]*outlierState),
+	}
+}
+
+func (od *OutlierDetector) GetConf() *OutlierConf {
+	return od.conf
+}
+
+// OnDial 记录拨号结果，连续拨号失败达到阈值后摘除
+func (od *OutlierDetector) OnDial(dstClientConf socket.IClientConf, err error) {
+	if err != nil {
+		od.onError(dstClientConf, EJECT_REASON_DIAL)
+	} else {
+		od.onSuccess(dstClientConf)
+	}
+}
+
+// OnDstRelease 记录dst端关闭，建立后很快就关闭的视为异常
+func (od *OutlierDetector) OnDstRelease(dstClientConf socket.IClientConf, lived time.Duration) {
+	if lived < od.conf.ShortLived {
+		od.onError(dstClientConf, EJECT_REASON_CLOSE)
+	} else {
+		od.onSuccess(dstClientConf)
+	}
+}
+
+func (od *OutlierDetector) onSuccess(dstClientConf socket.IClientConf) {
+	od.mut.Lock()
+	defer od.mut.Unlock()
+	state, found := od.states[dstClientConf]
+	if found {
+		state.consecutive = 0
+	}
+}
+
+func (od *OutlierDetector) onError(dstClientConf socket.IClientConf, reason string) {
+	now := time.Now()
+	od.mut.Lock()
+	defer od.mut.Unlock()
+	state := od.getState(dstClientConf)
+	if now.Before(state.ejectedUntil) {
+		// 摘除中，不再重复计算
+		return
+	}
+	state.consecutive++
+	if state.consecutive < od.conf.ConsecutiveErrors {
+		return
+	}
+
+	// 距离上次摘除结束已超过最大摘除时长，则重新计算摘除次数
+	if !state.ejectedUntil.IsZero() && now.Sub(state.ejectedUntil) > od.conf.MaxEjection {
+		state.ejectCount = 0
+	}
+	state.consecutive = 0
+	state.ejectCount++
+	ejection := od.conf.BaseEjection
+	for i := 1; i < state.ejectCount && ejection < od.conf.MaxEjection; i++ {
+		ejection *= 2
+	}
+	if ejection > od.conf.MaxEjection {
+		ejection = od.conf.MaxEjection
+	}
+	state.ejectedUntil = now.Add(ejection)
+
+	event := &EjectionEvent{
+		DstClientConf: dstClientConf,
+		Reason:        reason,
+		EjectCount:    state.ejectCount,
+		EjectTime:     now,
+		EjectedUntil:  state.ejectedUntil,
+	}
+	od.events = append(od.events, event)
+	if len(od.events) > max_ejection_events {
+		od.events = od.events[len(od.events)-max_ejection_events:]
+	}
+	logx.Warnf("eject dst, upstreamId:%v, dst:%v, reason:%v, ejectCount:%v, ejection:%v",
+		od.upstreamId, dstClientConf.GetAddrStr(), reason, state.ejectCount, ejection)
+}
+
+func (od *OutlierDetector) getState(dstClientConf socket.IClientConf) *outlierState {
+	state, found := od.states[dstClientConf]
+	if !found {
+		state = &outlierState{}
+		od.states[dstClientConf] = state
+	}
+	return state
+}
+
+// IsEjected dst是否被摘除中
+func (od *OutlierDetector) IsEjected(dstClientConf socket.IClientConf) bool {
+	return time.Now().Before(od.GetEjectedUntil(dstClientConf))
+}
+
+// GetEjectedUntil 获取dst的摘除截止时间，未摘除过则为零值
+func (od *OutlierDetector) GetEjectedUntil(dstClientConf socket.IClientConf) time.Time {
+	od.mut.RLock()
+	defer od.mut.RUnlock()
+	state, found := od.states[dstClientConf]
+	if !found {
+		return time.Time{}
+	}
+	return state.ejectedUntil
+}
+
+// GetEjectCount 获取dst连续被摘除的次数，可用于观察频繁波动的dst
+func (od *OutlierDetector) GetEjectCount(dstClientConf socket.IClientConf) int {
+	od.mut.RLock()
+	defer od.mut.RUnlock()
+	state, found := od.states[dstClientConf]
+	if !found {
+		return 0
+	}
+	return state.ejectCount
+}
+
+// GetEjectionEvents 获取最近的摘除事件，按时间先后排序
+func (od *OutlierDetector) GetEjectionEvents() []*EjectionEvent {
+	od.mut.RLock()
+	defer od.mut.RUnlock()
+	events := make([]*EjectionEvent, len(od.events))
+	copy(events, od.events)
+	return events
+}
@@ -5,16 +5,46 @@
 package agent
 
 import (
+	"fmt"
 	"github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/common"
 	logx "github.com/slive/gsfly/logger"
 	"github.com/slive/gsfly/socket"
 	"github.com/emirpasic/gods/maps/hashmap"
+	"time"
 )
 
 type IProxy interface {
 	IUpstream
+
+	// GetLoadBalance 获取负载均衡实例
+	GetLoadBalance() ILoadBalance
+
+	// GetEffectiveWeight 获取dst的有效权重，慢启动期间小于配置的权重
+	GetEffectiveWeight(dstClientConf socket.IClientConf) float64
+
+	// GetOutlierDetector 获取被动异常检测，未启用则为nil
+	GetOutlierDetector() *OutlierDetector
+
+	// GetUpstreamBreaker 获取upstream整体的熔断器，未启用则为nil
+	GetUpstreamBreaker() *CircuitBreaker
+
+	// GetDstBreaker 获取dst的熔断器，未启用则为nil
+	GetDstBreaker(dstClientConf socket.IClientConf) *CircuitBreaker
+
+	// GetDstSnapshot 获取dst当前的健康和负载快照
+	GetDstSnapshot(dstClientConf socket.IClientConf) *DstSnapshot
+
+	// SelectDstClientConf 经过负载均衡选择一个可用的dst，但不建立channelpeer，如流量镜像使用
+	SelectDstClientConf(agentCh channel.IChannel, params map[string]interface{}) socket.IClientConf
 }
 
+// 慢启动时，有效权重最小为配置权重的比例
+const slow_start_min_factor = 0.05
+
+// 没有可用的dst的错误码，如dst都不可用或者负载均衡未选出dst
+const ERR_NO_AVAILABLE_DST = "ERR_NO_AVAILABLE_DST"
+
 // Proxy 通用的代理一对一代理方式，即agent端和dst端是一对一关系
 type Proxy struct {
 	Upstream
@@ -24,47 +54,248 @@ type Proxy struct {
 
 	// 记录agent代理端和dst端channelId映射关系
 	agentMapperDstCh *hashmap.Map
+
+	// 负载均衡，每个proxy一个实例
+	loadBalance ILoadBalance
+
+	// 会话亲和表，未配置affinityKey则为nil
+	affinityTable *AffinityTable
+
+	// 主动健康检查，未配置则为nil
+	healthChecker *HealthChecker
+
+	// 被动异常检测，未配置则为nil
+	outlierDetector *OutlierDetector
+
+	// upstream整体的熔断器，未配置则为nil
+	upstreamBreaker *CircuitBreaker
+
+	// 每个dst的熔断器，dstClientConf作为主键，未配置则为nil
+	dstBreakers map[socket.IClientConf]*CircuitBreaker
+
+	// 每个dst的空闲连接池，dstClientConf作为主键，未配置则为nil
+	dstPools map[socket.IClientConf]*DstPool
 }
 
+const (
+	// 会话亲和的默认有效期
+	default_affinity_ttl = 5 * time.Minute
+
+	// channelpeer中存放会话亲和key的附件key
+	SessionKey_Attach_key = "sessionKey"
+)
+
 func NewProxy(parent interface{}, proxyConf IProxyConf, transfer IExtension) *Proxy {
 	p := &Proxy{}
 	p.Upstream = *NewUpstream(parent, proxyConf, transfer)
 	p.ProxyConf = proxyConf
 	p.agentMapperDstCh = hashmap.New()
+
+	// 按名称创建负载均衡
+	lbName := proxyConf.GetLoadBalanceName()
+	loadBalance := CreateLoadBalance(lbName, p)
+	if loadBalance == nil {
+		errMsg := "loadBalance is invalid, name:" + lbName
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	loadBalance.UpdateTargets(proxyConf.GetDstClientConfs())
+	p.loadBalance = loadBalance
+	for _, dstClientConf := range proxyConf.GetDstClientConfs() {
+		// 初始化统计，记录新增的时间
+		p.GetDstStatis(dstClientConf)
+	}
+
+	if len(proxyConf.GetAffinityKey()) > 0 {
+		ttl := proxyConf.GetAffinityTtl()
+		if ttl <= 0 {
+			ttl = default_affinity_ttl
+		}
+		p.affinityTable = NewAffinityTable(ttl)
+	}
+
+	healthCheckConf := proxyConf.GetHealthCheckConf()
+	if healthCheckConf != nil {
+		p.healthChecker = NewHealthChecker(p, healthCheckConf, proxyConf.GetDstClientConfs())
+	}
+
+	outlierConf := proxyConf.GetOutlierConf()
+	if outlierConf != nil {
+		p.outlierDetector = NewOutlierDetector(proxyConf.GetId(), outlierConf)
+	}
+
+	breakerConf := proxyConf.GetBreakerConf()
+	if breakerConf != nil {
+		p.upstreamBreaker = NewCircuitBreaker(proxyConf.GetId(), breakerConf)
+		p.dstBreakers = make(map[socket.IClientConf]*CircuitBreaker, len(proxyConf.GetDstClientConfs()))
+		for _, dstClientConf := range proxyConf.GetDstClientConfs() {
+			name := proxyConf.GetId() + "/" + dstClientConf.GetAddrStr()
+			p.dstBreakers[dstClientConf] = NewCircuitBreaker(name, breakerConf)
+		}
+	}
+
+	poolConf := proxyConf.GetDstPoolConf()
+	if poolConf != nil {
+		p.dstPools = make(map[socket.IClientConf]*DstPool, len(proxyConf.GetDstClientConfs()))
+		for _, dstClientConf := range proxyConf.GetDstClientConfs() {
+			p.dstPools[dstClientConf] = NewDstPool(dstClientConf, poolConf, p.dialPoolConn, p.IsDstHealthy)
+		}
+	}
 	return p
 }
 
-func (proxy *Proxy) InitChannelPeer(agentCtx channel.IChHandleContext, params map[string]interface{}) {
-	lbsCtx := NewLoadBalanceContext(nil, proxy, agentCtx.GetChannel())
-	lbhandle := localBalanceHandles[proxy.ProxyConf.GetLoadBalanceType()]
-	// TODO 负载均衡策略
-	lbhandle(lbsCtx)
-	dstClientConf := lbsCtx.Result
-
-	// 3、代理到目标
-	var dstCh channel.IChannel
-	logx.Info("select params:", params)
+func (proxy *Proxy) GetUpstreamBreaker() *CircuitBreaker {
+	return proxy.upstreamBreaker
+}
 
-	// 初始化DstClientConn
-	handle := channel.NewDefChHandle(proxy.onDstChannelReadHandle)
-	handle.SetOnConnect(proxy.onDstChannelActiveHandle)
-	handle.SetOnRelease(proxy.onDstChannelInActiveHandle)
-	clientConn := socket.NewClientSocket(proxy, dstClientConf, handle, params)
-	err := clientConn.Dial()
+func (proxy *Proxy) GetDstBreaker(dstClientConf socket.IClientConf) *CircuitBreaker {
+	return proxy.dstBreakers[dstClientConf]
+}
+
+func (proxy *Proxy) GetOutlierDetector() *OutlierDetector {
+	return proxy.outlierDetector
+}
+
+// IsDstHealthy dst端是否健康，被动异常检测摘除中的视为不健康
+func (proxy *Proxy) IsDstHealthy(dstClientConf socket.IClientConf) bool {
+	if proxy.outlierDetector != nil && proxy.outlierDetector.IsEjected(dstClientConf) {
+		return false
+	}
+	return proxy.Upstream.IsDstHealthy(dstClientConf)
+}
+
+// Start 启动主动健康检查和空闲连接池
+func (proxy *Proxy) Start() error {
+	if proxy.healthChecker != nil {
+		proxy.healthChecker.Start()
+	}
+	for _, pool := range proxy.dstPools {
+		pool.Start()
+	}
+	return nil
+}
+
+// Stop 停止主动健康检查和空闲连接池
+func (proxy *Proxy) Stop() {
+	if proxy.healthChecker != nil {
+		proxy.healthChecker.Stop()
+	}
+	for _, pool := range proxy.dstPools {
+		pool.Stop()
+	}
+}
+
+// GetDstPool 获取dst的空闲连接池，未配置则为nil
+func (proxy *Proxy) GetDstPool(dstClientConf socket.IClientConf) *DstPool {
+	return proxy.dstPools[dstClientConf]
+}
+
+func (proxy *Proxy) GetLoadBalance() ILoadBalance {
+	return proxy.loadBalance
+}
+
+func (proxy *Proxy) InitChannelPeer(agentCtx channel.IChHandleContext, params map[string]interface{}) {
+	// upstream整体熔断时直接拒绝，不再拨号
+	if proxy.upstreamBreaker != nil && !proxy.upstreamBreaker.CanPass() {
+		proxy.rejectBreakerOpen(agentCtx, fmt.Sprintf("upstream circuit breaker is open, upstreamId:%v", proxy.GetConf().GetId()))
+		return
+	}
 	agentCh := agentCtx.GetChannel()
 	agentChId := agentCh.GetId()
-	if err != nil {
+	logx.Info("select params:", params)
+	sessionKey := getSessionKey(proxy.GetExtension(), agentCtx, proxy, params)
+
+	attempts := default_retry_attempts
+	excludeTried := false
+	var dialTimeout time.Duration
+	retryConf := proxy.ProxyConf.GetRetryConf()
+	if retryConf != nil {
+		attempts = retryConf.Attempts
+		excludeTried = retryConf.ExcludeTried
+		dialTimeout = retryConf.Timeout
+	}
+
+	// 拨号失败的dst
+	tried := make(map[socket.IClientConf]bool, attempts)
+	var lbsCtx *LoadBalanceContext
+	var dstClientConf socket.IClientConf
+	var clientConn *socket.ClientSocket
+	var err error
+	rejected := false
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var excludes map[socket.IClientConf]bool
+		if excludeTried {
+			excludes = tried
+		}
+		lbsCtx = proxy.newLoadBalanceContext(agentCh, params)
+		lbsCtx.Targets = proxy.getAvailableTargets(excludes)
+		if len(lbsCtx.Targets) <= 0 {
+			if attempt == 1 && proxy.isAllDstBreakerOpen() {
+				proxy.rejectBreakerOpen(agentCtx, fmt.Sprintf("all dst circuit breakers are open, upstreamId:%v", proxy.GetConf().GetId()))
+				return
+			}
+			logx.Errorf("available dst is empty, agentChId:%v, attempt:%v", agentChId, attempt)
+			break
+		}
+		dstClientConf = proxy.selectDst(lbsCtx, sessionKey, tried)
+		if lbsCtx.Error != nil {
+			// 负载均衡拒绝，不再重试
+			logx.Warnf("reject by loadBalance, agentChId:%v, error:%v", agentChId, lbsCtx.Error)
+			agentCtx.SetError(lbsCtx.Error)
+			return
+		}
+		if dstClientConf == nil {
+			logx.Error("select dstClientConf is nil, agentChId:", agentChId)
+			break
+		}
+
+		// 3、代理到目标
+		err = proxy.allowBreakers(dstClientConf)
+		rejected = (err != nil)
+		if err == nil {
+			clientConn, err = proxy.dialDst(dstClientConf, params, dialTimeout)
+			if err == nil {
+				break
+			}
+		}
+		tried[dstClientConf] = true
+		logx.Warnf("dial dst error, agentChId:%v, dst:%v, attempt:%v/%v, error:%v",
+			agentChId, dstClientConf.GetAddrStr(), attempt, attempts, err)
+	}
+	if err != nil || clientConn == nil {
+		if rejected {
+			proxy.rejectBreakerOpen(agentCtx, err.Error())
+			return
+		}
 		logx.Error("dialws error, agentChId:" + agentChId)
+		if err != nil {
+			// 最后一次拨号的错误，供关闭码映射使用
+			agentCtx.SetError(common.NewError1(channel.ERR_MSG, err))
+		} else {
+			// 未拨号，没有可用的dst或者负载均衡未选出dst
+			agentCtx.SetError(common.NewError2(ERR_NO_AVAILABLE_DST, "no available dst, upstreamId:"+proxy.GetConf().GetId()))
+		}
 		return
 	}
 
 	// 拨号成功，记录
-	dstCh = clientConn.GetChannel()
+	dstCh := clientConn.GetChannel()
 	dstChId := dstCh.GetId()
 	// agentChId和dstChId关系
 	proxy.agentMapperDstCh.Put(agentChId, dstChId)
 	// dstChId作为主键
-	proxy.GetChannelPeers().Put(dstChId, NewChannelPeer(agentCh, dstCh))
+	chPeer := NewChannelPeer(agentCh, dstCh)
+	chPeer.SetDstClientConf(dstClientConf)
+	if len(sessionKey) > 0 && proxy.affinityTable != nil {
+		proxy.affinityTable.Put(sessionKey, dstClientConf)
+		chPeer.AddAttach(SessionKey_Attach_key, sessionKey)
+	}
+	if params != nil {
+		chPeer.AddAttach(Params_Attach_key, params)
+	}
+	proxy.GetChannelPeers().Put(dstChId, chPeer)
+	proxy.GetDstStatis(dstClientConf).IncInflight()
+	proxy.loadBalance.OnConnect(lbsCtx, dstCh)
 
 	// 记录dstchannel到pool中
 	proxy.GetDstChannels().Put(dstChId, dstCh)
@@ -72,6 +303,248 @@ func (proxy *Proxy) InitChannelPeer(agentCtx channel.IChHandleContext, params ma
 	logx.Info("fininsh initChannelPeer, agentChId:{}, dstChId:{}", agentChId, dstChId)
 }
 
+// newLoadBalanceContext 创建负载均衡上下文，包括agserver，location，参数和所有dst的快照
+func (proxy *Proxy) newLoadBalanceContext(agentCh channel.IChannel, params map[string]interface{}) *LoadBalanceContext {
+	agserver, _ := agentCh.GetAttach(AgServer_Attach_key).(IAgServer)
+	lbsCtx := NewLoadBalanceContext(agserver, proxy, agentCh)
+	lbsCtx.Location, _ = agentCh.GetAttach(Location_Attach_key).(ILocationConf)
+	lbsCtx.Params = params
+	targets := proxy.loadBalance.GetTargets()
+	lbsCtx.Snapshots = make(map[socket.IClientConf]*DstSnapshot, len(targets))
+	for _, dstClientConf := range targets {
+		lbsCtx.Snapshots[dstClientConf] = proxy.GetDstSnapshot(dstClientConf)
+	}
+	return lbsCtx
+}
+
+// GetDstSnapshot 获取dst当前的健康和负载快照
+func (proxy *Proxy) GetDstSnapshot(dstClientConf socket.IClientConf) *DstSnapshot {
+	dstStatis := proxy.GetDstStatis(dstClientConf)
+	return &DstSnapshot{
+		DstClientConf:   dstClientConf,
+		Healthy:         proxy.IsDstHealthy(dstClientConf),
+		Available:       proxy.isDstAvailable(dstClientConf),
+		Latency:         dstStatis.GetLatency(),
+		Inflight:        dstStatis.GetInflight(),
+		Load:            dstStatis.GetLoad(),
+		EffectiveWeight: proxy.GetEffectiveWeight(dstClientConf),
+	}
+}
+
+// SelectDstClientConf 经过负载均衡选择一个可用的dst，但不建立channelpeer，如流量镜像使用
+func (proxy *Proxy) SelectDstClientConf(agentCh channel.IChannel, params map[string]interface{}) socket.IClientConf {
+	lbsCtx := proxy.newLoadBalanceContext(agentCh, params)
+	lbsCtx.Targets = proxy.GetAvailableTargets()
+	if len(lbsCtx.Targets) <= 0 {
+		return nil
+	}
+	proxy.loadBalance.Select(lbsCtx)
+	return lbsCtx.Result
+}
+
+// selectDst 选择dst，优先选择会话亲和表中可用且未拨号失败的dst，否则经过负载均衡选择
+func (proxy *Proxy) selectDst(lbsCtx *LoadBalanceContext, sessionKey string, tried map[socket.IClientConf]bool) socket.IClientConf {
+	if len(sessionKey) > 0 && proxy.affinityTable != nil {
+		affinityConf, found := proxy.affinityTable.Get(sessionKey)
+		if found && !tried[affinityConf] && proxy.isDstAvailable(affinityConf) {
+			logx.Info("select dst by affinity, sessionKey:", sessionKey)
+			lbsCtx.Result = affinityConf
+		}
+	}
+	if lbsCtx.Result == nil {
+		proxy.loadBalance.Select(lbsCtx)
+	}
+	return lbsCtx.Result
+}
+
+// dialDst 优先从空闲连接池中取出连接，没有则拨号到dst，并记录拨号结果，
+// 连接池的连接不带agent端的参数，带参数的会话(如ws的query参数)总是直接拨号
+func (proxy *Proxy) dialDst(dstClientConf socket.IClientConf, params map[string]interface{}, timeout time.Duration) (*socket.ClientSocket, error) {
+	pool := proxy.GetDstPool(dstClientConf)
+	if pool != nil && len(params) <= 0 {
+		clientConn := pool.Get()
+		if clientConn != nil {
+			logx.Debug("bind pool conn, dstChId:", clientConn.GetChannel().GetId())
+			proxy.onBreakerResult(dstClientConf, nil)
+			return clientConn, nil
+		}
+	}
+	return proxy.dialNew(dstClientConf, params, timeout)
+}
+
+// dialNew 拨号到dst，并记录拨号结果，拨号panic也记为失败，归还熔断器半打开状态下占用的试探名额
+func (proxy *Proxy) dialNew(dstClientConf socket.IClientConf, params map[string]interface{}, timeout time.Duration) (clientConn *socket.ClientSocket, err error) {
+	dialTime := time.Now()
+	defer func() {
+		ret := recover()
+		if ret == nil {
+			return
+		}
+		err = fmt.Errorf("dial dst panic:%v", ret)
+		logx.Errorf("dial dst error, dst:%v, error:%v", dstClientConf.GetAddrStr(), err)
+		proxy.onDialResult(dstClientConf, time.Since(dialTime), err)
+	}()
+	clientConn = proxy.newClientSocket(dstClientConf, params)
+	err = dialWithTimeout(clientConn, timeout)
+	proxy.onDialResult(dstClientConf, time.Since(dialTime), err)
+	return clientConn, err
+}
+
+// onDialResult 记录拨号耗时和结果，供负载均衡，异常检测和熔断器使用
+func (proxy *Proxy) onDialResult(dstClientConf socket.IClientConf, cost time.Duration, err error) {
+	proxy.GetDstStatis(dstClientConf).OnDial(cost, err)
+	if proxy.outlierDetector != nil {
+		proxy.outlierDetector.OnDial(dstClientConf, err)
+	}
+	proxy.onBreakerResult(dstClientConf, err)
+}
+
+// dialPoolConn 空闲连接池的拨号，不带agent端的参数，同样经过熔断器和拨号超时，避免阻塞连接池的维护
+func (proxy *Proxy) dialPoolConn(dstClientConf socket.IClientConf) (*socket.ClientSocket, error) {
+	err := proxy.allowBreakers(dstClientConf)
+	if err != nil {
+		return nil, err
+	}
+	timeout := default_pool_dial_timeout
+	retryConf := proxy.ProxyConf.GetRetryConf()
+	if retryConf != nil && retryConf.Timeout > 0 {
+		timeout = retryConf.Timeout
+	}
+	return proxy.dialNew(dstClientConf, nil, timeout)
+}
+
+// newClientSocket 创建dst端的客户端
+func (proxy *Proxy) newClientSocket(dstClientConf socket.IClientConf, params map[string]interface{}) *socket.ClientSocket {
+	// 初始化DstClientConn
+	handle := channel.NewDefChHandle(proxy.onDstChannelReadHandle)
+	handle.SetOnConnect(proxy.onDstChannelActiveHandle)
+	handle.SetOnRelease(proxy.onDstChannelInActiveHandle)
+	handle.SetPreWrite(proxy.onDstChannelPreWriteHandle)
+	handle.SetOnError(onChannelErrorHandle)
+	return socket.NewClientSocket(proxy, dstClientConf, handle, params)
+}
+
+// allowBreakers 拨号前由upstream和dst的熔断器放行，半打开状态下会占用试探名额
+func (proxy *Proxy) allowBreakers(dstClientConf socket.IClientConf) error {
+	if proxy.upstreamBreaker == nil {
+		return nil
+	}
+	err := proxy.upstreamBreaker.Allow()
+	if err != nil {
+		return err
+	}
+	dstBreaker := proxy.GetDstBreaker(dstClientConf)
+	if dstBreaker == nil {
+		return nil
+	}
+	err = dstBreaker.Allow()
+	if err != nil {
+		// dst拒绝，未实际拨号，归还upstream的试探名额
+		proxy.upstreamBreaker.Cancel()
+		return err
+	}
+	return nil
+}
+
+// onBreakerResult 记录拨号结果到upstream和dst的熔断器
+func (proxy *Proxy) onBreakerResult(dstClientConf socket.IClientConf, err error) {
+	if proxy.upstreamBreaker == nil {
+		return
+	}
+	proxy.upstreamBreaker.OnResult(err)
+	dstBreaker := proxy.GetDstBreaker(dstClientConf)
+	if dstBreaker != nil {
+		dstBreaker.OnResult(err)
+	}
+}
+
+// isAllDstBreakerOpen 是否所有dst的熔断器都处于拒绝状态
+func (proxy *Proxy) isAllDstBreakerOpen() bool {
+	if len(proxy.dstBreakers) <= 0 {
+		return false
+	}
+	for _, breaker := range proxy.dstBreakers {
+		if breaker.CanPass() {
+			return false
+		}
+	}
+	return true
+}
+
+// rejectBreakerOpen 熔断时立即拒绝新的会话
+func (proxy *Proxy) rejectBreakerOpen(agentCtx channel.IChHandleContext, errMsg string) {
+	logx.Warnf("reject by circuit breaker, agentChId:%v, %v", agentCtx.GetChannel().GetId(), errMsg)
+	agentCtx.SetError(common.NewError2(ERR_BREAKER_OPEN, errMsg))
+}
+
+// GetEffectiveWeight 获取dst的有效权重，新增或者恢复健康的dst在慢启动时长内，
+// 有效权重从配置权重的slow_start_min_factor倍线性增长到配置权重
+func (proxy *Proxy) GetEffectiveWeight(dstClientConf socket.IClientConf) float64 {
+	proxyConf := proxy.ProxyConf
+	weight := float64(proxyConf.GetDstClientAttr(dstClientConf).Weight)
+	slowStart := proxyConf.GetSlowStart()
+	if slowStart <= 0 {
+		return weight
+	}
+	upTime := proxy.GetDstStatis(dstClientConf).GetUpTime()
+	if proxy.outlierDetector != nil {
+		// 摘除结束也视为恢复健康
+		ejectedUntil := proxy.outlierDetector.GetEjectedUntil(dstClientConf)
+		if ejectedUntil.After(upTime) {
+			upTime = ejectedUntil
+		}
+	}
+	elapsed := time.Since(upTime)
+	if elapsed >= slowStart {
+		return weight
+	}
+	factor := float64(elapsed) / float64(slowStart)
+	if factor < slow_start_min_factor {
+		factor = slow_start_min_factor
+	}
+	return weight * factor
+}
+
+// GetAvailableTargets 按优先级分组，返回优先级最高且有可用dst的分组中的可用dst，
+// 可用即健康，未熔断且未达到最大连接数，只有高优先级的都不可用时，才会选用低优先级或者备用的dst
+func (proxy *Proxy) GetAvailableTargets() []socket.IClientConf {
+	return proxy.getAvailableTargets(nil)
+}
+
+// getAvailableTargets 同GetAvailableTargets，excludes中的dst视为不可用，如重试时已拨号失败的dst
+func (proxy *Proxy) getAvailableTargets(excludes map[socket.IClientConf]bool) []socket.IClientConf {
+	proxyConf := proxy.ProxyConf
+	var bestAttr *DstClientAttr
+	var targets []socket.IClientConf
+	for _, dstClientConf := range proxy.loadBalance.GetTargets() {
+		if excludes[dstClientConf] || !proxy.isDstAvailable(dstClientConf) {
+			continue
+		}
+		attr := proxyConf.GetDstClientAttr(dstClientConf)
+		if bestAttr == nil || attr.HigherThan(bestAttr) {
+			bestAttr = attr
+			targets = []socket.IClientConf{dstClientConf}
+		} else if !bestAttr.HigherThan(attr) {
+			// 同一优先级
+			targets = append(targets, dstClientConf)
+		}
+	}
+	return targets
+}
+
+// isDstAvailable dst是否可用，即健康，未熔断且未达到最大连接数
+func (proxy *Proxy) isDstAvailable(dstClientConf socket.IClientConf) bool {
+	if !proxy.IsDstHealthy(dstClientConf) {
+		return false
+	}
+	breaker := proxy.GetDstBreaker(dstClientConf)
+	if breaker != nil && !breaker.CanPass() {
+		return false
+	}
+	maxChannelSize := proxy.ProxyConf.GetDstClientAttr(dstClientConf).MaxChannelSize
+	return maxChannelSize <= 0 || proxy.GetDstStatis(dstClientConf).GetInflight() < int64(maxChannelSize)
+}
+
 // GetChannelPeer 通过UpstreamContext获取到对应的channelpeer
 func (proxy *Proxy) GetChannelPeer(ctx channel.IChHandleContext, isAgent bool) IChannelPeer {
 	var dstChId interface{}
@@ -100,18 +573,48 @@ func (proxy *Proxy) GetChannelPeer(ctx channel.IChHandleContext, isAgent bool) I
 
 // onDstChannelReadHandle upstream的客户端channel收到消息后的处理，直接会写到server对应的客户端channel
 func (proxy *Proxy) onDstChannelReadHandle(dstCtx channel.IChHandleContext) {
+	proxy.statisRtt(dstCtx)
 	proxy.QueryAgentChannel(dstCtx)
 	agentCh := dstCtx.GetRet()
 	if agentCh != nil {
-		proxy.extension.Transfer(dstCtx, agentCh.(channel.IChannel))
+		agentChannel := agentCh.(channel.IChannel)
+		syncAgentWrite(agentChannel, func() {
+			proxy.extension.Transfer(dstCtx, agentChannel)
+		})
 		return
 	}
 	logx.Warn("unknown dst Transfer.")
 }
 
-// onDstChannelActiveHandle 当dstchannel关闭时，触发agentchannel关闭
+// onDstChannelPreWriteHandle 发送到dstchannel前，记录发送时间
+func (proxy *Proxy) onDstChannelPreWriteHandle(dstCtx channel.IChHandleContext) {
+	ret, found := proxy.channelPeers.Get(dstCtx.GetChannel().GetId())
+	if found {
+		chPeer, ok := ret.(*ChannelPeer)
+		if ok {
+			chPeer.markSend()
+		}
+	}
+}
+
+// statisRtt 收到dstchannel消息后，统计消息往返耗时
+func (proxy *Proxy) statisRtt(dstCtx channel.IChHandleContext) {
+	ret, found := proxy.channelPeers.Get(dstCtx.GetChannel().GetId())
+	if found {
+		chPeer, ok := ret.(*ChannelPeer)
+		if !ok {
+			return
+		}
+		rtt, ok := chPeer.takeRtt()
+		if ok && chPeer.GetDstClientConf() != nil {
+			proxy.GetDstStatis(chPeer.GetDstClientConf()).OnRtt(rtt)
+		}
+	}
+}
+
+// onDstChannelActiveHandle 当dstchannel建立时，记录ws的关闭帧
 func (proxy *Proxy) onDstChannelActiveHandle(ctx channel.IChHandleContext) {
-	// TODO
+	watchClose(ctx.GetChannel())
 }
 
 // onDstChannelInActiveHandle 当dstchannel关闭时，触发agentchannel关闭
@@ -132,35 +635,66 @@ func (proxy *Proxy) onDstChannelInActiveHandle(ctx channel.IChHandleContext) {
 // 因为和dst端channel是一对一对应关系，所以需要释放dst端的channel记录和资源
 func (proxy *Proxy) ReleaseOnAgentChannel(agentCtx channel.IChHandleContext) {
 	agentChId := agentCtx.GetChannel().GetId()
-	dstCh, found := proxy.agentMapperDstCh.Get(agentChId)
+	dstChId, found := proxy.agentMapperDstCh.Get(agentChId)
 	logx.Infof("dstCh found:%v, agentChId:%v", found, agentChId)
 	if found {
 		// 清除dstchannel相关记录
 		proxy.agentMapperDstCh.Remove(agentChId)
-		chPeer, ok := dstCh.(IChannelPeer)
-		if ok {
-			dstChannel := chPeer.GetDstChannel()
-			dstChId := dstChannel.GetId()
+		chPeer := proxy.removeChannelPeer(dstChId)
+		if chPeer != nil {
 			proxy.GetDstChannels().Remove(dstChId)
-			// 释放dstchannel资源
-			dstChannel.Release()
-			dstChannel.GetParent()
+			// 按agent端的关闭信息释放dstchannel资源
+			closePeer(proxy.GetExtension(), agentCtx.GetChannel(), chPeer.GetDstChannel())
 		}
 	}
 }
 
 // ReleaseOnDstChannel 当dst端channel释放资源后调用该方法，清除dst端相关的channel的记录
-// 因为和agent端channel是一对一对应关系，所以需要释放agent端的channel记录和资源
+// 因为和agent端channel是一对一对应关系，所以需要释放agent端的channel记录和资源，配置了重连则重连到其他dst
 func (proxy *Proxy) ReleaseOnDstChannel(dstCtx channel.IChHandleContext) {
 	dstChId := dstCtx.GetChannel().GetId()
-	chPeer, found := proxy.channelPeers.Get(dstChId)
-	logx.Infof("agentch found:%v, dstChId:%v", found, dstChId)
-	if found {
-		proxy.GetChannelPeers().Remove(dstChId)
+	chPeer := proxy.removeChannelPeer(dstChId)
+	logx.Infof("agentch found:%v, dstChId:%v", chPeer != nil, dstChId)
+	if chPeer != nil {
 		proxy.GetDstChannels().Remove(dstChId)
-		agentCh := chPeer.(IChannelPeer).GetAgentChannel()
-		agentCh.Release()
+		dstClientConf := chPeer.GetDstClientConf()
+		if proxy.outlierDetector != nil && dstClientConf != nil {
+			// dst端主动关闭，建立后很快关闭的视为异常
+			proxy.outlierDetector.OnDstRelease(dstClientConf, time.Since(chPeer.GetCreateTime()))
+		}
+		agentCh := chPeer.GetAgentChannel()
+		if proxy.ProxyConf.GetReconnectConf() != nil && !agentCh.IsClosed() {
+			// 保持agentChannel，重连到其他dst
+			params, _ := chPeer.GetAttach(Params_Attach_key).(map[string]interface{})
+			logx.Info("start to reconnect, agentChId:", agentCh.GetId())
+			proxy.reconnect(agentCh, params)
+			return
+		}
+		// 按dst端的关闭信息释放agentChannel
+		closePeer(proxy.GetExtension(), dstCtx.GetChannel(), agentCh)
+	}
+}
+
+// removeChannelPeer 移除channelpeer，同时更新dst端的会话数统计
+func (proxy *Proxy) removeChannelPeer(dstChId interface{}) IChannelPeer {
+	ret, found := proxy.channelPeers.Get(dstChId)
+	if !found {
+		return nil
+	}
+	proxy.channelPeers.Remove(dstChId)
+	chPeer := ret.(IChannelPeer)
+	dstClientConf := chPeer.GetDstClientConf()
+	if dstClientConf != nil {
+		proxy.GetDstStatis(dstClientConf).DecInflight()
+		proxy.loadBalance.OnRelease(dstClientConf, chPeer.GetDstChannel())
+	}
+
+	// 会话释放后，从释放时开始计算会话亲和的有效期
+	sessionKey := chPeer.GetAttach(SessionKey_Attach_key)
+	if sessionKey != nil && proxy.affinityTable != nil {
+		proxy.affinityTable.Touch(sessionKey.(string))
 	}
+	return chPeer
 }
 
 func (proxy *Proxy) QueryDstChannel(ctx channel.IChHandleContext) {
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/slive/gsfly/channel"
+)
+
+// nilLoadBalance 不选择任何dst
+type nilLoadBalance struct {
+	LoadBalance
+}
+
+func (lb *nilLoadBalance) Select(bcontext *LoadBalanceContext) {
+}
+
+func TestProxyInitChannelPeerNoAvailableDst(t *testing.T) {
+	RegisterLoadBalance("test_nil", func(upstream IUpstream) ILoadBalance {
+		return &nilLoadBalance{LoadBalance: *NewLoadBalance("test_nil", upstream)}
+	})
+	tests := []struct {
+		name   string
+		lbName string
+		setup  func(proxy *Proxy)
+	}{
+		{"all dst unhealthy", "default", func(proxy *Proxy) {
+			for _, conf := range proxy.ProxyConf.GetDstClientConfs() {
+				proxy.GetDstStatis(conf).SetHealthy(false)
+			}
+		}},
+		{"loadBalance selects nil", "test_nil", func(proxy *Proxy) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, _ := newTestProxy(t, tt.lbName, 2)
+			tt.setup(proxy)
+			agentCtx := channel.NewChHandleContext(channel.NewSimpleChannel(func(ctx channel.IChHandleContext) {}), nil)
+			proxy.InitChannelPeer(agentCtx, nil)
+			if agentCtx.GetRet() != nil {
+				t.Fatalf("InitChannelPeer() ret = %v, want nil", agentCtx.GetRet())
+			}
+			gerr := agentCtx.GetError()
+			if gerr == nil || gerr.GetErrCode() != ERR_NO_AVAILABLE_DST {
+				t.Fatalf("InitChannelPeer() error = %v, want %v", gerr, ERR_NO_AVAILABLE_DST)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * dst端断开后重连，agentChannel保持不关闭，重新经过负载均衡选择dst并拨号，
+ * 重连期间agent端的消息按序缓存，重连成功后按序发送
+ * Author:slive
+ * DATE:2021/4/22
+ */
+package agent
+
+import (
+	"github.com/slive/gsfly/channel"
+	logx "github.com/slive/gsfly/logger"
+	"time"
+)
+
+const (
+	default_reconnect_attempts    = 3
+	default_reconnect_interval    = time.Second
+	default_reconnect_buffer_size = 64
+
+	// channelpeer中存放agent端参数的附件key，重连时使用
+	Params_Attach_key = "params"
+)
+
+// ReconnectConf dst端断开后的重连配置
+type ReconnectConf struct {
+	// 最多重连次数
+	Attempts int
+
+	// 每次重连失败后的等待时间
+	Interval time.Duration
+
+	// 重连期间最多缓存的消息数，超过则关闭agentChannel
+	BufferSize int
+}
+
+// NewReconnectConf 创建重连配置，参数<=0则取默认值
+func NewReconnectConf(attempts int, interval time.Duration, bufferSize int) *ReconnectConf {
+	if attempts <= 0 {
+		attempts = default_reconnect_attempts
+	}
+	if interval <= 0 {
+		interval = default_reconnect_interval
+	}
+	if bufferSize <= 0 {
+		bufferSize = default_reconnect_buffer_size
+	}
+	return &ReconnectConf{
+		Attempts:   attempts,
+		Interval:   interval,
+		BufferSize: bufferSize,
+	}
+}
+
+// reconnect 异步重连，重新建立channelpeer，成功后调用IExtension.AfterDstReconnect，再按序发送缓存的消息，
+// 重连失败则关闭agentChannel
+func (proxy *Proxy) reconnect(agentCh channel.IChannel, params map[string]interface{}) {
+	conf := proxy.ProxyConf.GetReconnectConf()
+	session := newPendingSession(NewAsyncDialConf(conf.BufferSize, 0), agentCh)
+	agentCh.AddAttach(PendingSession_Attach_key, session)
+	agentChId := agentCh.GetId()
+	go func() {
+		defer func() {
+			ret := recover()
+			if ret != nil {
+				logx.Error("reconnect error:", ret)
+				if session.fail() {
+					agentCh.Release()
+				}
+			}
+		}()
+		for attempt := 1; attempt <= conf.Attempts; attempt++ {
+			if agentCh.IsClosed() {
+				session.fail()
+				return
+			}
+			ctx := channel.NewChHandleContext(agentCh, nil)
+			proxy.InitChannelPeer(ctx, params)
+			dstCh, ok := ctx.GetRet().(channel.IChannel)
+			if ok {
+				logx.Infof("reconnect success, agentChId:%v, dstChId:%v, attempt:%v", agentChId, dstCh.GetId(), attempt)
+				// 先由应用发送重新同步的消息，再发送缓存的消息
+				afterDstReconnect(proxy.GetExtension(), ctx, proxy, dstCh)
+				ags, bound := agentCh.GetAttach(AgServer_Attach_key).(*AgServer)
+				bound = bound && agentCh.GetAttach(Bindings_Attach_key) != nil
+				ready := session.ready(func(packet channel.IPacket) {
+					packetCtx := channel.NewChHandleContext(agentCh, packet)
+					if bound {
+						// 绑定了多个upstream，重连期间缓存的消息重新按选择器分发
+						ags.transferAgentMsg(packetCtx)
+						return
+					}
+					proxy.GetExtension().Transfer(packetCtx, dstCh)
+				})
+				if !ready || agentCh.IsClosed() {
+					proxy.ReleaseOnAgentChannel(ctx)
+				}
+				return
+			}
+			logx.Warnf("reconnect failed, agentChId:%v, attempt:%v/%v", agentChId, attempt, conf.Attempts)
+			if attempt < conf.Attempts {
+				time.Sleep(conf.Interval)
+			}
+		}
+		if session.fail() {
+			logx.Error("reconnect exhausted, release agentChId:", agentChId)
+			agentCh.Release()
+		}
+	}()
+}
@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/socket"
+)
+
+// testDst 本地tcp的dst端，记录已接受的连接，可整体关闭
+type testDst struct {
+	listener net.Listener
+	conns    []net.Conn
+	mut      sync.Mutex
+}
+
+func newTestDst(t *testing.T) *testDst {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	dst := &testDst{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			dst.mut.Lock()
+			dst.conns = append(dst.conns, conn)
+			dst.mut.Unlock()
+		}
+	}()
+	return dst
+}
+
+func (dst *testDst) clientConf() socket.IClientConf {
+	return socket.NewTcpClientConf("127.0.0.1", getPort(dst.listener.Addr()))
+}
+
+// close 停止监听并断开所有连接，之后拨号会被拒绝
+func (dst *testDst) close() {
+	dst.listener.Close()
+	dst.mut.Lock()
+	defer dst.mut.Unlock()
+	for _, conn := range dst.conns {
+		conn.Close()
+	}
+}
+
+// reconnectExtension 通知重连成功的dstChannel
+type reconnectExtension struct {
+	Extension
+	reconnected chan channel.IChannel
+}
+
+func (e *reconnectExtension) AfterDstReconnect(agentCtx channel.IChHandleContext, upstream IUpstream, dstChannel channel.IChannel) {
+	e.reconnected <- dstChannel
+}
+
+func newReconnectProxy(extension IExtension, dsts ...*testDst) *Proxy {
+	dstClientConfs := make([]socket.IClientConf, len(dsts))
+	for i, dst := range dsts {
+		dstClientConfs[i] = dst.clientConf()
+	}
+	conf := NewProxyConf("test", LOADBALANCE_DEFAULT, dstClientConfs...)
+	conf.ReconnectConf = NewReconnectConf(2, 10*time.Millisecond, 8)
+	conf.RetryConf = NewRetryConf(len(dsts), time.Second, true)
+	return NewProxy(nil, conf, extension)
+}
+
+func getPort(addr net.Addr) int {
+	return addr.(*net.TCPAddr).Port
+}
+
+func TestProxyReconnectToAnotherDst(t *testing.T) {
+	dsts := []*testDst{newTestDst(t), newTestDst(t)}
+	defer dsts[0].close()
+	defer dsts[1].close()
+	extension := &reconnectExtension{Extension: *NewExtension(), reconnected: make(chan channel.IChannel, 1)}
+	proxy := newReconnectProxy(extension, dsts...)
+	agentCh := newTestOpenChannel()
+	agentCtx := channel.NewChHandleContext(agentCh, nil)
+	proxy.InitChannelPeer(agentCtx, nil)
+	dstCh, ok := agentCtx.GetRet().(channel.IChannel)
+	if !ok {
+		t.Fatal("InitChannelPeer() did not connect")
+	}
+
+	// 断开并关闭当前的dst，重连时拨号被拒绝，应重连到另一个dst
+	firstPort := getPort(dstCh.RemoteAddr())
+	for _, dst := range dsts {
+		if getPort(dst.listener.Addr()) == firstPort {
+			dst.close()
+		}
+	}
+	select {
+	case dstCh = <-extension.reconnected:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for reconnect")
+	}
+	if getPort(dstCh.RemoteAddr()) == firstPort {
+		t.Fatalf("reconnected to the closed dst, port:%v", firstPort)
+	}
+	if agentCh.getReleased() != 0 {
+		t.Fatal("agentChannel released after reconnect succeeded")
+	}
+}
+
+func TestProxyReconnectExhausted(t *testing.T) {
+	dst := newTestDst(t)
+	extension := &reconnectExtension{Extension: *NewExtension(), reconnected: make(chan channel.IChannel, 1)}
+	proxy := newReconnectProxy(extension, dst)
+	agentCh := newTestOpenChannel()
+	agentCtx := channel.NewChHandleContext(agentCh, nil)
+	proxy.InitChannelPeer(agentCtx, nil)
+	if agentCtx.GetRet() == nil {
+		t.Fatal("InitChannelPeer() did not connect")
+	}
+
+	// 唯一的dst不可用，重连次数用完后释放agentChannel
+	dst.close()
+	deadline := time.Now().Add(3 * time.Second)
+	for agentCh.getReleased() <= 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for agentChannel release")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-extension.reconnected:
+		t.Fatal("reconnected to the closed dst")
+	default:
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * 拨号失败后的重试，每次重试重新经过负载均衡选择dst
+ * Author:slive
+ * DATE:2021/4/16
+ */
+package agent
+
+import (
+	"errors"
+	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
+	"time"
+)
+
+const default_retry_attempts = 1
+
+// RetryConf 拨号重试配置
+type RetryConf struct {
+	// 最多拨号次数，包括第一次拨号，1则不重试
+	Attempts int
+
+	// 每次拨号的超时时间，<=0则不限制
+	Timeout time.Duration
+
+	// 重试时是否排除已经拨号失败的dst
+	ExcludeTried bool
+}
+
+// NewRetryConf 创建拨号重试配置，attempts<=0则取默认值
+func NewRetryConf(attempts int, timeout time.Duration, excludeTried bool) *RetryConf {
+	if attempts <= 0 {
+		attempts = default_retry_attempts
+	}
+	return &RetryConf{
+		Attempts:     attempts,
+		Timeout:      timeout,
+		ExcludeTried: excludeTried,
+	}
+}
+
+// dialWithTimeout 带超时的拨号，超时后拨号仍成功的，则释放对应的channel
+func dialWithTimeout(clientConn *socket.ClientSocket, timeout time.Duration) error {
+	if timeout <= 0 {
+		return clientConn.Dial()
+	}
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			ret := recover()
+			if ret != nil {
+				logx.Error("dial error:", ret)
+				result <- errors.New("dial panic")
+			}
+		}()
+		result <- clientConn.Dial()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		go func() {
+			err := <-result
+			dstCh := clientConn.GetChannel()
+			if err == nil && dstCh != nil {
+				logx.Warn("release dstchannel after dial timeout, dstChId:", dstCh.GetId())
+				dstCh.Release()
+			}
+		}()
+		return errors.New("dial timeout, dst:" + clientConn.GetConf().GetAddrStr())
+	}
+}
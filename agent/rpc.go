@@ -0,0 +1,727 @@
+/*
+ * 请求/响应关联方式的upstream，适用于RPC方式的消息，按请求进行负载均衡：
+ *  1、agent端的每个请求按请求id(json字段或者二进制头)跟踪，替换为upstream内唯一的id后发送到任意健康的dst端
+ *  2、dst端的响应按id找回原请求，恢复原请求id后写回对应的agentChannel
+ *  3、超时未响应，或者dst端断开的请求，合成错误响应写回agentChannel
+ * Author:slive
+ * DATE:2021/4/25
+ */
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/channel/tcpx"
+	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RPC_ID_JSON 请求id为json字段
+	RPC_ID_JSON = "json"
+	// RPC_ID_BINARY 请求id为二进制头中的固定字节
+	RPC_ID_BINARY = "binary"
+
+	default_rpc_pool_size = 1
+	default_rpc_id_field  = "id"
+	default_rpc_id_length = 4
+	default_rpc_timeout   = 10 * time.Second
+
+	// 补充dst长连接的间隔
+	rpc_maintain_interval = time.Second
+)
+
+const (
+	// ERR_RPC_TIMEOUT 请求超时未响应
+	ERR_RPC_TIMEOUT = "ERR_RPC_TIMEOUT"
+	// ERR_RPC_UNAVAILABLE 没有可用的dst端
+	ERR_RPC_UNAVAILABLE = "ERR_RPC_UNAVAILABLE"
+	// ERR_RPC_DST_CLOSED 请求发送后dst端断开
+	ERR_RPC_DST_CLOSED = "ERR_RPC_DST_CLOSED"
+)
+
+type IRpcConf interface {
+	IUpstreamConf
+
+	// GetDstClientConfs dst客户端配置列表
+	GetDstClientConfs() []socket.IClientConf
+
+	// GetPoolSize 每个dstclient的长连接数
+	GetPoolSize() int
+
+	// GetIdType 请求id的类型，RPC_ID_JSON或者RPC_ID_BINARY
+	GetIdType() string
+
+	// GetIdField json方式的请求id字段名
+	GetIdField() string
+
+	// GetIdOffset 二进制方式的请求id在消息中的偏移
+	GetIdOffset() int
+
+	// GetIdLength 二进制方式的请求id的字节数，1-8
+	GetIdLength() int
+
+	// GetTimeout 请求的超时时间
+	GetTimeout() time.Duration
+}
+
+// RpcConf 请求/响应关联方式的upstream配置
+type RpcConf struct {
+	UpstreamConf
+
+	DstClientConfs []socket.IClientConf
+
+	// 每个dstclient的长连接数
+	PoolSize int
+
+	// 请求id的类型
+	IdType string
+
+	// json方式的请求id字段名
+	IdField string
+
+	// 二进制方式的请求id偏移
+	IdOffset int
+
+	// 二进制方式的请求id字节数
+	IdLength int
+
+	// 请求的超时时间
+	Timeout time.Duration
+}
+
+// NewRpcConf 创建请求/响应关联方式的upstream配置，其他参数取默认值，可再设置
+// id upstreamId
+// idType 请求id的类型，为空则为RPC_ID_JSON
+// dstClientConfs dst客户端配置列表
+func NewRpcConf(id string, idType string, dstClientConfs ...socket.IClientConf) *RpcConf {
+	if len(dstClientConfs) <= 0 {
+		errMsg := "dstClientConfs are nil"
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	if len(idType) <= 0 {
+		idType = RPC_ID_JSON
+	}
+	if idType != RPC_ID_JSON && idType != RPC_ID_BINARY {
+		errMsg := "rpc id type is invalid:" + idType
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	r := &RpcConf{
+		DstClientConfs: dstClientConfs,
+		PoolSize:       default_rpc_pool_size,
+		IdType:         idType,
+		IdField:        default_rpc_id_field,
+		IdLength:       default_rpc_id_length,
+		Timeout:        default_rpc_timeout,
+	}
+	r.UpstreamConf = *NewUpstreamConf(id, UPSTREAM_RPC)
+	return r
+}
+
+func (rc *RpcConf) GetDstClientConfs() []socket.IClientConf {
+	return rc.DstClientConfs
+}
+
+func (rc *RpcConf) GetPoolSize() int {
+	if rc.PoolSize <= 0 {
+		return default_rpc_pool_size
+	}
+	return rc.PoolSize
+}
+
+func (rc *RpcConf) GetIdType() string {
+	return rc.IdType
+}
+
+func (rc *RpcConf) GetIdField() string {
+	if len(rc.IdField) <= 0 {
+		return default_rpc_id_field
+	}
+	return rc.IdField
+}
+
+func (rc *RpcConf) GetIdOffset() int {
+	return rc.IdOffset
+}
+
+func (rc *RpcConf) GetIdLength() int {
+	if rc.IdLength <= 0 || rc.IdLength > 8 {
+		return default_rpc_id_length
+	}
+	return rc.IdLength
+}
+
+func (rc *RpcConf) GetTimeout() time.Duration {
+	if rc.Timeout <= 0 {
+		return default_rpc_timeout
+	}
+	return rc.Timeout
+}
+
+// RpcErrorBuilder 合成错误响应，originId为agent端原请求id(json方式为原始json值，二进制方式为原始字节)
+type RpcErrorBuilder func(conf IRpcConf, originId []byte, errCode string, reason string) []byte
+
+// DefRpcErrorBuilder 默认的错误响应：
+// json方式为{"<idField>":<originId>,"error":{"code":"<errCode>","message":"<reason>"}}；
+// 二进制方式为原请求id所在的头(其他字节为0)加上"<errCode>:<reason>"
+func DefRpcErrorBuilder(conf IRpcConf, originId []byte, errCode string, reason string) []byte {
+	if conf.GetIdType() == RPC_ID_BINARY {
+		header := make([]byte, conf.GetIdOffset()+conf.GetIdLength())
+		copy(header[conf.GetIdOffset():], originId)
+		return append(header, []byte(errCode+":"+reason)...)
+	}
+	msg := map[string]interface{}{
+		conf.GetIdField(): json.RawMessage(originId),
+		"error": map[string]string{
+			"code":    errCode,
+			"message": reason,
+		},
+	}
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// rpcConn dst端长连接
+type rpcConn struct {
+	dstClientConf socket.IClientConf
+
+	dstChannel channel.IChannel
+
+	// 未响应的请求数
+	inflight int64
+
+	// 多个agent端的请求共用长连接，写需串行
+	writeMut sync.Mutex
+}
+
+// rpcRequest 未响应的请求
+type rpcRequest struct {
+	// upstream内唯一的请求id
+	seq uint64
+
+	// agent端原请求id
+	originId []byte
+
+	session *rpcSession
+
+	conn *rpcConn
+
+	// agent端ws消息类型，响应按此类型写回
+	msgType int
+
+	sendTime time.Time
+
+	timer *time.Timer
+}
+
+// rpcSession agentChannel对应的会话，记录该会话未响应的请求
+type rpcSession struct {
+	agentChannel channel.IChannel
+
+	requests map[uint64]*rpcRequest
+}
+
+// Rpc 请求/响应关联方式的upstream
+type Rpc struct {
+	Upstream
+
+	RpcConf IRpcConf
+
+	// 合成错误响应，默认为DefRpcErrorBuilder，可替换
+	ErrorBuilder RpcErrorBuilder
+
+	conns []*rpcConn
+
+	connMut sync.RWMutex
+
+	// 请求id生成，在reqMut内使用
+	seq uint64
+
+	// agentChId作为主键
+	sessions map[string]*rpcSession
+
+	// 未响应的请求，seq作为主键
+	requests map[uint64]*rpcRequest
+
+	// sessions和requests共用
+	reqMut sync.Mutex
+
+	exit chan bool
+
+	startOnce sync.Once
+
+	stopOnce sync.Once
+}
+
+func NewRpc(parent interface{}, rpcConf IRpcConf, extension IExtension) *Rpc {
+	r := &Rpc{
+		RpcConf:      rpcConf,
+		ErrorBuilder: DefRpcErrorBuilder,
+		sessions:     make(map[string]*rpcSession),
+		requests:     make(map[uint64]*rpcRequest),
+		exit:         make(chan bool),
+	}
+	r.Upstream = *NewUpstream(parent, rpcConf, extension)
+	return r
+}
+
+// Start 预先建立长连接，并在后台补充断开的长连接
+func (r *Rpc) Start() error {
+	r.startOnce.Do(func() {
+		r.maintain()
+		go r.loop()
+	})
+	return nil
+}
+
+// Stop 停止后台补充长连接
+func (r *Rpc) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.exit)
+	})
+}
+
+func (r *Rpc) loop() {
+	defer func() {
+		ret := recover()
+		if ret != nil {
+			logx.Error("rpc maintain error:", ret)
+		}
+	}()
+	ticker := time.NewTicker(rpc_maintain_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.exit:
+			return
+		case <-ticker.C:
+			r.maintain()
+		}
+	}
+}
+
+// maintain 每个dstclient补充到PoolSize个长连接，拨号结果作为dst端的健康状态
+func (r *Rpc) maintain() {
+	for _, dstClientConf := range r.RpcConf.GetDstClientConfs() {
+		need := r.RpcConf.GetPoolSize() - r.countConns(dstClientConf)
+		for i := 0; i < need; i++ {
+			_, err := r.dial(dstClientConf)
+			r.GetDstStatis(dstClientConf).SetHealthy(err == nil)
+			if err != nil {
+				logx.Warnf("dial rpc dst error, dst:%v, error:%v", dstClientConf.GetAddrStr(), err)
+				break
+			}
+		}
+	}
+}
+
+func (r *Rpc) countConns(dstClientConf socket.IClientConf) int {
+	r.connMut.RLock()
+	defer r.connMut.RUnlock()
+	count := 0
+	for _, conn := range r.conns {
+		if conn.dstClientConf == dstClientConf && !conn.dstChannel.IsClosed() {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Rpc) dial(dstClientConf socket.IClientConf) (*rpcConn, error) {
+	handle := channel.NewDefChHandle(r.onDstChannelReadHandle)
+	handle.SetOnConnect(onChannelConnectHandle)
+	handle.SetOnRelease(r.onDstChannelInActiveHandle)
+	handle.SetOnError(onChannelErrorHandle)
+	clientConn := socket.NewClientSocket(r, dstClientConf, handle, nil)
+	err := clientConn.Dial()
+	if err != nil {
+		return nil, err
+	}
+	dstCh := clientConn.GetChannel()
+	conn := &rpcConn{
+		dstClientConf: dstClientConf,
+		dstChannel:    dstCh,
+	}
+	r.connMut.Lock()
+	r.conns = append(r.conns, conn)
+	r.connMut.Unlock()
+	r.GetDstChannels().Put(dstCh.GetId(), dstCh)
+	logx.Info("open rpc conn, dstChId:", dstCh.GetId())
+	return conn, nil
+}
+
+// selectConn 选择健康的dst端中未响应请求数最少的长连接
+func (r *Rpc) selectConn() *rpcConn {
+	r.connMut.RLock()
+	defer r.connMut.RUnlock()
+	var selected *rpcConn
+	for _, conn := range r.conns {
+		if conn.dstChannel.IsClosed() || !r.IsDstHealthy(conn.dstClientConf) {
+			continue
+		}
+		if selected == nil || atomic.LoadInt64(&conn.inflight) < atomic.LoadInt64(&selected.inflight) {
+			selected = conn
+		}
+	}
+	return selected
+}
+
+func (r *Rpc) getConn(dstCh channel.IChannel) *rpcConn {
+	r.connMut.RLock()
+	defer r.connMut.RUnlock()
+	for _, conn := range r.conns {
+		if conn.dstChannel.GetId() == dstCh.GetId() {
+			return conn
+		}
+	}
+	return nil
+}
+
+// InitChannelPeer 创建agentChannel的会话，不绑定dst端，有可用的长连接即成功，ret为选中的dstChannel
+func (r *Rpc) InitChannelPeer(agentCtx channel.IChHandleContext, params map[string]interface{}) {
+	agentCh := agentCtx.GetChannel()
+	agentChId := agentCh.GetId()
+	conn := r.selectConn()
+	if conn == nil {
+		logx.Error("select rpc conn error, agentChId:", agentChId)
+		return
+	}
+	r.reqMut.Lock()
+	r.sessions[agentChId] = &rpcSession{
+		agentChannel: agentCh,
+		requests:     make(map[uint64]*rpcRequest),
+	}
+	r.reqMut.Unlock()
+	agentCtx.SetRet(conn.dstChannel)
+	logx.Info("finish rpc initChannelPeer, agentChId:", agentChId)
+}
+
+// TransferAgentMsg 替换请求id后发送到选中的长连接，没有请求id的消息直接发送，不跟踪响应，见IAgentMsgTransfer
+func (r *Rpc) TransferAgentMsg(agentCtx channel.IChHandleContext) bool {
+	agentCh := agentCtx.GetChannel()
+	r.reqMut.Lock()
+	session := r.sessions[agentCh.GetId()]
+	r.reqMut.Unlock()
+	if session == nil {
+		return false
+	}
+	packet := agentCtx.GetPacket()
+	msgType := websocket.TextMessage
+	wsPacket, ok := packet.(*tcpx.WsPacket)
+	if ok {
+		msgType = wsPacket.MsgType
+	}
+	data := packet.GetData()
+	originId, err := r.getId(data)
+	conn := r.selectConn()
+	if err != nil {
+		// 没有请求id，如通知类消息
+		logx.Debugf("rpc msg without id, agentChId:%v, error:%v", agentCh.GetId(), err)
+		if conn != nil {
+			r.write(conn, data, msgType)
+		}
+		return true
+	}
+	if conn == nil {
+		r.reply(session.agentChannel, msgType, r.ErrorBuilder(r.RpcConf, originId, ERR_RPC_UNAVAILABLE, "no available dst"))
+		return true
+	}
+
+	r.reqMut.Lock()
+	seq, ok := r.nextSeq()
+	if !ok {
+		r.reqMut.Unlock()
+		r.reply(session.agentChannel, msgType, r.ErrorBuilder(r.RpcConf, originId, ERR_RPC_UNAVAILABLE, "no free request id"))
+		return true
+	}
+	reqData, err := r.replaceId(data, r.encodeSeq(seq))
+	if err != nil {
+		r.reqMut.Unlock()
+		logx.Warnf("replace rpc id error, agentChId:%v, error:%v", agentCh.GetId(), err)
+		return true
+	}
+	request := &rpcRequest{
+		seq:      seq,
+		originId: originId,
+		session:  session,
+		conn:     conn,
+		msgType:  msgType,
+		sendTime: time.Now(),
+	}
+	r.requests[seq] = request
+	session.requests[seq] = request
+	request.timer = time.AfterFunc(r.RpcConf.GetTimeout(), func() {
+		r.failRequest(seq, ERR_RPC_TIMEOUT, "request timeout")
+	})
+	r.reqMut.Unlock()
+	atomic.AddInt64(&conn.inflight, 1)
+	r.GetDstStatis(conn.dstClientConf).IncInflight()
+
+	err = r.write(conn, reqData, msgType)
+	if err != nil {
+		r.failRequest(seq, ERR_RPC_DST_CLOSED, err.Error())
+	}
+	return true
+}
+
+// nextSeq 分配非0且未被未响应请求占用的请求id，二进制方式按id字节数回绕，都被占用则返回false，调用方持有reqMut
+func (r *Rpc) nextSeq() (uint64, bool) {
+	mask := uint64(math.MaxUint64)
+	if r.RpcConf.GetIdType() == RPC_ID_BINARY && r.RpcConf.GetIdLength() < 8 {
+		mask = 1<<(8*uint(r.RpcConf.GetIdLength())) - 1
+	}
+	if uint64(len(r.requests)) >= mask {
+		return 0, false
+	}
+	for {
+		r.seq++
+		seq := r.seq & mask
+		if seq == 0 {
+			continue
+		}
+		_, found := r.requests[seq]
+		if !found {
+			return seq, true
+		}
+	}
+}
+
+func (r *Rpc) write(conn *rpcConn, data []byte, msgType int) error {
+	conn.writeMut.Lock()
+	defer conn.writeMut.Unlock()
+	dstCh := conn.dstChannel
+	if dstCh.IsClosed() {
+		return errors.New("rpc conn is closed, dstChId:" + dstCh.GetId())
+	}
+	packet := dstCh.NewPacket()
+	packet.SetData(data)
+	wsPacket, ok := packet.(*tcpx.WsPacket)
+	if ok {
+		wsPacket.MsgType = msgType
+	}
+	return dstCh.Write(packet)
+}
+
+// reply 写回agentChannel
+func (r *Rpc) reply(agentCh channel.IChannel, msgType int, data []byte) {
+	if agentCh.IsClosed() {
+		return
+	}
+	packet := agentCh.NewPacket()
+	packet.SetData(data)
+	wsPacket, ok := packet.(*tcpx.WsPacket)
+	if ok {
+		wsPacket.MsgType = msgType
+	}
+	syncAgentWrite(agentCh, func() {
+		agentCh.Write(packet)
+	})
+}
+
+// removeRequest 移除未响应的请求，已移除则返回nil
+func (r *Rpc) removeRequest(seq uint64) *rpcRequest {
+	r.reqMut.Lock()
+	request, found := r.requests[seq]
+	if found {
+		delete(r.requests, seq)
+		delete(request.session.requests, seq)
+	}
+	r.reqMut.Unlock()
+	if !found {
+		return nil
+	}
+	request.timer.Stop()
+	atomic.AddInt64(&request.conn.inflight, -1)
+	r.GetDstStatis(request.conn.dstClientConf).DecInflight()
+	return request
+}
+
+// failRequest 请求失败，合成错误响应写回agentChannel
+func (r *Rpc) failRequest(seq uint64, errCode string, reason string) {
+	request := r.removeRequest(seq)
+	if request == nil {
+		return
+	}
+	logx.Warnf("rpc request failed, agentChId:%v, seq:%v, errCode:%v, reason:%v",
+		request.session.agentChannel.GetId(), seq, errCode, reason)
+	r.reply(request.session.agentChannel, request.msgType, r.ErrorBuilder(r.RpcConf, request.originId, errCode, reason))
+}
+
+// onDstChannelReadHandle 按响应id找回原请求，恢复原请求id后写回agentChannel
+func (r *Rpc) onDstChannelReadHandle(dstCtx channel.IChHandleContext) {
+	data := dstCtx.GetPacket().GetData()
+	id, err := r.getId(data)
+	var seq uint64
+	if err == nil {
+		seq, err = r.decodeSeq(id)
+	}
+	if err != nil {
+		logx.Warnf("rpc response without valid id, dstChId:%v, error:%v", dstCtx.GetChannel().GetId(), err)
+		return
+	}
+	request := r.removeRequest(seq)
+	if request == nil {
+		logx.Debug("rpc request is not existed, maybe timeout, seq:", seq)
+		return
+	}
+	r.GetDstStatis(request.conn.dstClientConf).OnRtt(time.Since(request.sendTime))
+	respData, err := r.replaceId(data, request.originId)
+	if err != nil {
+		logx.Warnf("restore rpc id error, seq:%v, error:%v", seq, err)
+		return
+	}
+	r.reply(request.session.agentChannel, request.msgType, respData)
+}
+
+// getId 获取消息中的请求id，json方式为原始json值，二进制方式为原始字节
+func (r *Rpc) getId(data []byte) ([]byte, error) {
+	conf := r.RpcConf
+	if conf.GetIdType() == RPC_ID_BINARY {
+		end := conf.GetIdOffset() + conf.GetIdLength()
+		if len(data) < end {
+			return nil, errors.New("rpc msg is too short")
+		}
+		id := make([]byte, conf.GetIdLength())
+		copy(id, data[conf.GetIdOffset():end])
+		return id, nil
+	}
+	msg := make(map[string]json.RawMessage)
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, err
+	}
+	id, found := msg[conf.GetIdField()]
+	if !found || string(id) == "null" {
+		return nil, errors.New("rpc id field is not existed")
+	}
+	return id, nil
+}
+
+// replaceId 替换消息中的请求id
+func (r *Rpc) replaceId(data []byte, id []byte) ([]byte, error) {
+	conf := r.RpcConf
+	if conf.GetIdType() == RPC_ID_BINARY {
+		ret := make([]byte, len(data))
+		copy(ret, data)
+		copy(ret[conf.GetIdOffset():conf.GetIdOffset()+conf.GetIdLength()], id)
+		return ret, nil
+	}
+	msg := make(map[string]json.RawMessage)
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, err
+	}
+	msg[conf.GetIdField()] = json.RawMessage(id)
+	return json.Marshal(msg)
+}
+
+// encodeSeq 将upstream内的请求id编码为消息中的id，json方式为数字，二进制方式为大端字节
+func (r *Rpc) encodeSeq(seq uint64) []byte {
+	if r.RpcConf.GetIdType() == RPC_ID_BINARY {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, seq)
+		return buf[8-r.RpcConf.GetIdLength():]
+	}
+	return []byte(strconv.FormatUint(seq, 10))
+}
+
+func (r *Rpc) decodeSeq(id []byte) (uint64, error) {
+	if r.RpcConf.GetIdType() == RPC_ID_BINARY {
+		buf := make([]byte, 8)
+		copy(buf[8-len(id):], id)
+		return binary.BigEndian.Uint64(buf), nil
+	}
+	var seq uint64
+	err := json.Unmarshal(id, &seq)
+	return seq, err
+}
+
+// onDstChannelInActiveHandle 长连接断开，其上未响应的请求返回错误，会话保留
+func (r *Rpc) onDstChannelInActiveHandle(dstCtx channel.IChHandleContext) {
+	r.ReleaseOnDstChannel(dstCtx)
+}
+
+// GetChannelPeer 请求不绑定dst端，没有channelpeer
+func (r *Rpc) GetChannelPeer(ctx channel.IChHandleContext, isAgent bool) IChannelPeer {
+	return nil
+}
+
+func (r *Rpc) QueryDstChannel(ctx channel.IChHandleContext) {
+	logx.Warn("rpc request is not bound to dst channel.")
+}
+
+func (r *Rpc) QueryAgentChannel(ctx channel.IChHandleContext) {
+	logx.Warn("rpc dst channel is shared, agent channel can not be queried.")
+}
+
+// ReleaseOnAgentChannel agentChannel关闭，丢弃该会话未响应的请求
+func (r *Rpc) ReleaseOnAgentChannel(agentCtx channel.IChHandleContext) {
+	agentChId := agentCtx.GetChannel().GetId()
+	r.reqMut.Lock()
+	session, found := r.sessions[agentChId]
+	delete(r.sessions, agentChId)
+	var seqs []uint64
+	if found {
+		for seq := range session.requests {
+			seqs = append(seqs, seq)
+		}
+	}
+	r.reqMut.Unlock()
+	for _, seq := range seqs {
+		r.removeRequest(seq)
+	}
+	logx.Infof("release rpc session, agentChId:%v, pending:%v", agentChId, len(seqs))
+}
+
+// ReleaseOnDstChannel 长连接断开，移除该连接，其上未响应的请求返回错误
+func (r *Rpc) ReleaseOnDstChannel(dstCtx channel.IChHandleContext) {
+	dstChId := dstCtx.GetChannel().GetId()
+	r.connMut.Lock()
+	for index, conn := range r.conns {
+		if conn.dstChannel.GetId() == dstChId {
+			r.conns = append(r.conns[:index], r.conns[index+1:]...)
+			break
+		}
+	}
+	r.connMut.Unlock()
+	r.GetDstChannels().Remove(dstChId)
+
+	var seqs []uint64
+	r.reqMut.Lock()
+	for seq, request := range r.requests {
+		if request.conn.dstChannel.GetId() == dstChId {
+			seqs = append(seqs, seq)
+		}
+	}
+	r.reqMut.Unlock()
+	logx.Infof("rpc conn closed, dstChId:%v, pending:%v", dstChId, len(seqs))
+	for _, seq := range seqs {
+		r.failRequest(seq, ERR_RPC_DST_CLOSED, "dst closed")
+	}
+}
+
+// ReleaseChannelPeers 释放所有会话，未响应的请求和长连接
+func (r *Rpc) ReleaseChannelPeers() {
+	r.reqMut.Lock()
+	requests := r.requests
+	r.sessions = make(map[string]*rpcSession)
+	r.requests = make(map[uint64]*rpcRequest)
+	r.reqMut.Unlock()
+	for _, request := range requests {
+		request.timer.Stop()
+	}
+	r.connMut.Lock()
+	r.conns = nil
+	r.connMut.Unlock()
+	r.Upstream.ReleaseChannelPeers()
+}
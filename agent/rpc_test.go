@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func newTestRpc(conf *RpcConf) *Rpc {
+	return &Rpc{
+		RpcConf:  conf,
+		requests: make(map[uint64]*rpcRequest),
+	}
+}
+
+func TestRpcGetId(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    *RpcConf
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{"json number", &RpcConf{IdType: RPC_ID_JSON}, `{"id":12,"method":"a"}`, `12`, false},
+		{"json string", &RpcConf{IdType: RPC_ID_JSON}, `{"id":"abc"}`, `"abc"`, false},
+		{"json custom field", &RpcConf{IdType: RPC_ID_JSON, IdField: "seq"}, `{"seq":3,"id":1}`, `3`, false},
+		{"json null", &RpcConf{IdType: RPC_ID_JSON}, `{"id":null}`, ``, true},
+		{"json missing", &RpcConf{IdType: RPC_ID_JSON}, `{"method":"a"}`, ``, true},
+		{"json invalid", &RpcConf{IdType: RPC_ID_JSON}, `not json`, ``, true},
+		{"binary", &RpcConf{IdType: RPC_ID_BINARY, IdOffset: 1, IdLength: 2}, "\x09\x01\x02body", "\x01\x02", false},
+		{"binary too short", &RpcConf{IdType: RPC_ID_BINARY, IdOffset: 1, IdLength: 4}, "\x09\x01\x02", ``, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTestRpc(tt.conf).getId([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getId() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Fatalf("getId() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRpcReplaceId(t *testing.T) {
+	tests := []struct {
+		name string
+		conf *RpcConf
+		data string
+		id   string
+		want string
+	}{
+		{"json", &RpcConf{IdType: RPC_ID_JSON}, `{"id":"abc","method":"a"}`, `7`, `{"id":7,"method":"a"}`},
+		{"json restore", &RpcConf{IdType: RPC_ID_JSON}, `{"id":7,"result":1}`, `"abc"`, `{"id":"abc","result":1}`},
+		{"binary", &RpcConf{IdType: RPC_ID_BINARY, IdOffset: 1, IdLength: 2}, "\x09\x01\x02body", "\x00\x07", "\x09\x00\x07body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTestRpc(tt.conf).replaceId([]byte(tt.data), []byte(tt.id))
+			if err != nil {
+				t.Fatalf("replaceId() error = %v", err)
+			}
+			if tt.conf.IdType == RPC_ID_JSON {
+				assertJsonEqual(t, got, []byte(tt.want))
+				return
+			}
+			if !bytes.Equal(got, []byte(tt.want)) {
+				t.Fatalf("replaceId() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRpcSeqRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		conf *RpcConf
+		seq  uint64
+	}{
+		{"json", &RpcConf{IdType: RPC_ID_JSON}, 1<<53 + 1},
+		{"binary 1 byte", &RpcConf{IdType: RPC_ID_BINARY, IdLength: 1}, 0xFF},
+		{"binary 8 bytes", &RpcConf{IdType: RPC_ID_BINARY, IdLength: 8}, 1<<64 - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRpc(tt.conf)
+			got, err := r.decodeSeq(r.encodeSeq(tt.seq))
+			if err != nil {
+				t.Fatalf("decodeSeq() error = %v", err)
+			}
+			if got != tt.seq {
+				t.Fatalf("decodeSeq() = %v, want %v", got, tt.seq)
+			}
+		})
+	}
+}
+
+func TestRpcNextSeq(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        *RpcConf
+		start       uint64
+		outstanding []uint64
+		want        []uint64
+	}{
+		{"json", &RpcConf{IdType: RPC_ID_JSON}, 0, nil, []uint64{1, 2, 3}},
+		{"json skips outstanding", &RpcConf{IdType: RPC_ID_JSON}, 0, []uint64{2}, []uint64{1, 3}},
+		{"json wraps skipping zero", &RpcConf{IdType: RPC_ID_JSON}, 1<<64 - 2, nil, []uint64{1<<64 - 1, 1, 2}},
+		{"binary 1 byte wraps skipping zero", &RpcConf{IdType: RPC_ID_BINARY, IdLength: 1}, 0xFE, nil, []uint64{0xFF, 1, 2}},
+		{"binary 1 byte skips outstanding", &RpcConf{IdType: RPC_ID_BINARY, IdLength: 1}, 0xFE, []uint64{0xFF, 1}, []uint64{2, 3}},
+		{"binary 2 bytes wraps", &RpcConf{IdType: RPC_ID_BINARY, IdLength: 2}, 0xFFFF, []uint64{1}, []uint64{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRpc(tt.conf)
+			r.seq = tt.start
+			for _, seq := range tt.outstanding {
+				r.requests[seq] = &rpcRequest{}
+			}
+			for _, want := range tt.want {
+				got, ok := r.nextSeq()
+				if !ok || got != want {
+					t.Fatalf("nextSeq() = %v, %v, want %v, true", got, ok, want)
+				}
+				r.requests[got] = &rpcRequest{}
+			}
+		})
+	}
+}
+
+func TestRpcNextSeqFull(t *testing.T) {
+	r := newTestRpc(&RpcConf{IdType: RPC_ID_BINARY, IdLength: 1})
+	for seq := uint64(1); seq <= 0xFF; seq++ {
+		r.requests[seq] = &rpcRequest{}
+	}
+	_, ok := r.nextSeq()
+	if ok {
+		t.Fatal("nextSeq() ok = true when all ids are outstanding")
+	}
+	delete(r.requests, 0x80)
+	got, ok := r.nextSeq()
+	if !ok || got != 0x80 {
+		t.Fatalf("nextSeq() = %v, %v, want 128, true", got, ok)
+	}
+}
+
+func assertJsonEqual(t *testing.T, got []byte, want []byte) {
+	t.Helper()
+	var gotMsg, wantMsg interface{}
+	if err := json.Unmarshal(got, &gotMsg); err != nil {
+		t.Fatalf("unmarshal %q error = %v", got, err)
+	}
+	if err := json.Unmarshal(want, &wantMsg); err != nil {
+		t.Fatalf("unmarshal %q error = %v", want, err)
+	}
+	gotData, _ := json.Marshal(gotMsg)
+	wantData, _ := json.Marshal(wantMsg)
+	if !bytes.Equal(gotData, wantData) {
+		t.Fatalf("json = %s, want %s", got, want)
+	}
+}
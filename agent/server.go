@@ -9,6 +9,7 @@ import (
 	"github.com/slive/gsfly/common"
 	logx "github.com/slive/gsfly/logger"
 	"github.com/slive/gsfly/socket"
+	"sync"
 )
 
 // IMsgHandler 处理消息的接口
@@ -28,6 +29,9 @@ type IAgServer interface {
 
 	// GetExtension 扩展实现
 	GetExtension() IExtension
+
+	// GetMirror 获取location对应的流量镜像，未配置则为nil
+	GetMirror(location ILocationConf) *Mirror
 }
 
 // AgServer 代理服务器
@@ -43,17 +47,26 @@ type AgServer struct {
 	msgHandlers []IMsgHandler
 
 	extension IExtension
+
+	// 流量镜像，location的pattern作为主键
+	mirrors map[string]*Mirror
+
+	mirrorMut sync.Mutex
 }
 
 func NewAgServer(parent interface{}, serverConf IAgServerConf, extension IExtension) *AgServer {
 	s := &AgServer{serverConf: serverConf}
 	s.Closed = false
 	s.msgHandlers = []IMsgHandler{}
+	s.mirrors = make(map[string]*Mirror)
 
 	// 初始化channel相关handler
 	handle := gch.NewDefChHandle(s.onAgentChannelReadHandle)
 	handle.SetOnConnect(s.onAgentChannelActiveHandle)
 	handle.SetOnRelease(s.onAgentChannelInActiveHandle)
+	handle.SetOnError(onChannelErrorHandle)
+	// 写回agentChannel前执行filters
+	handle.SetPreWrite(onAgentChannelPreWrite)
 
 	// 扩展点
 	if extension == nil {
@@ -107,11 +120,22 @@ func (server *AgServer) ClearMsgHandlers() {
 
 const (
 	Upstream_Attach_key = "upstream"
+
+	// agentChannel中存放所属agserver的附件key
+	AgServer_Attach_key = "agserver"
+
+	// agentChannel中存放匹配到的location的附件key
+	Location_Attach_key = "location"
+
+	// agentChannel中存放流量镜像的附件key
+	Mirror_Attach_key = "mirror"
 )
 
 // onAgentChannelActiveHandle 当agentChannel注册时，路由dstClientChannel等操作
 func (ags *AgServer) onAgentChannelActiveHandle(ctx gch.IChHandleContext) {
 	chId := ctx.GetChannel().GetId()
+	// 记录ws的关闭帧，用于关闭dst端
+	watchClose(ctx.GetChannel())
 	extension := ags.extension
 	err := extension.BeforeAgentChannelActive(ctx)
 	if err != nil {
@@ -119,11 +143,33 @@ func (ags *AgServer) onAgentChannelActiveHandle(ctx gch.IChHandleContext) {
 		gch.NotifyErrorHandle(ctx, err, gch.ERR_ACTIVE)
 		return
 	}
+	err = ags.beforeFilters(ctx)
+	if err != nil {
+		logx.Errorf("filter active, chId:%v, error:%v", chId, err)
+		gch.NotifyErrorHandle(ctx, err, gch.ERR_ACTIVE)
+		rejectSession(ctx.GetChannel(), err)
+		return
+	}
+	asyncDialConf := ags.serverConf.GetAsyncDialConf()
+	if asyncDialConf == nil {
+		if _, ok := ctx.GetChannel().(*TunnelChannel); ok {
+			// tunnel会话由链路的读协程激活，同步拨号会阻塞链路上的其他会话
+			asyncDialConf = NewAsyncDialConf(0, 0)
+		}
+	}
+	if asyncDialConf != nil {
+		// 异步拨号，不阻塞agentChannel的激活
+		ags.asyncLocationUpstream(ctx, asyncDialConf)
+		return
+	}
 	ags.locationUpstream(ctx)
 	err = ctx.GetError()
 	if err != nil {
 		logx.Errorf("location chId:%v, error:%v", chId, err)
 		gch.NotifyErrorHandle(ctx, err, gch.ERR_ACTIVE)
+		if isFilterReject(err) {
+			rejectSession(ctx.GetChannel(), err)
+		}
 	} else {
 		// 最后的处理
 		extension.AfterAgentChannelActive(ctx)
@@ -139,12 +185,11 @@ func (ags *AgServer) onAgentChannelInActiveHandle(ctx gch.IChHandleContext) {
 		logx.Infof("finish to onAgentChannelInActiveHandle, chId:%v, ret:%v", agentChId, ret)
 	}()
 	logx.Info("start to onAgentChannelInActiveHandle, chId:", agentChId)
-	ups := agentChannel.GetAttach(Upstream_Attach_key)
-	if ups != nil {
-		proxy, ok := ups.(IProxy)
-		if ok {
-			proxy.ReleaseOnAgentChannel(ctx)
-		}
+	releaseUpstreams(ctx)
+	closeFilters(ctx)
+	mirror, ok := agentChannel.GetAttach(Mirror_Attach_key).(*Mirror)
+	if ok {
+		mirror.Close(agentChannel)
 	}
 }
 
@@ -162,12 +207,46 @@ func (ags *AgServer) onAgentChannelReadHandle(handlerCtx gch.IChHandleContext) {
 	}
 
 	agentChannel := packet.GetChannel()
-	ups, found := agentChannel.GetAttach(Upstream_Attach_key).(IUpstream)
+	if !filterAgentMsg(handlerCtx) {
+		return
+	}
+	session, ok := agentChannel.GetAttach(PendingSession_Attach_key).(*pendingSession)
+	if ok {
+		// 异步拨号中，先缓存
+		buffered, err := session.offer(packet)
+		if err != nil {
+			ags.failPendingSession(session, err)
+			return
+		}
+		if buffered {
+			return
+		}
+	}
+	ags.transferAgentMsg(handlerCtx)
+}
+
+// transferAgentMsg 转发agent端的消息到upstream
+func (ags *AgServer) transferAgentMsg(handlerCtx gch.IChHandleContext) {
+	// 绑定了多个upstream，则按选择器选择
+	ups, found := selectUpstream(handlerCtx)
 	if found {
+		msgTransfer, ok := ups.(IAgentMsgTransfer)
+		if ok && msgTransfer.TransferAgentMsg(handlerCtx) {
+			ags.mirrorTransfer(handlerCtx)
+			return
+		}
 		ups.QueryDstChannel(handlerCtx)
-		dstCh := handlerCtx.GetRet()
-		if dstCh != nil {
-			ags.GetExtension().Transfer(handlerCtx, dstCh.(gch.IChannel))
+		switch dstCh := handlerCtx.GetRet().(type) {
+		case gch.IChannel:
+			ags.GetExtension().Transfer(handlerCtx, dstCh)
+			ags.mirrorTransfer(handlerCtx)
+			return
+		case []gch.IChannel:
+			// 一个agentChannel对应多个dstChannel，如广播方式
+			for _, ch := range dstCh {
+				ags.GetExtension().Transfer(handlerCtx, ch)
+			}
+			ags.mirrorTransfer(handlerCtx)
 			return
 		}
 	}
@@ -178,9 +257,6 @@ const default_localPattern = ""
 
 // locationUpstream 定位到location
 func (ags *AgServer) locationUpstream(agentCtx gch.IChHandleContext) {
-	// TODO filter的处理
-	// FilterConfs := ags.GetServerConf().GetServerConf().GetFilterConfs()
-
 	// 步骤：
 	// 先获取(可先认证)location->获取(可先认证)upstream->执行负载均衡算法->获取到clientconf
 	// 获取clientchannel
@@ -208,24 +284,83 @@ func (ags *AgServer) locationUpstream(agentCtx gch.IChHandleContext) {
 	upsStreams := ags.GetParent().(IService).GetUpstreams()
 	ups, found := upsStreams[upstreamId]
 	if found {
+		// 记录agserver和location，供负载均衡等使用
+		agentChannel.AddAttach(AgServer_Attach_key, ags)
+		agentChannel.AddAttach(Location_Attach_key, location)
+		if location.GetBindingConf() != nil {
+			// 绑定多个upstream，多个dst端的响应串行写回agentChannel
+			agentChannel.AddAttach(AgentWriteLock_Attach_key, &sync.Mutex{})
+		}
 		// 第一次获取到upstream，要构建channelPeer，然后对agentChannel和dstChannel进行关联
 		ups.InitChannelPeer(agentCtx, params)
 		ret := agentCtx.GetRet()
 		isOk := (ret != nil)
 		logx.Info("select ret:", isOk)
 		if isOk {
-			// TODO 一个agent可能有多个upstream情况
 			agentChannel.AddAttach(Upstream_Attach_key, ups)
-			return
+			// 一个agent可能有多个upstream情况，按绑定配置初始化其他upstream
+			if ags.bindUpstreams(agentCtx, location, ups, params) {
+				ags.openMirror(agentChannel, location, params)
+				err := afterLocationFilters(agentCtx, location, ups)
+				if err != nil {
+					agentCtx.SetError(common.NewError1(gch.ERR_MSG, err))
+				}
+				return
+			}
 		}
 	}
 
 	errMs := "select dstchannel error."
 	logx.Error(errMs, ups)
-	agentCtx.SetError(common.NewError2(gch.ERR_MSG, errMs))
+	if agentCtx.GetError() == nil {
+		// upstream未设置更明确的错误(如熔断)，则使用通用错误
+		agentCtx.SetError(common.NewError2(gch.ERR_MSG, errMs))
+	}
 	return
 }
 
+// GetMirror 获取location对应的流量镜像，未配置或者镜像的upstream不是proxy类型则为nil
+func (ags *AgServer) GetMirror(location ILocationConf) *Mirror {
+	mirrorUpsId := location.GetMirrorUpstreamId()
+	if len(mirrorUpsId) <= 0 {
+		return nil
+	}
+	ags.mirrorMut.Lock()
+	defer ags.mirrorMut.Unlock()
+	pattern := location.GetPattern()
+	mirror, found := ags.mirrors[pattern]
+	if found {
+		return mirror
+	}
+	ups, found := ags.GetParent().(IService).GetUpstreams()[mirrorUpsId]
+	proxy, ok := ups.(IProxy)
+	if !found || !ok {
+		logx.Warn("mirror upstream is invalid, upstreamId:", mirrorUpsId)
+	} else {
+		mirror = NewMirror(proxy, location.GetMirrorPercent())
+	}
+	// 无效的配置也记录，避免重复查找
+	ags.mirrors[pattern] = mirror
+	return mirror
+}
+
+// openMirror 按location的镜像配置打开影子dstChannel
+func (ags *AgServer) openMirror(agentChannel gch.IChannel, location ILocationConf, params map[string]interface{}) {
+	mirror := ags.GetMirror(location)
+	if mirror != nil {
+		agentChannel.AddAttach(Mirror_Attach_key, mirror)
+		mirror.Open(agentChannel, params)
+	}
+}
+
+// mirrorTransfer 主会话发送完成后，再发送到影子dstChannel
+func (ags *AgServer) mirrorTransfer(handlerCtx gch.IChHandleContext) {
+	mirror, ok := handlerCtx.GetChannel().GetAttach(Mirror_Attach_key).(*Mirror)
+	if ok {
+		mirror.Transfer(handlerCtx)
+	}
+}
+
 // locationHandle 获取location，以便确认upstream的处理
 // Pattern 匹配路径
 // params 任意参数
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"github.com/slive/gsfly/channel"
 	logx "github.com/slive/gsfly/logger"
+	"sort"
 )
 
 // IService 代理服务
@@ -19,7 +20,11 @@ type IService interface {
 
 	GetUpstreams() map[string]IUpstream
 
-	// GetFilters() map[string]IFilter
+	// Publish 进程内发布消息到hub方式upstream的topic，返回收到消息的agentChannel数
+	Publish(upstreamId string, topic string, data []byte) (int, error)
+
+	// GetFilters 获取过滤器，按order排序
+	GetFilters() []IFilter
 
 	Start() error
 
@@ -28,13 +33,14 @@ type IService interface {
 	IsClosed() bool
 
 	// CreateUpstream(upsConf IUpstreamConf) IUpstream
-
-	// CreateFilter(filterConf IFilterConf) IFilter
 }
 
 type Service struct {
 	AgServer IAgServer
 
+	// 接收边缘agent链路的tunnel监听，未配置则为nil
+	TunnelServer *TunnelServer
+
 	ServiceConf IServiceConf
 
 	Closed bool
@@ -43,7 +49,8 @@ type Service struct {
 
 	extension IExtension
 
-	// Filters map[string]IFilter
+	// 过滤器，按order排序
+	Filters []IFilter
 }
 
 func NewService(serviceConf IServiceConf, extension IExtension) *Service {
@@ -69,19 +76,29 @@ func NewService(serviceConf IServiceConf, extension IExtension) *Service {
 		if ups != nil {
 			service.GetUpstreams()[key] = ups
 		} else {
-			logx.Warnf("create ups is nil, conf:", conf)
+			logx.Warn("create ups is nil, conf:", conf)
 		}
 	}
 
-	// 初始化filters
-	// filterConfs := serviceConf.GetFilterConfs()
-	// service.Filters = make(map[string]IFilter, len(filterConfs))
-	// for key, conf := range filterConfs {
-	// 	filter := service.CreateFilter(conf)
-	// 	if filter != nil {
-	// 		service.GetFilters()[key] = filter
-	// 	}
-	// }
+	// 初始化filters，按order排序，order相同则按id
+	filterConfs := serviceConf.GetFilterConfs()
+	service.Filters = make([]IFilter, 0, len(filterConfs))
+	for _, conf := range filterConfs {
+		filter := createFilter(service.extension, conf)
+		if filter != nil {
+			service.Filters = append(service.Filters, filter)
+		} else {
+			logx.Warn("create filter is nil, conf:", conf)
+		}
+	}
+	sort.Slice(service.Filters, func(i, j int) bool {
+		iConf := service.Filters[i].GetConf()
+		jConf := service.Filters[j].GetConf()
+		if iConf.GetOrder() != jConf.GetOrder() {
+			return iConf.GetOrder() < jConf.GetOrder()
+		}
+		return iConf.GetId() < jConf.GetId()
+	})
 	service.Closed = true
 	return service
 }
@@ -94,9 +111,23 @@ func (service *Service) GetUpstreams() map[string]IUpstream {
 	return service.Upstreams
 }
 
-// func (service *Service) GetFilters() map[string]IFilter {
-// 	return service.Filters
-// }
+// Publish 进程内发布消息到hub方式upstream的topic，返回收到消息的agentChannel数
+func (service *Service) Publish(upstreamId string, topic string, data []byte) (int, error) {
+	ups, found := service.GetUpstreams()[upstreamId]
+	if !found {
+		return 0, errors.New("upstream is not existed, id:" + upstreamId)
+	}
+	hub, ok := ups.(IHub)
+	if !ok {
+		return 0, errors.New("upstream is not hub, id:" + upstreamId)
+	}
+	return hub.Publish(topic, data), nil
+}
+
+// GetFilters 获取过滤器，按order排序
+func (service *Service) GetFilters() []IFilter {
+	return service.Filters
+}
 
 func (service *Service) Start() error {
 	id := service.GetConf().GetId()
@@ -113,14 +144,50 @@ func (service *Service) Start() error {
 		}
 	}()
 	logx.Info("start to agent service, id:", id)
+	// 先启动upstream，如健康检查
+	started := make([]IUpstream, 0, len(service.Upstreams))
+	for upsId, upstream := range service.Upstreams {
+		err := upstream.Start()
+		if err != nil {
+			logx.Errorf("start upstream error, upstreamId:%v, error:%v", upsId, err)
+			stopUpstreams(started)
+			return err
+		}
+		started = append(started, upstream)
+	}
+
 	agServerConf := service.GetConf().GetAgServerConf()
 	agServer := NewAgServer(service, agServerConf, service.extension)
 	err := agServer.Listen()
-	if err == nil {
-		service.AgServer = agServer
-		service.Closed = true
+	if err != nil {
+		stopUpstreams(started)
+		return err
+	}
+	service.AgServer = agServer
+
+	// tunnel的会话按agServer的location处理，在agServer之后监听
+	tunnelServerConf := agServerConf.GetTunnelServerConf()
+	if tunnelServerConf != nil {
+		tunnelServer := NewTunnelServer(agServer, tunnelServerConf)
+		err = tunnelServer.Listen()
+		if err != nil {
+			logx.Errorf("listen tunnel error, id:%v, error:%v", id, err)
+			agServer.Close()
+			service.AgServer = nil
+			stopUpstreams(started)
+			return err
+		}
+		service.TunnelServer = tunnelServer
+	}
+	service.Closed = false
+	return nil
+}
+
+// stopUpstreams 启动失败时停止已启动的upstream
+func stopUpstreams(upstreams []IUpstream) {
+	for _, upstream := range upstreams {
+		upstream.Stop()
 	}
-	return err
 }
 
 func (service *Service) Stop() {
@@ -141,6 +208,12 @@ func (service *Service) Stop() {
 	}()
 	logx.Info("start to close agent, id:", id)
 
+	// 先清理tunnel监听，其上的会话依赖代理服务
+	if service.TunnelServer != nil {
+		service.TunnelServer.Close()
+		service.TunnelServer = nil
+	}
+
 	// 清理代理服务
 	server := service.GetAgServer()
 	if server != nil {
@@ -150,12 +223,13 @@ func (service *Service) Stop() {
 	// 清理upstream相关
 	upstreams := service.Upstreams
 	for _, upstream := range upstreams {
+		upstream.Stop()
 		upstream.ReleaseChannelPeers()
 		service.Upstreams = nil
 	}
 
 	// 清理filter相关
-	// service.Filters = nil
+	service.Filters = nil
 }
 
 func (b *Service) IsClosed() bool {
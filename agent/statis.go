@@ -0,0 +1,151 @@
+/*
+ * dst端的统计信息，主要给负载均衡使用
+ * Author:slive
+ * DATE:2021/4/12
+ */
+package agent
+
+import (
+	"github.com/slive/gsfly/socket"
+	"sync"
+	"time"
+)
+
+// 延迟EWMA的衰减系数，越大越偏向最近的采样
+const latency_ewma_alpha = 0.3
+
+// 拨号失败时，按此耗时进行惩罚采样
+const dial_fail_penalty = 3 * time.Second
+
+// DstStatis dst端统计信息，包括延迟(拨号耗时和消息往返耗时)的EWMA值，正在使用的会话数和健康状态
+type DstStatis struct {
+	// 是否健康，默认为健康
+	healthy bool
+
+	// 新增或者最近一次恢复健康的时间，用于慢启动
+	upTime time.Time
+
+	// 延迟的EWMA值，单位ms
+	latency float64
+
+	// 是否已有采样
+	sampled bool
+
+	// 当前正在使用的会话数
+	inflight int64
+
+	mut sync.RWMutex
+}
+
+func NewDstStatis() *DstStatis {
+	return &DstStatis{healthy: true, upTime: time.Now()}
+}
+
+// IsHealthy 是否健康
+func (ds *DstStatis) IsHealthy() bool {
+	ds.mut.RLock()
+	defer ds.mut.RUnlock()
+	return ds.healthy
+}
+
+// SetHealthy 设置健康状态，从不健康恢复为健康时，重新记录upTime
+func (ds *DstStatis) SetHealthy(healthy bool) {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	if healthy && !ds.healthy {
+		ds.upTime = time.Now()
+	}
+	ds.healthy = healthy
+}
+
+// GetUpTime 获取新增或者最近一次恢复健康的时间
+func (ds *DstStatis) GetUpTime() time.Time {
+	ds.mut.RLock()
+	defer ds.mut.RUnlock()
+	return ds.upTime
+}
+
+// OnDial 记录拨号耗时，拨号失败则按惩罚耗时记录
+func (ds *DstStatis) OnDial(cost time.Duration, err error) {
+	if err != nil && cost < dial_fail_penalty {
+		cost = dial_fail_penalty
+	}
+	ds.addLatency(cost)
+}
+
+// OnRtt 记录消息往返耗时
+func (ds *DstStatis) OnRtt(cost time.Duration) {
+	ds.addLatency(cost)
+}
+
+func (ds *DstStatis) addLatency(cost time.Duration) {
+	sample := float64(cost) / float64(time.Millisecond)
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	if !ds.sampled {
+		ds.latency = sample
+		ds.sampled = true
+	} else {
+		ds.latency = latency_ewma_alpha*sample + (1-latency_ewma_alpha)*ds.latency
+	}
+}
+
+// IncInflight 会话数加1
+func (ds *DstStatis) IncInflight() {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	ds.inflight++
+}
+
+// DecInflight 会话数减1
+func (ds *DstStatis) DecInflight() {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	if ds.inflight > 0 {
+		ds.inflight--
+	}
+}
+
+// GetLatency 获取延迟的EWMA值，单位ms
+func (ds *DstStatis) GetLatency() float64 {
+	ds.mut.RLock()
+	defer ds.mut.RUnlock()
+	return ds.latency
+}
+
+// GetInflight 获取正在使用的会话数
+func (ds *DstStatis) GetInflight() int64 {
+	ds.mut.RLock()
+	defer ds.mut.RUnlock()
+	return ds.inflight
+}
+
+// GetLoad 获取综合负载，延迟和会话数越大，负载越大
+func (ds *DstStatis) GetLoad() float64 {
+	ds.mut.RLock()
+	defer ds.mut.RUnlock()
+	return (ds.latency + 1) * float64(ds.inflight+1)
+}
+
+// DstSnapshot dst端某一时刻的健康和负载快照，供自定义负载均衡参考
+type DstSnapshot struct {
+	DstClientConf socket.IClientConf
+
+	// 是否健康，包括主动健康检查和被动异常检测的结果
+	Healthy bool
+
+	// 是否可用，即健康，未熔断且未达到最大连接数
+	Available bool
+
+	// 延迟的EWMA值，单位ms
+	Latency float64
+
+	// 正在使用的会话数
+	Inflight int64
+
+	// 负载，见DstStatis.GetLoad
+	Load float64
+
+	// 有效权重，慢启动期间小于配置的权重
+	EffectiveWeight float64
+}
@@ -0,0 +1,800 @@
+/*
+ * agent之间的tunnel方式，边缘agent的多个会话经一条加密的多路复用链路转发到核心agent：
+ *  1、链路按mux包的分帧协议收发，建立后先交换FRAME_HELLO握手，payload使用按共享密钥和握手派生的本链路密钥加密，见mux.Cipher
+ *  2、FRAME_OPEN的payload为会话的原始信息(客户端地址，path，参数)，核心agent据此按正常的location路由，见TunnelServer
+ *  3、FRAME_DATA的payload首字节为ws消息类型，FRAME_CLOSE的payload为关闭信息
+ *  4、链路断开后会话保留，期间的消息缓存，重连后以相同的会话id恢复会话并发送缓存的消息，超过恢复时间则关闭会话
+ *  5、链路没有确认和重发，已写入链路但链路断开时尚未送达的帧直接丢失，会话的消息最多送达一次(at-most-once)
+ * 本文件为边缘agent的tunnel方式的upstream
+ * Author:slive
+ * DATE:2021/4/28
+ */
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/slive/gsfly-agent/mux"
+	"github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/channel/tcpx"
+	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 默认的会话恢复时间
+	default_tunnel_resume_timeout = 30 * time.Second
+
+	// 默认每个会话在链路断开期间缓存的消息数
+	default_tunnel_buffer_size = 256
+
+	// 链路的检查间隔
+	tunnel_maintain_interval = time.Second
+
+	// 链路的握手超时
+	tunnel_handshake_timeout = 5 * time.Second
+)
+
+// TunnelMeta 会话的原始信息，即FRAME_OPEN的payload
+type TunnelMeta struct {
+	// 边缘agent的tunnel实例id，和会话id一起唯一确定会话
+	TunnelId string `json:"tunnelId"`
+
+	// 客户端连接的协议
+	Network string `json:"network"`
+
+	// 客户端地址，ip:port
+	ClientAddr string `json:"clientAddr"`
+
+	// 客户端连接的path
+	Path string `json:"path"`
+
+	// 客户端连接的参数
+	Params map[string]interface{} `json:"params"`
+
+	// 是否为链路重连后恢复会话
+	Resume bool `json:"resume"`
+}
+
+// tunnelLink 加密的多路复用链路，建立后先交换FRAME_HELLO握手，派生本链路的密钥后才可收发其他帧
+type tunnelLink struct {
+	ch channel.IChannel
+
+	secret string
+
+	// 是否为链路的发起方，即边缘agent
+	client bool
+
+	// 本端的握手nonce
+	localNonce []byte
+
+	// 握手完成前为nil，在writeMut内设置
+	cipher *mux.Cipher
+
+	// 握手完成后关闭
+	ready chan struct{}
+
+	// 解帧，只在链路的读协程中使用
+	decoder *mux.Decoder
+
+	writeMut sync.Mutex
+
+	// 链路来自的边缘agent的tunnelId，核心agent使用
+	tunnelId string
+}
+
+func newTunnelLink(ch channel.IChannel, secret string, client bool) (*tunnelLink, error) {
+	nonce, err := mux.NewHandshakeNonce()
+	if err != nil {
+		return nil, err
+	}
+	return &tunnelLink{
+		ch:         ch,
+		secret:     secret,
+		client:     client,
+		localNonce: nonce,
+		ready:      make(chan struct{}),
+		decoder:    mux.NewDecoder(),
+	}, nil
+}
+
+// hello 发送本端的握手nonce
+func (link *tunnelLink) hello() error {
+	link.writeMut.Lock()
+	defer link.writeMut.Unlock()
+	return link.write(mux.NewFrame(mux.FRAME_HELLO, 0, link.localNonce))
+}
+
+// onHello 收到对端的握手nonce，派生密钥，核心agent先回复本端的握手nonce
+func (link *tunnelLink) onHello(peerNonce []byte) error {
+	link.writeMut.Lock()
+	defer link.writeMut.Unlock()
+	if link.cipher != nil {
+		return errors.New("tunnel link had handshake, chId:" + link.ch.GetId())
+	}
+	clientNonce, serverNonce := link.localNonce, peerNonce
+	if !link.client {
+		clientNonce, serverNonce = peerNonce, link.localNonce
+		err := link.write(mux.NewFrame(mux.FRAME_HELLO, 0, link.localNonce))
+		if err != nil {
+			return err
+		}
+	}
+	cipher, err := mux.NewCipher(link.secret, clientNonce, serverNonce, link.client)
+	if err != nil {
+		return err
+	}
+	link.cipher = cipher
+	close(link.ready)
+	return nil
+}
+
+// waitReady 等待握手完成
+func (link *tunnelLink) waitReady(timeout time.Duration) error {
+	select {
+	case <-link.ready:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("tunnel link handshake timeout, chId:" + link.ch.GetId())
+	}
+}
+
+func (link *tunnelLink) isReady() bool {
+	select {
+	case <-link.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeFrame 加密后写一帧，多个会话共用链路，串行加密和写入，保证发送序号和写入顺序一致
+func (link *tunnelLink) writeFrame(frame *mux.Frame) error {
+	if link.ch.IsClosed() {
+		return errors.New("tunnel link is closed, chId:" + link.ch.GetId())
+	}
+	link.writeMut.Lock()
+	defer link.writeMut.Unlock()
+	if link.cipher == nil {
+		return errors.New("tunnel link is not ready, chId:" + link.ch.GetId())
+	}
+	return link.write(link.cipher.SealFrame(frame))
+}
+
+// write 写一帧，调用方持有writeMut
+func (link *tunnelLink) write(frame *mux.Frame) error {
+	packet := link.ch.NewPacket()
+	packet.SetData(frame.Encode())
+	wsPacket, ok := packet.(*tcpx.WsPacket)
+	if ok {
+		wsPacket.MsgType = websocket.BinaryMessage
+	}
+	return link.ch.Write(packet)
+}
+
+// readFrames 解帧并解密，握手帧在内部处理，解密失败说明密钥不一致，被篡改或者重放，返回错误
+func (link *tunnelLink) readFrames(data []byte) ([]*mux.Frame, error) {
+	frames, err := link.decoder.Feed(data)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*mux.Frame, 0, len(frames))
+	for _, frame := range frames {
+		if frame.Type == mux.FRAME_HELLO {
+			err = link.onHello(frame.Payload)
+			if err != nil {
+				return ret, err
+			}
+			continue
+		}
+		// cipher只在读协程中设置，无需加锁
+		if link.cipher == nil {
+			return ret, errors.New("tunnel link is not ready, chId:" + link.ch.GetId())
+		}
+		opened, err := link.cipher.OpenFrame(frame)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, opened)
+	}
+	return ret, nil
+}
+
+// encodeTunnelData FRAME_DATA的payload，首字节为ws消息类型，非ws为0
+func encodeTunnelData(packet channel.IPacket) []byte {
+	data := packet.GetData()
+	payload := make([]byte, len(data)+1)
+	wsPacket, ok := packet.(*tcpx.WsPacket)
+	if ok {
+		payload[0] = byte(wsPacket.MsgType)
+	}
+	copy(payload[1:], data)
+	return payload
+}
+
+// decodeTunnelData 解出ws消息类型和消息
+func decodeTunnelData(payload []byte) (int, []byte) {
+	if len(payload) <= 0 {
+		return 0, nil
+	}
+	return int(payload[0]), payload[1:]
+}
+
+// newTunnelDataPacket 按FRAME_DATA的payload创建ch的包，ws保持消息类型
+func newTunnelDataPacket(ch channel.IChannel, payload []byte) channel.IPacket {
+	msgType, data := decodeTunnelData(payload)
+	packet := ch.NewPacket()
+	packet.SetData(data)
+	wsPacket, ok := packet.(*tcpx.WsPacket)
+	if ok && msgType > 0 {
+		wsPacket.MsgType = msgType
+	}
+	return packet
+}
+
+// encodeTunnelClose FRAME_CLOSE的payload
+func encodeTunnelClose(info *CloseInfo) []byte {
+	payload, err := json.Marshal(info)
+	if err != nil {
+		logx.Warn("marshal close info error:", err)
+		return nil
+	}
+	return payload
+}
+
+// decodeTunnelClose 解出关闭信息，没有则视为异常断开
+func decodeTunnelClose(payload []byte) *CloseInfo {
+	info := &CloseInfo{}
+	if len(payload) <= 0 || json.Unmarshal(payload, info) != nil {
+		return NewCloseInfo(channel.NETWORK_UNKNOWN, CLOSE_CAUSE_RESET, 0, "tunnel session closed")
+	}
+	return info
+}
+
+type ITunnelConf interface {
+	IUpstreamConf
+
+	// GetDstClientConfs 核心agent的tunnel监听地址，按顺序选择第一个可连接的
+	GetDstClientConfs() []socket.IClientConf
+
+	// GetSecret 链路加密的共享密钥，和核心agent一致
+	GetSecret() string
+
+	// GetResumeTimeout 链路断开后会话的恢复时间，超过则关闭会话
+	GetResumeTimeout() time.Duration
+
+	// GetBufferSize 链路断开期间每个会话缓存的消息数，超过则关闭会话
+	GetBufferSize() int
+}
+
+// TunnelConf tunnel方式的upstream配置
+type TunnelConf struct {
+	UpstreamConf
+
+	DstClientConfs []socket.IClientConf
+
+	Secret string
+
+	ResumeTimeout time.Duration
+
+	BufferSize int
+}
+
+func NewTunnelConf(id string, secret string, dstClientConfs ...socket.IClientConf) *TunnelConf {
+	if len(dstClientConfs) <= 0 {
+		errMsg := "dstClientConfs are nil"
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	if len(secret) <= 0 {
+		errMsg := "tunnel secret is nil"
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	t := &TunnelConf{
+		DstClientConfs: dstClientConfs,
+		Secret:         secret,
+		ResumeTimeout:  default_tunnel_resume_timeout,
+		BufferSize:     default_tunnel_buffer_size,
+	}
+	t.UpstreamConf = *NewUpstreamConf(id, UPSTREAM_TUNNEL)
+	return t
+}
+
+func (tc *TunnelConf) GetDstClientConfs() []socket.IClientConf {
+	return tc.DstClientConfs
+}
+
+func (tc *TunnelConf) GetSecret() string {
+	return tc.Secret
+}
+
+func (tc *TunnelConf) GetResumeTimeout() time.Duration {
+	if tc.ResumeTimeout <= 0 {
+		return default_tunnel_resume_timeout
+	}
+	return tc.ResumeTimeout
+}
+
+func (tc *TunnelConf) GetBufferSize() int {
+	if tc.BufferSize <= 0 {
+		return default_tunnel_buffer_size
+	}
+	return tc.BufferSize
+}
+
+// tunnelSession tunnel方式的会话
+type tunnelSession struct {
+	sessionId uint32
+
+	meta *TunnelMeta
+
+	agentCh channel.IChannel
+
+	// 所在的链路，断开期间为nil
+	link *tunnelLink
+
+	// 链路断开期间缓存的FRAME_DATA的payload
+	pending [][]byte
+
+	// 链路断开的时间
+	detachTime time.Time
+
+	mut sync.Mutex
+}
+
+// Tunnel 边缘agent的tunnel方式的upstream
+type Tunnel struct {
+	Upstream
+
+	TunnelConf ITunnelConf
+
+	// tunnel实例id，核心agent据此区分不同的边缘agent
+	tunnelId string
+
+	link *tunnelLink
+
+	linkMut sync.RWMutex
+
+	// 串行建立链路，避免同时建立多条
+	connectMut sync.Mutex
+
+	// 会话id生成
+	sessionSeq uint32
+
+	// agentChId作为主键
+	agentSessions map[string]*tunnelSession
+
+	// sessionId作为主键
+	idSessions map[uint32]*tunnelSession
+
+	sessionMut sync.RWMutex
+
+	exit chan bool
+
+	startOnce sync.Once
+
+	stopOnce sync.Once
+}
+
+func NewTunnel(parent interface{}, tunnelConf ITunnelConf, extension IExtension) *Tunnel {
+	if len(tunnelConf.GetSecret()) <= 0 {
+		errMsg := "tunnel secret is nil"
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+	t := &Tunnel{
+		TunnelConf:    tunnelConf,
+		tunnelId:      hex.EncodeToString(idBytes),
+		agentSessions: make(map[string]*tunnelSession),
+		idSessions:    make(map[uint32]*tunnelSession),
+		exit:          make(chan bool),
+	}
+	t.Upstream = *NewUpstream(parent, tunnelConf, extension)
+	return t
+}
+
+// Start 预先建立链路，并在后台重连断开的链路和关闭超过恢复时间的会话
+func (t *Tunnel) Start() error {
+	t.startOnce.Do(func() {
+		t.maintain()
+		go t.loop()
+	})
+	return nil
+}
+
+// Stop 停止后台重连
+func (t *Tunnel) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.exit)
+	})
+}
+
+func (t *Tunnel) loop() {
+	defer func() {
+		ret := recover()
+		if ret != nil {
+			logx.Error("tunnel maintain error:", ret)
+		}
+	}()
+	ticker := time.NewTicker(tunnel_maintain_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.exit:
+			return
+		case <-ticker.C:
+			t.maintain()
+		}
+	}
+}
+
+// maintain 链路断开则重连并恢复会话，关闭超过恢复时间的会话
+func (t *Tunnel) maintain() {
+	link, err := t.connect()
+	if err == nil {
+		t.resumeSessions(link)
+	}
+	t.expireSessions()
+}
+
+// connect 获取当前链路，断开则按顺序连接核心agent，成功则作为当前链路
+func (t *Tunnel) connect() (*tunnelLink, error) {
+	t.connectMut.Lock()
+	defer t.connectMut.Unlock()
+	link := t.getLink()
+	if link != nil {
+		return link, nil
+	}
+	var err error
+	for _, dstClientConf := range t.TunnelConf.GetDstClientConfs() {
+		var link *tunnelLink
+		link, err = t.dial(dstClientConf)
+		t.GetDstStatis(dstClientConf).SetHealthy(err == nil)
+		if err == nil {
+			return link, nil
+		}
+		logx.Warnf("dial tunnel error, dst:%v, error:%v", dstClientConf.GetAddrStr(), err)
+	}
+	return nil, err
+}
+
+func (t *Tunnel) dial(dstClientConf socket.IClientConf) (*tunnelLink, error) {
+	handle := channel.NewDefChHandle(t.onLinkReadHandle)
+	handle.SetOnConnect(onChannelConnectHandle)
+	handle.SetOnRelease(t.onLinkInActiveHandle)
+	handle.SetOnError(onChannelErrorHandle)
+	clientConn := socket.NewClientSocket(t, dstClientConf, handle, nil)
+	err := clientConn.Dial()
+	if err != nil {
+		return nil, err
+	}
+	dstCh := clientConn.GetChannel()
+	link, err := newTunnelLink(dstCh, t.TunnelConf.GetSecret(), true)
+	if err != nil {
+		dstCh.Release()
+		return nil, err
+	}
+	// 先设置为当前链路，读协程据此处理握手帧，握手完成前getLink返回nil
+	t.linkMut.Lock()
+	t.link = link
+	t.linkMut.Unlock()
+	t.GetDstChannels().Put(dstCh.GetId(), dstCh)
+	err = link.hello()
+	if err == nil {
+		err = link.waitReady(tunnel_handshake_timeout)
+	}
+	if err != nil {
+		dstCh.Release()
+		return nil, err
+	}
+	logx.Info("open tunnel link, dstChId:", dstCh.GetId())
+	return link, nil
+}
+
+func (t *Tunnel) getLink() *tunnelLink {
+	t.linkMut.RLock()
+	defer t.linkMut.RUnlock()
+	if t.link == nil || t.link.ch.IsClosed() || !t.link.isReady() {
+		return nil
+	}
+	return t.link
+}
+
+// resumeSessions 链路重连后，以相同的会话id恢复断开期间的会话，并发送缓存的消息
+func (t *Tunnel) resumeSessions(link *tunnelLink) {
+	var sessions []*tunnelSession
+	t.sessionMut.RLock()
+	for _, session := range t.agentSessions {
+		sessions = append(sessions, session)
+	}
+	t.sessionMut.RUnlock()
+	resumed := 0
+	for _, session := range sessions {
+		session.mut.Lock()
+		if session.link == nil && t.attach(session, link) {
+			resumed++
+		}
+		session.mut.Unlock()
+	}
+	if resumed > 0 {
+		logx.Infof("resume tunnel sessions, dstChId:%v, resumed:%v", link.ch.GetId(), resumed)
+	}
+}
+
+// attach 会话绑定到链路，发送FRAME_OPEN和缓存的消息，调用方持有session.mut
+func (t *Tunnel) attach(session *tunnelSession, link *tunnelLink) bool {
+	payload, err := json.Marshal(session.meta)
+	if err != nil {
+		logx.Warn("marshal tunnel meta error:", err)
+		return false
+	}
+	err = link.writeFrame(mux.NewFrame(mux.FRAME_OPEN, session.sessionId, payload))
+	if err != nil {
+		logx.Warnf("write tunnel open frame error, sessionId:%v, error:%v", session.sessionId, err)
+		return false
+	}
+	for index, data := range session.pending {
+		err = link.writeFrame(mux.NewFrame(mux.FRAME_DATA, session.sessionId, data))
+		if err != nil {
+			// 未发送的消息继续缓存，等下次重连
+			session.pending = session.pending[index:]
+			return false
+		}
+	}
+	session.pending = nil
+	session.link = link
+	// 后续的连接都是恢复会话
+	session.meta.Resume = true
+	return true
+}
+
+// expireSessions 关闭链路断开超过恢复时间的会话
+func (t *Tunnel) expireSessions() {
+	resumeTimeout := t.TunnelConf.GetResumeTimeout()
+	var expired []*tunnelSession
+	t.sessionMut.RLock()
+	for _, session := range t.agentSessions {
+		session.mut.Lock()
+		if session.link == nil && time.Since(session.detachTime) >= resumeTimeout {
+			expired = append(expired, session)
+		}
+		session.mut.Unlock()
+	}
+	t.sessionMut.RUnlock()
+	for _, session := range expired {
+		logx.Infof("tunnel session expired, sessionId:%v, agentChId:%v", session.sessionId, session.agentCh.GetId())
+		t.closeSession(session, session.agentCh, NewCloseInfo(channel.NETWORK_UNKNOWN, CLOSE_CAUSE_RESET, 0, "tunnel link lost"))
+	}
+}
+
+// closeSession 移除会话，按映射后的关闭信息关闭agentChannel，
+// fromChannel为链路，本地原因(恢复超时，缓存已满)关闭时为agentChannel
+func (t *Tunnel) closeSession(session *tunnelSession, fromChannel channel.IChannel, info *CloseInfo) {
+	t.removeSession(session.agentCh.GetId())
+	agentCh := session.agentCh
+	if agentCh.IsClosed() {
+		return
+	}
+	info = mapCloseInfoBy(t.GetExtension(), fromChannel, agentCh, info)
+	if info != nil {
+		closeWithInfo(agentCh, info)
+	}
+	agentCh.Release()
+}
+
+// InitChannelPeer 为agentChannel分配会话id，并通过链路发送FRAME_OPEN帧，payload为会话的原始信息
+func (t *Tunnel) InitChannelPeer(agentCtx channel.IChHandleContext, params map[string]interface{}) {
+	agentCh := agentCtx.GetChannel()
+	agentChId := agentCh.GetId()
+	link, err := t.connect()
+	if err != nil {
+		logx.Error("connect tunnel error, agentChId:", agentChId)
+		return
+	}
+
+	meta := &TunnelMeta{
+		TunnelId: t.tunnelId,
+		Network:  agentCh.GetConf().GetNetwork().String(),
+		Path:     agentCh.GetRelativePath(),
+		Params:   params,
+	}
+	addr := agentCh.RemoteAddr()
+	if addr != nil {
+		meta.ClientAddr = addr.String()
+	}
+	session := &tunnelSession{
+		sessionId: atomic.AddUint32(&t.sessionSeq, 1),
+		meta:      meta,
+		agentCh:   agentCh,
+	}
+	session.mut.Lock()
+	ok := t.attach(session, link)
+	session.mut.Unlock()
+	if !ok {
+		logx.Error("open tunnel session error, agentChId:", agentChId)
+		return
+	}
+
+	t.sessionMut.Lock()
+	t.agentSessions[agentChId] = session
+	t.idSessions[session.sessionId] = session
+	t.sessionMut.Unlock()
+	agentCtx.SetRet(link.ch)
+	logx.Infof("finish tunnel initChannelPeer, agentChId:%v, sessionId:%v, dstChId:%v", agentChId, session.sessionId, link.ch.GetId())
+}
+
+// TransferAgentMsg 将agent端的消息封装为FRAME_DATA帧发送到链路，链路断开期间缓存，见IAgentMsgTransfer
+func (t *Tunnel) TransferAgentMsg(agentCtx channel.IChHandleContext) bool {
+	session := t.getSession(agentCtx.GetChannel().GetId())
+	if session == nil {
+		return false
+	}
+	payload := encodeTunnelData(agentCtx.GetPacket())
+	session.mut.Lock()
+	if session.link != nil {
+		err := session.link.writeFrame(mux.NewFrame(mux.FRAME_DATA, session.sessionId, payload))
+		if err == nil {
+			session.mut.Unlock()
+			return true
+		}
+		logx.Warnf("write tunnel data frame error, sessionId:%v, error:%v", session.sessionId, err)
+		t.detach(session)
+	}
+	overflow := len(session.pending) >= t.TunnelConf.GetBufferSize()
+	if !overflow {
+		session.pending = append(session.pending, payload)
+	}
+	session.mut.Unlock()
+	if overflow {
+		logx.Warnf("tunnel buffer is full, sessionId:%v", session.sessionId)
+		t.closeSession(session, session.agentCh, NewCloseInfo(channel.NETWORK_UNKNOWN, CLOSE_CAUSE_ERROR, 0, "tunnel buffer is full"))
+	}
+	return true
+}
+
+// detach 会话和链路解绑，开始计算恢复时间，调用方持有session.mut
+func (t *Tunnel) detach(session *tunnelSession) {
+	if session.link != nil {
+		session.link = nil
+		session.detachTime = time.Now()
+	}
+}
+
+func (t *Tunnel) getSession(agentChId string) *tunnelSession {
+	t.sessionMut.RLock()
+	defer t.sessionMut.RUnlock()
+	return t.agentSessions[agentChId]
+}
+
+// onLinkReadHandle 解帧后按会话id写回agentChannel，核心agent关闭会话则按关闭信息关闭agentChannel
+func (t *Tunnel) onLinkReadHandle(dstCtx channel.IChHandleContext) {
+	dstCh := dstCtx.GetChannel()
+	t.linkMut.RLock()
+	link := t.link
+	t.linkMut.RUnlock()
+	if link == nil || link.ch.GetId() != dstCh.GetId() {
+		logx.Warn("unknown tunnel link, dstChId:", dstCh.GetId())
+		return
+	}
+	frames, err := link.readFrames(dstCtx.GetPacket().GetData())
+	if err != nil {
+		logx.Errorf("read tunnel frame error, dstChId:%v, error:%v", dstCh.GetId(), err)
+	}
+	for _, frame := range frames {
+		t.sessionMut.RLock()
+		session := t.idSessions[frame.SessionId]
+		t.sessionMut.RUnlock()
+		if session == nil {
+			logx.Debugf("tunnel session is not existed, sessionId:%v, type:%v", frame.SessionId, frame.Type)
+			continue
+		}
+		agentCh := session.agentCh
+		switch frame.Type {
+		case mux.FRAME_DATA:
+			packet := newTunnelDataPacket(agentCh, frame.Payload)
+			syncAgentWrite(agentCh, func() {
+				agentCh.Write(packet)
+			})
+		case mux.FRAME_CLOSE:
+			t.closeSession(session, dstCh, decodeTunnelClose(frame.Payload))
+		default:
+			logx.Warnf("unexpected tunnel frame, sessionId:%v, type:%v", frame.SessionId, frame.Type)
+		}
+	}
+	if err != nil {
+		// 握手失败，密钥不一致，重放或者数据错乱，链路不可再用
+		dstCh.Release()
+	}
+}
+
+// onLinkInActiveHandle 链路断开
+func (t *Tunnel) onLinkInActiveHandle(dstCtx channel.IChHandleContext) {
+	t.ReleaseOnDstChannel(dstCtx)
+}
+
+// GetChannelPeer 会话可在链路间恢复，不绑定固定的dst端，没有channelpeer
+func (t *Tunnel) GetChannelPeer(ctx channel.IChHandleContext, isAgent bool) IChannelPeer {
+	return nil
+}
+
+func (t *Tunnel) QueryDstChannel(ctx channel.IChHandleContext) {
+	logx.Warn("tunnel session is not bound to dst channel.")
+}
+
+func (t *Tunnel) QueryAgentChannel(ctx channel.IChHandleContext) {
+	logx.Warn("tunnel link is shared, agent channel can not be queried.")
+}
+
+// ReleaseOnAgentChannel agentChannel关闭，发送FRAME_CLOSE帧，payload为关闭信息，链路保留
+func (t *Tunnel) ReleaseOnAgentChannel(agentCtx channel.IChHandleContext) {
+	session := t.removeSession(agentCtx.GetChannel().GetId())
+	if session == nil {
+		return
+	}
+	session.mut.Lock()
+	link := session.link
+	session.mut.Unlock()
+	if link != nil {
+		payload := encodeTunnelClose(GetCloseInfo(agentCtx.GetChannel()))
+		err := link.writeFrame(mux.NewFrame(mux.FRAME_CLOSE, session.sessionId, payload))
+		if err != nil {
+			logx.Debugf("write tunnel close frame error, sessionId:%v, error:%v", session.sessionId, err)
+		}
+	}
+}
+
+// ReleaseOnDstChannel 链路断开，其上的会话保留并开始计算恢复时间，由后台重连后恢复
+func (t *Tunnel) ReleaseOnDstChannel(dstCtx channel.IChHandleContext) {
+	dstChId := dstCtx.GetChannel().GetId()
+	t.linkMut.Lock()
+	if t.link != nil && t.link.ch.GetId() == dstChId {
+		t.link = nil
+	}
+	t.linkMut.Unlock()
+	t.GetDstChannels().Remove(dstChId)
+
+	detached := 0
+	t.sessionMut.RLock()
+	for _, session := range t.agentSessions {
+		session.mut.Lock()
+		if session.link != nil && session.link.ch.GetId() == dstChId {
+			t.detach(session)
+			detached++
+		}
+		session.mut.Unlock()
+	}
+	t.sessionMut.RUnlock()
+	logx.Infof("tunnel link closed, dstChId:%v, sessions:%v", dstChId, detached)
+}
+
+func (t *Tunnel) removeSession(agentChId string) *tunnelSession {
+	t.sessionMut.Lock()
+	defer t.sessionMut.Unlock()
+	session, found := t.agentSessions[agentChId]
+	if found {
+		delete(t.agentSessions, agentChId)
+		delete(t.idSessions, session.sessionId)
+	}
+	return session
+}
+
+// ReleaseChannelPeers 释放所有会话和链路
+func (t *Tunnel) ReleaseChannelPeers() {
+	t.sessionMut.Lock()
+	t.agentSessions = make(map[string]*tunnelSession)
+	t.idSessions = make(map[uint32]*tunnelSession)
+	t.sessionMut.Unlock()
+	t.linkMut.Lock()
+	t.link = nil
+	t.linkMut.Unlock()
+	t.Upstream.ReleaseChannelPeers()
+}
@@ -0,0 +1,514 @@
+/*
+ * 核心agent的tunnel监听，接收边缘agent的加密链路：
+ *  1、每个FRAME_OPEN创建一个虚拟的agentChannel(TunnelChannel)，使用原始的客户端地址，path和参数，
+ *     按AgServer正常的location和upstream处理，写入TunnelChannel的消息封装为FRAME_DATA发回边缘agent
+ *  2、链路断开后TunnelChannel保留，期间的消息缓存，边缘agent重连后以相同的tunnelId和会话id恢复，超过恢复时间则关闭
+ * Author:slive
+ * DATE:2021/4/28
+ */
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/slive/gsfly-agent/mux"
+	gch "github.com/slive/gsfly/channel"
+	"github.com/slive/gsfly/channel/tcpx"
+	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
+	"net"
+	"sync"
+	"time"
+)
+
+// TunnelServerConf 核心agent的tunnel监听配置
+type TunnelServerConf struct {
+	// 链路的监听配置
+	socket.IServerConf
+
+	// 链路加密的共享密钥，和边缘agent一致
+	Secret string
+
+	// 链路断开后会话的恢复时间，超过则关闭会话
+	ResumeTimeout time.Duration
+
+	// 链路断开期间每个会话缓存的消息数，超过则关闭会话
+	BufferSize int
+}
+
+func NewTunnelServerConf(serverConf socket.IServerConf, secret string) *TunnelServerConf {
+	if serverConf == nil {
+		errMsg := "tunnel serverConf is nil"
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	if len(secret) <= 0 {
+		errMsg := "tunnel secret is nil"
+		logx.Error(errMsg)
+		panic(errMsg)
+	}
+	return &TunnelServerConf{
+		IServerConf:   serverConf,
+		Secret:        secret,
+		ResumeTimeout: default_tunnel_resume_timeout,
+		BufferSize:    default_tunnel_buffer_size,
+	}
+}
+
+// TunnelServer 核心agent的tunnel监听
+type TunnelServer struct {
+	socket.ServerSocket
+
+	conf *TunnelServerConf
+
+	agServer *AgServer
+
+	// 链路channelId作为主键
+	links map[string]*tunnelLink
+
+	// tunnelId#sessionId作为主键
+	sessions map[string]*TunnelChannel
+
+	mut sync.Mutex
+
+	exit chan bool
+
+	stopOnce sync.Once
+}
+
+func NewTunnelServer(agServer *AgServer, conf *TunnelServerConf) *TunnelServer {
+	ts := &TunnelServer{
+		conf:     conf,
+		agServer: agServer,
+		links:    make(map[string]*tunnelLink),
+		sessions: make(map[string]*TunnelChannel),
+		exit:     make(chan bool),
+	}
+	handle := gch.NewDefChHandle(ts.onLinkReadHandle)
+	handle.SetOnConnect(onChannelConnectHandle)
+	handle.SetOnRelease(ts.onLinkInActiveHandle)
+	handle.SetOnError(onChannelErrorHandle)
+	ts.ServerSocket = *socket.NewServerSocket(agServer, conf.IServerConf, handle)
+	return ts
+}
+
+// Listen 监听链路，并在后台关闭超过恢复时间的会话
+func (ts *TunnelServer) Listen() error {
+	err := ts.ServerSocket.Listen()
+	if err == nil {
+		go ts.loop()
+	}
+	return err
+}
+
+// Close 关闭监听，链路和所有会话
+func (ts *TunnelServer) Close() {
+	ts.stopOnce.Do(func() {
+		close(ts.exit)
+	})
+	ts.ServerSocket.Close()
+	ts.mut.Lock()
+	var chs []*TunnelChannel
+	for _, ch := range ts.sessions {
+		chs = append(chs, ch)
+	}
+	ts.mut.Unlock()
+	for _, ch := range chs {
+		ch.Release()
+	}
+}
+
+func (ts *TunnelServer) loop() {
+	defer func() {
+		ret := recover()
+		if ret != nil {
+			logx.Error("tunnel server maintain error:", ret)
+		}
+	}()
+	ticker := time.NewTicker(tunnel_maintain_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ts.exit:
+			return
+		case <-ticker.C:
+			ts.expireSessions()
+		}
+	}
+}
+
+// expireSessions 关闭链路断开超过恢复时间的会话
+func (ts *TunnelServer) expireSessions() {
+	resumeTimeout := ts.conf.ResumeTimeout
+	if resumeTimeout <= 0 {
+		resumeTimeout = default_tunnel_resume_timeout
+	}
+	var expired []*TunnelChannel
+	ts.mut.Lock()
+	for _, ch := range ts.sessions {
+		if ch.isExpired(resumeTimeout) {
+			expired = append(expired, ch)
+		}
+	}
+	ts.mut.Unlock()
+	for _, ch := range expired {
+		logx.Info("tunnel session expired, chId:", ch.GetId())
+		recordCloseInfo(ch, NewCloseInfo(gch.NETWORK_UNKNOWN, CLOSE_CAUSE_RESET, 0, "tunnel link lost"))
+		ch.Release()
+	}
+}
+
+// getLink 获取链路，首次收到数据时创建，等待边缘agent的握手
+func (ts *TunnelServer) getLink(linkCh gch.IChannel) (*tunnelLink, error) {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	link, found := ts.links[linkCh.GetId()]
+	if !found {
+		var err error
+		link, err = newTunnelLink(linkCh, ts.conf.Secret, false)
+		if err != nil {
+			return nil, err
+		}
+		ts.links[linkCh.GetId()] = link
+	}
+	return link, nil
+}
+
+// onLinkReadHandle 解帧后按帧类型打开，转发或者关闭会话
+func (ts *TunnelServer) onLinkReadHandle(linkCtx gch.IChHandleContext) {
+	linkCh := linkCtx.GetChannel()
+	link, err := ts.getLink(linkCh)
+	if err != nil {
+		logx.Errorf("create tunnel link error, linkChId:%v, error:%v", linkCh.GetId(), err)
+		linkCh.Release()
+		return
+	}
+	frames, err := link.readFrames(linkCtx.GetPacket().GetData())
+	if err != nil {
+		logx.Errorf("read tunnel frame error, linkChId:%v, error:%v", linkCh.GetId(), err)
+	}
+	for _, frame := range frames {
+		switch frame.Type {
+		case mux.FRAME_OPEN:
+			ts.openSession(link, frame)
+		case mux.FRAME_DATA:
+			ch := ts.getSession(link, frame.SessionId)
+			if ch == nil {
+				logx.Debug("tunnel session is not existed, sessionId:", frame.SessionId)
+				continue
+			}
+			ch.onData(frame.Payload)
+		case mux.FRAME_CLOSE:
+			ch := ts.getSession(link, frame.SessionId)
+			if ch == nil {
+				continue
+			}
+			ch.peerClosed = true
+			recordCloseInfo(ch, decodeTunnelClose(frame.Payload))
+			ch.Release()
+		default:
+			logx.Warnf("unexpected tunnel frame, sessionId:%v, type:%v", frame.SessionId, frame.Type)
+		}
+	}
+	if err != nil {
+		// 握手失败，密钥不一致，重放或者数据错乱，链路不可再用
+		linkCh.Release()
+	}
+}
+
+// openSession 新的会话创建TunnelChannel并按location路由，恢复的会话绑定到新的链路
+func (ts *TunnelServer) openSession(link *tunnelLink, frame *mux.Frame) {
+	meta := &TunnelMeta{}
+	err := json.Unmarshal(frame.Payload, meta)
+	if err != nil || len(meta.TunnelId) <= 0 {
+		logx.Warnf("tunnel meta is invalid, sessionId:%v, error:%v", frame.SessionId, err)
+		return
+	}
+	key := fmt.Sprintf("%v#%v", meta.TunnelId, frame.SessionId)
+	ts.mut.Lock()
+	// 同一条链路只来自一个边缘agent
+	link.tunnelId = meta.TunnelId
+	ch, found := ts.sessions[key]
+	ts.mut.Unlock()
+
+	if meta.Resume {
+		if !found {
+			// 已超过恢复时间或者核心agent已重启，通知边缘agent关闭会话
+			logx.Info("tunnel session can not be resumed, key:", key)
+			info := NewCloseInfo(gch.NETWORK_UNKNOWN, CLOSE_CAUSE_RESET, 0, "tunnel session expired")
+			link.writeFrame(mux.NewFrame(mux.FRAME_CLOSE, frame.SessionId, encodeTunnelClose(info)))
+			return
+		}
+		ch.attach(link)
+		logx.Info("resume tunnel session, chId:", ch.GetId())
+		return
+	}
+	if found {
+		ch.Release()
+	}
+
+	ch = NewTunnelChannel(ts, link, key, frame.SessionId, meta)
+	ts.mut.Lock()
+	ts.sessions[key] = ch
+	ts.mut.Unlock()
+	ts.agServer.GetChannels().Put(ch.GetId(), ch)
+	err = ch.Open()
+	if err != nil {
+		logx.Errorf("open tunnel channel error, chId:%v, error:%v", ch.GetId(), err)
+		ch.Release()
+	}
+}
+
+func (ts *TunnelServer) getSession(link *tunnelLink, sessionId uint32) *TunnelChannel {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	return ts.sessions[fmt.Sprintf("%v#%v", link.tunnelId, sessionId)]
+}
+
+func (ts *TunnelServer) removeSession(ch *TunnelChannel) {
+	ts.mut.Lock()
+	if ts.sessions[ch.key] == ch {
+		delete(ts.sessions, ch.key)
+	}
+	ts.mut.Unlock()
+	ts.agServer.GetChannels().Remove(ch.GetId())
+}
+
+// onLinkInActiveHandle 链路断开，其上的会话保留并开始计算恢复时间
+func (ts *TunnelServer) onLinkInActiveHandle(linkCtx gch.IChHandleContext) {
+	linkChId := linkCtx.GetChannel().GetId()
+	ts.mut.Lock()
+	link := ts.links[linkChId]
+	delete(ts.links, linkChId)
+	var chs []*TunnelChannel
+	for _, ch := range ts.sessions {
+		chs = append(chs, ch)
+	}
+	ts.mut.Unlock()
+	if link == nil {
+		return
+	}
+	detached := 0
+	for _, ch := range chs {
+		if ch.detach(link) {
+			detached++
+		}
+	}
+	logx.Infof("tunnel link closed, linkChId:%v, sessions:%v", linkChId, detached)
+}
+
+// tunnelAddr 客户端的原始地址
+type tunnelAddr struct {
+	network string
+
+	addr string
+}
+
+func (addr *tunnelAddr) Network() string {
+	return addr.network
+}
+
+func (addr *tunnelAddr) String() string {
+	return addr.addr
+}
+
+// TunnelChannel tunnel会话在核心agent的虚拟agentChannel，没有读协程，消息由链路的读协程分发
+type TunnelChannel struct {
+	gch.Channel
+
+	server *TunnelServer
+
+	// tunnelId#sessionId
+	key string
+
+	sessionId uint32
+
+	meta *TunnelMeta
+
+	// 所在的链路，断开期间为nil
+	link *tunnelLink
+
+	// 链路断开期间缓存的FRAME_DATA的payload
+	pending [][]byte
+
+	// 链路断开的时间
+	detachTime time.Time
+
+	// 边缘agent已关闭会话，释放时不再发送FRAME_CLOSE
+	peerClosed bool
+
+	mut sync.Mutex
+}
+
+func NewTunnelChannel(server *TunnelServer, link *tunnelLink, key string, sessionId uint32, meta *TunnelMeta) *TunnelChannel {
+	network := gch.ToNetwork(meta.Network)
+	if network == gch.NETWORK_UNKNOWN {
+		network = gch.NETWORK_TCP
+	}
+	ch := &TunnelChannel{
+		server:    server,
+		key:       key,
+		sessionId: sessionId,
+		meta:      meta,
+		link:      link,
+	}
+	chConf := gch.NewDefChannelConf(network)
+	ch.Channel = *gch.NewDefChannel(server.agServer, chConf, server.agServer.GetChHandle().(*gch.ChHandle), true)
+	ch.SetId("tunnel#" + key)
+	ch.SetRelativePath(meta.Path)
+	return ch
+}
+
+// Open 激活会话，按AgServer的location和upstream处理，dst端总是异步拨号，不阻塞链路的读协程
+func (ch *TunnelChannel) Open() error {
+	if !ch.IsClosed() {
+		return errors.New("tunnel channel had open, chId:" + ch.GetId())
+	}
+	ch.SetClosed(false)
+	ctx := gch.NewChHandleContext(ch, nil)
+	gch.HandleOnConnnect(ctx)
+	gerr := ctx.GetError()
+	if gerr != nil {
+		return gerr
+	}
+	return nil
+}
+
+// Release 释放会话，边缘agent未关闭的则发送FRAME_CLOSE，payload为关闭信息
+func (ch *TunnelChannel) Release() {
+	if ch.IsClosed() {
+		return
+	}
+	ch.server.removeSession(ch)
+	ch.mut.Lock()
+	link := ch.link
+	ch.link = nil
+	ch.pending = nil
+	ch.mut.Unlock()
+	if link != nil && !ch.peerClosed {
+		payload := encodeTunnelClose(GetCloseInfo(ch))
+		err := link.writeFrame(mux.NewFrame(mux.FRAME_CLOSE, ch.sessionId, payload))
+		if err != nil {
+			logx.Debugf("write tunnel close frame error, chId:%v, error:%v", ch.GetId(), err)
+		}
+	}
+	ch.StopChannel(ch)
+}
+
+// onData 链路收到的消息，按agentChannel收到的消息处理
+func (ch *TunnelChannel) onData(payload []byte) {
+	if ch.IsClosed() {
+		return
+	}
+	packet := newTunnelDataPacket(ch, payload)
+	gch.RevStatis(packet, true)
+	ctx := gch.NewChHandleContext(ch, packet)
+	defer func() {
+		ret := recover()
+		if ret != nil {
+			logx.Errorf("handle tunnel data error, chId:%v, error:%v", ch.GetId(), ret)
+			gch.HandleMsgStatis(packet, false)
+		}
+	}()
+	ch.GetChHandle().GetOnRead()(ctx)
+	gch.HandleMsgStatis(packet, ctx.GetError() == nil)
+}
+
+// WriteByConn 封装为FRAME_DATA写到链路，链路断开期间缓存，超过缓存数则关闭会话
+func (ch *TunnelChannel) WriteByConn(packet gch.IPacket) error {
+	payload := encodeTunnelData(packet)
+	ch.mut.Lock()
+	if ch.link != nil {
+		err := ch.link.writeFrame(mux.NewFrame(mux.FRAME_DATA, ch.sessionId, payload))
+		if err == nil {
+			ch.mut.Unlock()
+			return nil
+		}
+		logx.Warnf("write tunnel data frame error, chId:%v, error:%v", ch.GetId(), err)
+		ch.link = nil
+		ch.detachTime = time.Now()
+	}
+	bufferSize := ch.server.conf.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = default_tunnel_buffer_size
+	}
+	overflow := len(ch.pending) >= bufferSize
+	if !overflow {
+		ch.pending = append(ch.pending, payload)
+	}
+	ch.mut.Unlock()
+	if overflow {
+		recordCloseInfo(ch, NewCloseInfo(gch.NETWORK_UNKNOWN, CLOSE_CAUSE_ERROR, 0, "tunnel buffer is full"))
+		ch.Release()
+		return errors.New("tunnel buffer is full, chId:" + ch.GetId())
+	}
+	return nil
+}
+
+// attach 边缘agent恢复会话，绑定到新的链路并发送缓存的消息
+func (ch *TunnelChannel) attach(link *tunnelLink) {
+	ch.mut.Lock()
+	defer ch.mut.Unlock()
+	for index, payload := range ch.pending {
+		err := link.writeFrame(mux.NewFrame(mux.FRAME_DATA, ch.sessionId, payload))
+		if err != nil {
+			ch.pending = ch.pending[index:]
+			return
+		}
+	}
+	ch.pending = nil
+	ch.link = link
+}
+
+// detach 所在的链路断开，开始计算恢复时间
+func (ch *TunnelChannel) detach(link *tunnelLink) bool {
+	ch.mut.Lock()
+	defer ch.mut.Unlock()
+	if ch.link != link {
+		return false
+	}
+	ch.link = nil
+	ch.detachTime = time.Now()
+	return true
+}
+
+func (ch *TunnelChannel) isExpired(resumeTimeout time.Duration) bool {
+	ch.mut.Lock()
+	defer ch.mut.Unlock()
+	return ch.link == nil && time.Since(ch.detachTime) >= resumeTimeout
+}
+
+// NewPacket ws协议的会话创建ws包，保持消息类型
+func (ch *TunnelChannel) NewPacket() gch.IPacket {
+	network := ch.GetConf().GetNetwork()
+	if network == gch.NETWORK_WS {
+		w := &tcpx.WsPacket{}
+		w.Packet = *gch.NewPacket(ch, network)
+		w.MsgType = websocket.TextMessage
+		return w
+	}
+	return gch.NewPacket(ch, network)
+}
+
+// RemoteAddr 客户端的原始地址
+func (ch *TunnelChannel) RemoteAddr() net.Addr {
+	if len(ch.meta.ClientAddr) <= 0 {
+		return nil
+	}
+	return &tunnelAddr{network: ch.meta.Network, addr: ch.meta.ClientAddr}
+}
+
+// GetParams 客户端连接的参数
+func (ch *TunnelChannel) GetParams() map[string]interface{} {
+	if ch.meta.Params == nil {
+		return make(map[string]interface{})
+	}
+	return ch.meta.Params
+}
+
+// GetMeta 会话的原始信息
+func (ch *TunnelChannel) GetMeta() *TunnelMeta {
+	return ch.meta
+}
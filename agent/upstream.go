@@ -9,7 +9,11 @@ import (
 	"github.com/slive/gsfly/channel"
 	"github.com/slive/gsfly/common"
 	logx "github.com/slive/gsfly/logger"
+	"github.com/slive/gsfly/socket"
 	"github.com/emirpasic/gods/maps/hashmap"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // IUpstream upstream接口
@@ -45,8 +49,26 @@ type IUpstream interface {
 	// ReleaseChannelPeers 释放所有channelpeer
 	ReleaseChannelPeers()
 
+	// Start 启动upstream相关的后台任务，如健康检查
+	Start() error
+
+	// Stop 停止upstream相关的后台任务
+	Stop()
+
 	// GetExtension 获取扩展点
 	GetExtension() IExtension
+
+	// GetDstStatis 获取dst端的统计信息，不存在则创建
+	GetDstStatis(dstClientConf socket.IClientConf) *DstStatis
+
+	// IsDstHealthy dst端是否健康
+	IsDstHealthy(dstClientConf socket.IClientConf) bool
+}
+
+// IAgentMsgTransfer 可选接口，upstream自行处理agent端消息的转发，如多路复用需要对消息分帧
+type IAgentMsgTransfer interface {
+	// TransferAgentMsg 转发agent端的消息，返回false则表示未处理
+	TransferAgentMsg(agentCtx channel.IChHandleContext) bool
 }
 
 type Upstream struct {
@@ -55,7 +77,7 @@ type Upstream struct {
 	// 配置
 	conf IUpstreamConf
 
-	// 记录目标端channel，可以复用
+	// 记录已使用的目标端channel，预先拨号可复用的空闲连接见DstPool
 	dstChannels *hashmap.Map
 
 	// 记录channelpeer
@@ -63,6 +85,11 @@ type Upstream struct {
 
 	// 扩展点
 	extension IExtension
+
+	// dst端的统计信息，dstClientConf作为主键
+	dstStatises map[socket.IClientConf]*DstStatis
+
+	statisMut sync.RWMutex
 }
 
 // NewUpstream 创建upstream对象
@@ -80,6 +107,7 @@ func NewUpstream(parent interface{}, upstreamConf IUpstreamConf, extension IExte
 		conf:         upstreamConf,
 		dstChannels:  hashmap.New(),
 		channelPeers: hashmap.New(),
+		dstStatises:  make(map[socket.IClientConf]*DstStatis),
 	}
 	u.SetParent(parent)
 	if extension == nil {
@@ -114,6 +142,39 @@ func (ups *Upstream) GetExtension() IExtension {
 	return ups.extension
 }
 
+// Start 默认空实现
+func (ups *Upstream) Start() error {
+	return nil
+}
+
+// Stop 默认空实现
+func (ups *Upstream) Stop() {
+}
+
+// GetDstStatis 获取dst端的统计信息，不存在则创建
+func (ups *Upstream) GetDstStatis(dstClientConf socket.IClientConf) *DstStatis {
+	ups.statisMut.RLock()
+	statis, found := ups.dstStatises[dstClientConf]
+	ups.statisMut.RUnlock()
+	if found {
+		return statis
+	}
+
+	ups.statisMut.Lock()
+	defer ups.statisMut.Unlock()
+	statis, found = ups.dstStatises[dstClientConf]
+	if !found {
+		statis = NewDstStatis()
+		ups.dstStatises[dstClientConf] = statis
+	}
+	return statis
+}
+
+// IsDstHealthy dst端是否健康
+func (ups *Upstream) IsDstHealthy(dstClientConf socket.IClientConf) bool {
+	return ups.GetDstStatis(dstClientConf).IsHealthy()
+}
+
 func InnerQueryDstChannel(b IUpstream, ctx channel.IChHandleContext) {
 	ret := b.GetChannelPeer(ctx, true)
 	if ret != nil {
@@ -162,6 +223,12 @@ type IChannelPeer interface {
 
 	GetDstChannel() channel.IChannel
 
+	// GetDstClientConf 获取dstChannel对应的dstClient配置，可能为空
+	GetDstClientConf() socket.IClientConf
+
+	// GetCreateTime 获取channel对的创建时间
+	GetCreateTime() time.Time
+
 	common.IAttact
 }
 
@@ -171,6 +238,13 @@ type ChannelPeer struct {
 
 	dstChannel channel.IChannel
 
+	dstClientConf socket.IClientConf
+
+	createTime time.Time
+
+	// 最早一次未响应的发送时间，单位ns，用于统计消息往返耗时
+	sendTime int64
+
 	common.Attact
 }
 
@@ -178,6 +252,8 @@ func NewChannelPeer(agentChannel, dstChannel channel.IChannel) *ChannelPeer {
 	return &ChannelPeer{
 		agentChannel: agentChannel,
 		dstChannel:   dstChannel,
+		createTime:   time.Now(),
+		Attact:       *common.NewAttact(),
 	}
 }
 
@@ -188,3 +264,29 @@ func (cp *ChannelPeer) GetAgentChannel() channel.IChannel {
 func (cp *ChannelPeer) GetDstChannel() channel.IChannel {
 	return cp.dstChannel
 }
+
+func (cp *ChannelPeer) GetDstClientConf() socket.IClientConf {
+	return cp.dstClientConf
+}
+
+func (cp *ChannelPeer) GetCreateTime() time.Time {
+	return cp.createTime
+}
+
+func (cp *ChannelPeer) SetDstClientConf(dstClientConf socket.IClientConf) {
+	cp.dstClientConf = dstClientConf
+}
+
+// markSend 记录发送时间，已有未响应的发送则不覆盖
+func (cp *ChannelPeer) markSend() {
+	atomic.CompareAndSwapInt64(&cp.sendTime, 0, time.Now().UnixNano())
+}
+
+// takeRtt 收到响应后，获取消息往返耗时，没有未响应的发送则返回false
+func (cp *ChannelPeer) takeRtt() (time.Duration, bool) {
+	sendTime := atomic.SwapInt64(&cp.sendTime, 0)
+	if sendTime <= 0 {
+		return 0, false
+	}
+	return time.Duration(time.Now().UnixNano() - sendTime), true
+}
@@ -58,10 +58,24 @@ func InitServiceConf(config map[string]string) []agent.IServiceConf {
 	upstreamConfs := initUpstreamConfs(config)
 	logx.Info("upstreamConfs:", upstreamConfs)
 
+	// server的标签，如"agent.server.tag.zone=a"
+	serverTags := initTags(config, serverTagKey)
+	logx.Info("serverTags:", serverTags)
+
+	asyncDialConf := initAsyncDialConf(config)
+
+	tunnelServerConf := initTunnelServerConf(config, agentId, channelConf)
+
+	filterConfs := initFilterConfs(config)
+
 	serviceConfs := make([]agent.IServiceConf, len(serverConfs))
 	for index, sconf := range serverConfs {
 		agServerConf := agent.NewAgServerConf(agentId, sconf, locations...)
+		agServerConf.Tags = serverTags
+		agServerConf.AsyncDialConf = asyncDialConf
+		agServerConf.TunnelServerConf = tunnelServerConf
 		serviceConf := agent.NewServiceConf(agentId, agServerConf, upstreamConfs...)
+		serviceConf.AddFilterConf(filterConfs...)
 		serviceConfs[index] = serviceConf
 	}
 	return serviceConfs
@@ -153,7 +167,75 @@ func initUpstreamConfs(config map[string]string) []agent.IUpstreamConf {
 				loadBalanceStr := upstreamMap[upsLbKey]
 				delete(upstreamMap, upsLbKey)
 
+				// 慢启动时长，单位s
+				upsSlowStartKey := upsPrefix + upsId + ".slowStart"
+				slowStart := parseIntConf(upstreamMap, upsSlowStartKey, 0)
+
+				// 会话亲和的key和有效期(单位s)
+				upsAffinityKey := upsPrefix + upsId + ".affinity.key"
+				affinityKey := upstreamMap[upsAffinityKey]
+				delete(upstreamMap, upsAffinityKey)
+				upsAffinityTtlKey := upsPrefix + upsId + ".affinity.ttl"
+				affinityTtl := parseIntConf(upstreamMap, upsAffinityTtlKey, 0)
+
+				// 就近负载均衡的标签名和阈值
+				upsZoneTagKey := upsPrefix + upsId + ".zone.tag"
+				zoneTag := upstreamMap[upsZoneTagKey]
+				delete(upstreamMap, upsZoneTagKey)
+				upsZoneThresholdKey := upsPrefix + upsId + ".zone.threshold"
+				zoneThreshold := parseFloatConf(upstreamMap, upsZoneThresholdKey, -1)
+
+				healthCheckConf := initHealthCheckConf(upstreamMap, upsPrefix+upsId+".healthCheck.")
+				outlierConf := initOutlierConf(upstreamMap, upsPrefix+upsId+".outlier.")
+				breakerConf := initBreakerConf(upstreamMap, upsPrefix+upsId+".breaker.")
+				retryConf := initRetryConf(upstreamMap, upsPrefix+upsId+".retry.")
+				poolConf := initDstPoolConf(upstreamMap, upsPrefix+upsId+".pool.")
+				reconnectConf := initReconnectConf(upstreamMap, upsPrefix+upsId+".reconnect.")
+
+				// 多路复用方式下每个dstclient的长连接数
+				upsMuxPoolSizeKey := upsPrefix + upsId + ".mux.poolSize"
+				muxPoolSize := parseIntConf(upstreamMap, upsMuxPoolSizeKey, 0)
+
+				// 广播方式下dstclient断开时的处理方式
+				upsDropPolicyKey := upsPrefix + upsId + ".broadcast.dropPolicy"
+				dropPolicy := upstreamMap[upsDropPolicyKey]
+				delete(upstreamMap, upsDropPolicyKey)
+
+				// 请求/响应关联方式下请求id的配置
+				rpcPrefix := upsPrefix + upsId + ".rpc."
+				rpcIdTypeKey := rpcPrefix + "idType"
+				rpcIdType := upstreamMap[rpcIdTypeKey]
+				delete(upstreamMap, rpcIdTypeKey)
+				rpcIdFieldKey := rpcPrefix + "idField"
+				rpcIdField := upstreamMap[rpcIdFieldKey]
+				delete(upstreamMap, rpcIdFieldKey)
+				rpcIdOffset := parseIntConf(upstreamMap, rpcPrefix+"idOffset", 0)
+				rpcIdLength := parseIntConf(upstreamMap, rpcPrefix+"idLength", 0)
+				rpcTimeout := parseIntConf(upstreamMap, rpcPrefix+"timeout", 0)
+				rpcPoolSize := parseIntConf(upstreamMap, rpcPrefix+"poolSize", 0)
+
+				// 发布/订阅方式下topic的参数名和字段名
+				hubPrefix := upsPrefix + upsId + ".hub."
+				hubTopicParamKey := hubPrefix + "topicParam"
+				hubTopicParam := upstreamMap[hubTopicParamKey]
+				delete(upstreamMap, hubTopicParamKey)
+				hubTopicFieldKey := hubPrefix + "topicField"
+				hubTopicField := upstreamMap[hubTopicFieldKey]
+				delete(upstreamMap, hubTopicFieldKey)
+				hubActionFieldKey := hubPrefix + "actionField"
+				hubActionField := upstreamMap[hubActionFieldKey]
+				delete(upstreamMap, hubActionFieldKey)
+
+				// agent之间tunnel方式下链路的共享密钥，恢复时间和缓存数
+				tunnelPrefix := upsPrefix + upsId + ".tunnel."
+				tunnelSecretKey := tunnelPrefix + "secret"
+				tunnelSecret := upstreamMap[tunnelSecretKey]
+				delete(upstreamMap, tunnelSecretKey)
+				tunnelResumeTimeout := parseIntConf(upstreamMap, tunnelPrefix+"resumeTimeout", 0)
+				tunnelBufferSize := parseIntConf(upstreamMap, tunnelPrefix+"bufferSize", 0)
+
 				var dstClientConfs []socket.IClientConf
+				var dstClientAttrs []*agent.DstClientAttr
 				dtsKey := upsPrefix + upsId + ".dstclient"
 				var loadbalance agent.LoadBalanceType
 				var err error
@@ -225,13 +307,82 @@ func initUpstreamConfs(config map[string]string) []agent.IUpstreamConf {
 						} else {
 							dstClientConfs = append(dstClientConfs, dstClientConf)
 						}
+						dstClientAttrs = append(dstClientAttrs, initDstClientAttr(upstreamMap, indexKey))
 					}
 					dstIndex++
 				}
 
 				var upstreamConf agent.IUpstreamConf
 				if (len(upsType) <= 0 || upsType == agent.UPSTREAM_PROXY) && (dstClientConfs != nil) {
-					upstreamConf = agent.NewProxyConf(upsId, loadbalance, dstClientConfs...)
+					proxyConf := agent.NewProxyConf(upsId, loadbalance, dstClientConfs...)
+					if len(loadBalanceStr) > 0 {
+						// 可能是扩展注册的自定义负载均衡，见agent.RegisterLoadBalance
+						proxyConf.LoadBalanceName = loadBalanceStr
+					}
+					proxyConf.SlowStart = time.Duration(slowStart) * time.Second
+					proxyConf.AffinityKey = affinityKey
+					proxyConf.AffinityTtl = time.Duration(affinityTtl) * time.Second
+					if len(zoneTag) > 0 {
+						proxyConf.ZoneTag = zoneTag
+					}
+					if zoneThreshold >= 0 {
+						proxyConf.ZoneThreshold = zoneThreshold
+					}
+					proxyConf.HealthCheckConf = healthCheckConf
+					proxyConf.OutlierConf = outlierConf
+					proxyConf.BreakerConf = breakerConf
+					proxyConf.RetryConf = retryConf
+					proxyConf.DstPoolConf = poolConf
+					proxyConf.ReconnectConf = reconnectConf
+					for index, dstClientConf := range dstClientConfs {
+						proxyConf.SetDstClientAttr(dstClientConf, dstClientAttrs[index])
+					}
+					upstreamConf = proxyConf
+				} else if upsType == agent.UPSTREAM_BROADCAST && (dstClientConfs != nil) {
+					upstreamConf = agent.NewBroadcastConf(upsId, dropPolicy, dstClientConfs...)
+				} else if upsType == agent.UPSTREAM_MULTIPLEX && (dstClientConfs != nil) {
+					upstreamConf = agent.NewMultiplexConf(upsId, muxPoolSize, dstClientConfs...)
+				} else if upsType == agent.UPSTREAM_RPC && (dstClientConfs != nil) {
+					rpcConf := agent.NewRpcConf(upsId, rpcIdType, dstClientConfs...)
+					if len(rpcIdField) > 0 {
+						rpcConf.IdField = rpcIdField
+					}
+					rpcConf.IdOffset = rpcIdOffset
+					if rpcIdLength > 0 {
+						rpcConf.IdLength = rpcIdLength
+					}
+					if rpcTimeout > 0 {
+						rpcConf.Timeout = time.Duration(rpcTimeout) * time.Millisecond
+					}
+					if rpcPoolSize > 0 {
+						rpcConf.PoolSize = rpcPoolSize
+					}
+					upstreamConf = rpcConf
+				} else if upsType == agent.UPSTREAM_MOCK {
+					// 不需要后端
+					upstreamConf = agent.NewMockConf(upsId, initMockRules(upstreamMap, upsPrefix+upsId+".mock.rule.")...)
+				} else if upsType == agent.UPSTREAM_HUB {
+					// 后端可为空，只使用进程内发布
+					hubConf := agent.NewHubConf(upsId, dstClientConfs...)
+					if len(hubTopicParam) > 0 {
+						hubConf.TopicParam = hubTopicParam
+					}
+					if len(hubTopicField) > 0 {
+						hubConf.TopicField = hubTopicField
+					}
+					if len(hubActionField) > 0 {
+						hubConf.ActionField = hubActionField
+					}
+					upstreamConf = hubConf
+				} else if upsType == agent.UPSTREAM_TUNNEL && (dstClientConfs != nil) {
+					tunnelConf := agent.NewTunnelConf(upsId, tunnelSecret, dstClientConfs...)
+					if tunnelResumeTimeout > 0 {
+						tunnelConf.ResumeTimeout = time.Duration(tunnelResumeTimeout) * time.Millisecond
+					}
+					if tunnelBufferSize > 0 {
+						tunnelConf.BufferSize = tunnelBufferSize
+					}
+					upstreamConf = tunnelConf
 				} else {
 					// TODO...
 				}
@@ -247,7 +398,299 @@ func initUpstreamConfs(config map[string]string) []agent.IUpstreamConf {
 	return upstreamConfs
 }
 
+// initHealthCheckConf 初始化健康检查配置，未启用则返回nil
+func initHealthCheckConf(upstreamMap map[string]string, hcPrefix string) *agent.HealthCheckConf {
+	enableKey := hcPrefix + "enable"
+	enableStr := upstreamMap[enableKey]
+	delete(upstreamMap, enableKey)
+	intervalKey := hcPrefix + "interval"
+	interval := parseIntConf(upstreamMap, intervalKey, 0)
+	timeoutKey := hcPrefix + "timeout"
+	timeout := parseIntConf(upstreamMap, timeoutKey, 0)
+	riseKey := hcPrefix + "rise"
+	rise := parseIntConf(upstreamMap, riseKey, 0)
+	fallKey := hcPrefix + "fall"
+	fall := parseIntConf(upstreamMap, fallKey, 0)
+	payloadKey := hcPrefix + "payload"
+	payload := upstreamMap[payloadKey]
+	delete(upstreamMap, payloadKey)
+	expectKey := hcPrefix + "expect"
+	expect := upstreamMap[expectKey]
+	delete(upstreamMap, expectKey)
+
+	enable, err := strconv.ParseBool(enableStr)
+	if err != nil || !enable {
+		return nil
+	}
+	hcConf := agent.NewHealthCheckConf(time.Duration(interval)*time.Second, time.Duration(timeout)*time.Second, rise, fall)
+	hcConf.Payload = payload
+	hcConf.Expect = expect
+	logx.Info("healthCheckConf:", hcConf)
+	return hcConf
+}
+
+// initOutlierConf 初始化被动异常检测配置，未启用则返回nil
+func initOutlierConf(upstreamMap map[string]string, outlierPrefix string) *agent.OutlierConf {
+	enableKey := outlierPrefix + "enable"
+	enableStr := upstreamMap[enableKey]
+	delete(upstreamMap, enableKey)
+	consecutiveErrorsKey := outlierPrefix + "consecutiveErrors"
+	consecutiveErrors := parseIntConf(upstreamMap, consecutiveErrorsKey, 0)
+	shortLivedKey := outlierPrefix + "shortLived"
+	shortLived := parseIntConf(upstreamMap, shortLivedKey, 0)
+	baseEjectionKey := outlierPrefix + "baseEjection"
+	baseEjection := parseIntConf(upstreamMap, baseEjectionKey, 0)
+	maxEjectionKey := outlierPrefix + "maxEjection"
+	maxEjection := parseIntConf(upstreamMap, maxEjectionKey, 0)
+
+	enable, err := strconv.ParseBool(enableStr)
+	if err != nil || !enable {
+		return nil
+	}
+	outlierConf := agent.NewOutlierConf(consecutiveErrors, time.Duration(shortLived)*time.Second,
+		time.Duration(baseEjection)*time.Second, time.Duration(maxEjection)*time.Second)
+	logx.Info("outlierConf:", outlierConf)
+	return outlierConf
+}
+
+// initBreakerConf 初始化熔断配置，未启用则返回nil
+func initBreakerConf(upstreamMap map[string]string, breakerPrefix string) *agent.BreakerConf {
+	enableKey := breakerPrefix + "enable"
+	enableStr := upstreamMap[enableKey]
+	delete(upstreamMap, enableKey)
+	errorRatioKey := breakerPrefix + "errorRatio"
+	errorRatio := parseFloatConf(upstreamMap, errorRatioKey, 0)
+	minRequestsKey := breakerPrefix + "minRequests"
+	minRequests := parseIntConf(upstreamMap, minRequestsKey, 0)
+	windowKey := breakerPrefix + "window"
+	window := parseIntConf(upstreamMap, windowKey, 0)
+	openTimeoutKey := breakerPrefix + "openTimeout"
+	openTimeout := parseIntConf(upstreamMap, openTimeoutKey, 0)
+	halfOpenRequestsKey := breakerPrefix + "halfOpenRequests"
+	halfOpenRequests := parseIntConf(upstreamMap, halfOpenRequestsKey, 0)
+
+	enable, err := strconv.ParseBool(enableStr)
+	if err != nil || !enable {
+		return nil
+	}
+	breakerConf := agent.NewBreakerConf(errorRatio, minRequests, time.Duration(window)*time.Second,
+		time.Duration(openTimeout)*time.Second, halfOpenRequests)
+	logx.Info("breakerConf:", breakerConf)
+	return breakerConf
+}
+
+// initRetryConf 初始化拨号重试配置，未配置重试次数则返回nil
+func initRetryConf(upstreamMap map[string]string, retryPrefix string) *agent.RetryConf {
+	attemptsKey := retryPrefix + "attempts"
+	attempts := parseIntConf(upstreamMap, attemptsKey, 0)
+	timeoutKey := retryPrefix + "timeout"
+	timeout := parseIntConf(upstreamMap, timeoutKey, 0)
+	excludeTriedKey := retryPrefix + "excludeTried"
+	excludeTriedStr := upstreamMap[excludeTriedKey]
+	delete(upstreamMap, excludeTriedKey)
+	excludeTried := true
+	if len(excludeTriedStr) > 0 {
+		ret, err := strconv.ParseBool(excludeTriedStr)
+		if err != nil {
+			logx.Panic(excludeTriedKey + " is invalid.")
+		}
+		excludeTried = ret
+	}
+
+	if attempts <= 0 && timeout <= 0 {
+		return nil
+	}
+	retryConf := agent.NewRetryConf(attempts, time.Duration(timeout)*time.Millisecond, excludeTried)
+	logx.Info("retryConf:", retryConf)
+	return retryConf
+}
+
+// initDstPoolConf 初始化空闲连接池配置，未启用则返回nil
+func initDstPoolConf(upstreamMap map[string]string, poolPrefix string) *agent.DstPoolConf {
+	enableKey := poolPrefix + "enable"
+	enableStr := upstreamMap[enableKey]
+	delete(upstreamMap, enableKey)
+	minIdleKey := poolPrefix + "minIdle"
+	minIdle := parseIntConf(upstreamMap, minIdleKey, 0)
+	maxIdleKey := poolPrefix + "maxIdle"
+	maxIdle := parseIntConf(upstreamMap, maxIdleKey, 0)
+	maxLifetimeKey := poolPrefix + "maxLifetime"
+	maxLifetime := parseIntConf(upstreamMap, maxLifetimeKey, 0)
+
+	enable, err := strconv.ParseBool(enableStr)
+	if err != nil || !enable {
+		return nil
+	}
+	poolConf := agent.NewDstPoolConf(minIdle, maxIdle, time.Duration(maxLifetime)*time.Second)
+	logx.Info("dstPoolConf:", poolConf)
+	return poolConf
+}
+
+// initReconnectConf 初始化重连配置，未启用则返回nil
+func initReconnectConf(upstreamMap map[string]string, reconnectPrefix string) *agent.ReconnectConf {
+	enableKey := reconnectPrefix + "enable"
+	enableStr := upstreamMap[enableKey]
+	delete(upstreamMap, enableKey)
+	attemptsKey := reconnectPrefix + "attempts"
+	attempts := parseIntConf(upstreamMap, attemptsKey, 0)
+	intervalKey := reconnectPrefix + "interval"
+	interval := parseIntConf(upstreamMap, intervalKey, 0)
+	bufferSizeKey := reconnectPrefix + "bufferSize"
+	bufferSize := parseIntConf(upstreamMap, bufferSizeKey, 0)
+
+	enable, err := strconv.ParseBool(enableStr)
+	if err != nil || !enable {
+		return nil
+	}
+	reconnectConf := agent.NewReconnectConf(attempts, time.Duration(interval)*time.Millisecond, bufferSize)
+	logx.Info("reconnectConf:", reconnectConf)
+	return reconnectConf
+}
+
+var serverTunnelPrefix = "agent.server.tunnel."
+
+// initTunnelServerConf 初始化接收边缘agent链路的tunnel监听配置，未配置端口则返回nil
+func initTunnelServerConf(config map[string]string, agentId string, defChannConf channel.IChannelConf) *agent.TunnelServerConf {
+	portKey := serverTunnelPrefix + "port"
+	port := parseIntConf(config, portKey, 0)
+	ipKey := serverTunnelPrefix + "ip"
+	ip := config[ipKey]
+	delete(config, ipKey)
+	if len(ip) <= 0 {
+		// 为空则取server的ip
+		ip = config[serverIpKey]
+	}
+	networkKey := serverTunnelPrefix + "network"
+	network := config[networkKey]
+	delete(config, networkKey)
+	pathKey := serverTunnelPrefix + "path"
+	path := config[pathKey]
+	delete(config, pathKey)
+	secretKey := serverTunnelPrefix + "secret"
+	secret := config[secretKey]
+	delete(config, secretKey)
+	resumeTimeout := parseIntConf(config, serverTunnelPrefix+"resumeTimeout", 0)
+	bufferSize := parseIntConf(config, serverTunnelPrefix+"bufferSize", 0)
+	if port <= 0 {
+		return nil
+	}
+
+	var serverConf socket.IServerConf
+	switch network {
+	case "", channel.NETWORK_TCP.String():
+		serverConf = socket.NewTcpServerConf(ip, port)
+	case channel.NETWORK_KCP.String():
+		serverConf = socket.NewKcpServerConf(ip, port)
+	case channel.NETWORK_WS.String():
+		serverConf = socket.NewWsServerConf(ip, port, "", socket.NewServerChildConf(channel.NETWORK_WS, path))
+	default:
+		logx.Panic("tunnel network is invalid:" + network)
+	}
+	serverConf.SetId(agentId + ".tunnel")
+	serverConf.CopyChConf(defChannConf)
+	tunnelServerConf := agent.NewTunnelServerConf(serverConf, secret)
+	if resumeTimeout > 0 {
+		tunnelServerConf.ResumeTimeout = time.Duration(resumeTimeout) * time.Millisecond
+	}
+	if bufferSize > 0 {
+		tunnelServerConf.BufferSize = bufferSize
+	}
+	logx.Info("tunnelServerConf:", tunnelServerConf)
+	return tunnelServerConf
+}
+
+var serverAsyncDialPrefix = "agent.server.asyncDial."
+
+// initAsyncDialConf 初始化异步拨号配置，未启用则返回nil
+func initAsyncDialConf(config map[string]string) *agent.AsyncDialConf {
+	enableKey := serverAsyncDialPrefix + "enable"
+	enableStr := config[enableKey]
+	delete(config, enableKey)
+	bufferSizeKey := serverAsyncDialPrefix + "bufferSize"
+	bufferSize := parseIntConf(config, bufferSizeKey, 0)
+	bufferTimeoutKey := serverAsyncDialPrefix + "bufferTimeout"
+	bufferTimeout := parseIntConf(config, bufferTimeoutKey, 0)
+
+	enable, err := strconv.ParseBool(enableStr)
+	if err != nil || !enable {
+		return nil
+	}
+	asyncDialConf := agent.NewAsyncDialConf(bufferSize, time.Duration(bufferTimeout)*time.Millisecond)
+	logx.Info("asyncDialConf:", asyncDialConf)
+	return asyncDialConf
+}
+
+// initDstClientAttr 初始化dstclient的附加属性，如权重，优先级，是否备用，最大连接数，标签
+func initDstClientAttr(upstreamMap map[string]string, indexKey string) *agent.DstClientAttr {
+	priorityKey := indexKey + "priority"
+	priority := parseIntConf(upstreamMap, priorityKey, 0)
+
+	backupKey := indexKey + "backup"
+	backupStr := upstreamMap[backupKey]
+	delete(upstreamMap, backupKey)
+	backup := false
+	if len(backupStr) > 0 {
+		ret, err := strconv.ParseBool(backupStr)
+		if err != nil {
+			logx.Panic("backup is invalid, backupKey:" + backupKey)
+		}
+		backup = ret
+	}
+
+	maxChannelSizeKey := indexKey + "maxChannelSize"
+	maxChannelSize := parseIntConf(upstreamMap, maxChannelSizeKey, 0)
+
+	weightKey := indexKey + "weight"
+	weight := parseIntConf(upstreamMap, weightKey, 1)
+	attr := agent.NewDstClientAttr(weight, priority, backup, maxChannelSize)
+
+	// 标签，如"dstclient.0.tag.zone=a"
+	attr.Tags = initTags(upstreamMap, indexKey+"tag.")
+	return attr
+}
+
+// initTags 初始化标签，key去掉前缀后作为标签名
+func initTags(config map[string]string, tagPrefix string) map[string]string {
+	tags := make(map[string]string)
+	for key, v := range config {
+		if strings.HasPrefix(key, tagPrefix) {
+			delete(config, key)
+			tags[strings.TrimPrefix(key, tagPrefix)] = v
+		}
+	}
+	return tags
+}
+
+// parseIntConf 解析int类型的配置，为空则返回默认值，解析出错则panic
+func parseIntConf(config map[string]string, key string, defValue int) int {
+	valueStr := config[key]
+	delete(config, key)
+	if len(valueStr) <= 0 {
+		return defValue
+	}
+	retInt, err := strconv.ParseInt(valueStr, 10, 32)
+	if err != nil {
+		logx.Panic(key + " is invalid.")
+	}
+	return int(retInt)
+}
+
+// parseFloatConf 解析float类型的配置，为空则返回默认值，解析出错则panic
+func parseFloatConf(config map[string]string, key string, defValue float64) float64 {
+	valueStr := config[key]
+	delete(config, key)
+	if len(valueStr) <= 0 {
+		return defValue
+	}
+	ret, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		logx.Panic(key + " is invalid.")
+	}
+	return ret
+}
+
 var serverKey = "agent.server"
+var serverTagKey = "agent.server.tag."
 var serverIpKey = "agent.server.ip"
 var serverPortKey = "agent.server.port"
 var serverNetworkKey = "agent.server.network"
@@ -443,6 +886,14 @@ func initLocations(config map[string]string) []agent.ILocationConf {
 				pattern = ""
 			}
 			locationConf := agent.NewLocationConf(pattern, upstreamId, nil)
+			// 流量镜像的upstreamId和会话比例
+			mirrorUpsIdKey := fmt.Sprintf("agent.server.location.%v.mirror.upstreamId", index)
+			locationConf.MirrorUpstreamId = locationMap[mirrorUpsIdKey]
+			mirrorPercentKey := fmt.Sprintf("agent.server.location.%v.mirror.percent", index)
+			locationConf.MirrorPercent = parseFloatConf(locationMap, mirrorPercentKey, agent.MIRROR_PERCENT_UNSET)
+			// 多个upstream的绑定
+			bindingPrefix := fmt.Sprintf("agent.server.location.%v.binding.", index)
+			locationConf.BindingConf = initBindingConf(locationMap, bindingPrefix)
 			logx.Info("locationConf:", locationConf)
 			if locationConfs == nil {
 				locationConfs = make([]agent.ILocationConf, 1)
@@ -456,6 +907,113 @@ func initLocations(config map[string]string) []agent.ILocationConf {
 	return locationConfs
 }
 
+var filterPrefix = "agent.filter."
+
+// initFilterConfs 初始化过滤器，按序号递增，序号即执行顺序，没有type则结束，
+// id、type、pattern以外的配置放入ExtConf
+func initFilterConfs(config map[string]string) []agent.IFilterConf {
+	filterMap := make(map[string]string)
+	for key, v := range config {
+		if strings.HasPrefix(key, filterPrefix) {
+			delete(config, key)
+			filterMap[key] = v
+		}
+	}
+
+	var filterConfs []agent.IFilterConf
+	for index := 0; ; index++ {
+		indexKey := fmt.Sprintf("%v%v.", filterPrefix, index)
+		typeKey := indexKey + "type"
+		filterType := filterMap[typeKey]
+		delete(filterMap, typeKey)
+		if len(filterType) <= 0 {
+			break
+		}
+		idKey := indexKey + "id"
+		id := filterMap[idKey]
+		delete(filterMap, idKey)
+		if len(id) <= 0 {
+			id = fmt.Sprintf("filter-%v", index)
+		}
+		patternKey := indexKey + "pattern"
+		pattern := filterMap[patternKey]
+		delete(filterMap, patternKey)
+		extConf := make(map[string]interface{})
+		for key, v := range filterMap {
+			if strings.HasPrefix(key, indexKey) {
+				extConf[strings.TrimPrefix(key, indexKey)] = v
+			}
+		}
+		filterConf := agent.NewFilterConf(id, filterType, pattern, extConf)
+		filterConf.Order = index
+		logx.Info("filterConf:", filterConf)
+		filterConfs = append(filterConfs, filterConf)
+	}
+	return filterConfs
+}
+
+// initMockRules 初始化模拟应答的规则，按序号递增，没有type则结束
+func initMockRules(upstreamMap map[string]string, rulePrefix string) []*agent.MockRule {
+	var rules []*agent.MockRule
+	for index := 0; ; index++ {
+		indexKey := fmt.Sprintf("%v%v.", rulePrefix, index)
+		typeKey := indexKey + "type"
+		ruleType := upstreamMap[typeKey]
+		delete(upstreamMap, typeKey)
+		if len(ruleType) <= 0 {
+			break
+		}
+		patternKey := indexKey + "pattern"
+		pattern := upstreamMap[patternKey]
+		delete(upstreamMap, patternKey)
+		fieldKey := indexKey + "field"
+		field := upstreamMap[fieldKey]
+		delete(upstreamMap, fieldKey)
+		valueKey := indexKey + "value"
+		value := upstreamMap[valueKey]
+		delete(upstreamMap, valueKey)
+		responseKey := indexKey + "response"
+		response := upstreamMap[responseKey]
+		delete(upstreamMap, responseKey)
+		// 延迟，单位ms
+		delay := parseIntConf(upstreamMap, indexKey+"delay", 0)
+		rule := agent.NewMockRule(ruleType, pattern, field, value, response, time.Duration(delay)*time.Millisecond)
+		logx.Info("mockRule:", rule)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// initBindingConf 初始化多个upstream的绑定配置，未配置选择方式则返回nil
+func initBindingConf(locationMap map[string]string, bindingPrefix string) *agent.BindingConf {
+	selectorType := locationMap[bindingPrefix+"selector"]
+	if len(selectorType) <= 0 {
+		return nil
+	}
+	var bindings []*agent.UpstreamBinding
+	for index := 0; ; index++ {
+		upstreamId := locationMap[fmt.Sprintf("%v%v.upstreamId", bindingPrefix, index)]
+		if len(upstreamId) <= 0 {
+			break
+		}
+		match := locationMap[fmt.Sprintf("%v%v.match", bindingPrefix, index)]
+		bindings = append(bindings, &agent.UpstreamBinding{Match: match, UpstreamId: upstreamId})
+	}
+	field := locationMap[bindingPrefix+"field"]
+	bindingConf := agent.NewBindingConf(selectorType, field, bindings...)
+	stripPrefixKey := bindingPrefix + "stripPrefix"
+	stripPrefixStr := locationMap[stripPrefixKey]
+	if len(stripPrefixStr) > 0 {
+		stripPrefix, err := strconv.ParseBool(stripPrefixStr)
+		if err != nil {
+			logx.Panic(stripPrefixKey + " is invalid.")
+		}
+		bindingConf.StripPrefix = stripPrefix
+	}
+	logx.Info("bindingConf:", bindingConf)
+	return bindingConf
+}
+
 var key_prefix_agent = "agent."
 var key_ch_readTimeout = key_prefix_agent + "channel.readTimeout"
 var key_ch_writeTimeout = key_prefix_agent + "channel.writeTimeout"
@@ -6,4 +6,6 @@ require (
 	github.com/emirpasic/gods v1.12.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/slive/gsfly v0.0.0-20210409043839-7206f31f8b19
+	github.com/xtaci/kcp-go v5.4.20+incompatible
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 )
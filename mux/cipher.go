@@ -0,0 +1,152 @@
+/*
+ * 帧payload的加解密，用于跨网络的tunnel链路：
+ *  1、链路建立后双方先交换明文的FRAME_HELLO帧，payload为各自随机生成的握手nonce，见NewHandshakeNonce
+ *  2、每条链路按HKDF-SHA256(共享密钥，双方的握手nonce)派生两个方向各自的AES-256-GCM密钥，不同链路的密钥不同
+ *  3、加密后的payload为8字节的发送序号+密文，序号按方向从1递增并作为GCM的nonce，
+ *     接收方要求序号严格递增，重放或者乱序的帧无法解密；帧类型和会话id作为附加数据一并认证，防止帧被篡改或者挪用到其他会话
+ *  4、帧头不加密，按流收发的协议仍可使用Decoder解帧
+ * Author:slive
+ * DATE:2021/4/28
+ */
+package mux
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+)
+
+const (
+	// HANDSHAKE_NONCE_SIZE 握手nonce的长度
+	HANDSHAKE_NONCE_SIZE = 32
+
+	// 发送序号的长度
+	seq_size = 8
+
+	// 派生发起方(客户端)到接收方的密钥
+	key_info_client = "gsfly-agent tunnel client"
+
+	// 派生接收方(服务端)到发起方的密钥
+	key_info_server = "gsfly-agent tunnel server"
+)
+
+var ErrCipherOpen = errors.New("mux frame payload can not be opened")
+
+var ErrCipherReplay = errors.New("mux frame sequence is not increasing")
+
+// NewHandshakeNonce 生成握手nonce，作为FRAME_HELLO的payload
+func NewHandshakeNonce() ([]byte, error) {
+	nonce := make([]byte, HANDSHAKE_NONCE_SIZE)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// Cipher 一条链路的帧payload加解密，并发安全，SealFrame的调用顺序即发送顺序
+type Cipher struct {
+	sealAead cipher.AEAD
+
+	openAead cipher.AEAD
+
+	// 最近发送的序号
+	sealSeq uint64
+
+	// 最近接收的序号
+	openSeq uint64
+
+	sealMut sync.Mutex
+
+	openMut sync.Mutex
+}
+
+// NewCipher 根据共享密钥和双方的握手nonce创建链路的加解密，client为是否链路的发起方
+func NewCipher(secret string, clientNonce []byte, serverNonce []byte, client bool) (*Cipher, error) {
+	if len(secret) <= 0 {
+		return nil, errors.New("mux cipher secret is nil")
+	}
+	if len(clientNonce) != HANDSHAKE_NONCE_SIZE || len(serverNonce) != HANDSHAKE_NONCE_SIZE {
+		return nil, errors.New("mux cipher handshake nonce is invalid")
+	}
+	salt := make([]byte, 0, 2*HANDSHAKE_NONCE_SIZE)
+	salt = append(salt, clientNonce...)
+	salt = append(salt, serverNonce...)
+	clientAead, err := deriveAead(secret, salt, key_info_client)
+	if err != nil {
+		return nil, err
+	}
+	serverAead, err := deriveAead(secret, salt, key_info_server)
+	if err != nil {
+		return nil, err
+	}
+	if client {
+		return &Cipher{sealAead: clientAead, openAead: serverAead}, nil
+	}
+	return &Cipher{sealAead: serverAead, openAead: clientAead}, nil
+}
+
+// deriveAead 按HKDF派生一个方向的密钥
+func deriveAead(secret string, salt []byte, info string) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), salt, []byte(info)), key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealFrame 加密帧的payload，返回新的帧
+func (c *Cipher) SealFrame(frame *Frame) *Frame {
+	c.sealMut.Lock()
+	defer c.sealMut.Unlock()
+	c.sealSeq++
+	payload := make([]byte, seq_size, seq_size+len(frame.Payload)+c.sealAead.Overhead())
+	binary.BigEndian.PutUint64(payload, c.sealSeq)
+	payload = c.sealAead.Seal(payload, seqNonce(c.sealAead, c.sealSeq), frame.Payload, additionalData(frame))
+	return NewFrame(frame.Type, frame.SessionId, payload)
+}
+
+// OpenFrame 解密帧的payload，返回新的帧，密钥不一致或者被篡改则返回ErrCipherOpen，重放则返回ErrCipherReplay
+func (c *Cipher) OpenFrame(frame *Frame) (*Frame, error) {
+	if len(frame.Payload) < seq_size {
+		return nil, ErrCipherOpen
+	}
+	seq := binary.BigEndian.Uint64(frame.Payload[:seq_size])
+	c.openMut.Lock()
+	defer c.openMut.Unlock()
+	if seq <= c.openSeq {
+		return nil, ErrCipherReplay
+	}
+	payload, err := c.openAead.Open(nil, seqNonce(c.openAead, seq), frame.Payload[seq_size:], additionalData(frame))
+	if err != nil {
+		return nil, ErrCipherOpen
+	}
+	c.openSeq = seq
+	return NewFrame(frame.Type, frame.SessionId, payload), nil
+}
+
+// seqNonce 序号作为GCM的nonce，高位补0
+func seqNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-seq_size:], seq)
+	return nonce
+}
+
+// additionalData 帧类型和会话id
+func additionalData(frame *Frame) []byte {
+	ad := make([]byte, 5)
+	ad[0] = byte(frame.Type)
+	binary.BigEndian.PutUint32(ad[1:5], frame.SessionId)
+	return ad
+}
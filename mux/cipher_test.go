@@ -0,0 +1,172 @@
+package mux
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newCipherPair 按同一次握手创建链路两端的加解密
+func newCipherPair(t *testing.T, clientSecret string, serverSecret string) (*Cipher, *Cipher) {
+	t.Helper()
+	clientNonce, err := NewHandshakeNonce()
+	if err != nil {
+		t.Fatalf("NewHandshakeNonce() error = %v", err)
+	}
+	serverNonce, err := NewHandshakeNonce()
+	if err != nil {
+		t.Fatalf("NewHandshakeNonce() error = %v", err)
+	}
+	client, err := NewCipher(clientSecret, clientNonce, serverNonce, true)
+	if err != nil {
+		t.Fatalf("NewCipher() client error = %v", err)
+	}
+	server, err := NewCipher(serverSecret, clientNonce, serverNonce, false)
+	if err != nil {
+		t.Fatalf("NewCipher() server error = %v", err)
+	}
+	return client, server
+}
+
+func TestNewCipherInvalid(t *testing.T) {
+	nonce := bytes.Repeat([]byte{1}, HANDSHAKE_NONCE_SIZE)
+	tests := []struct {
+		name        string
+		secret      string
+		clientNonce []byte
+		serverNonce []byte
+	}{
+		{"empty secret", "", nonce, nonce},
+		{"short client nonce", "secret", nonce[:HANDSHAKE_NONCE_SIZE-1], nonce},
+		{"nil server nonce", "secret", nonce, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCipher(tt.secret, tt.clientNonce, tt.serverNonce, true)
+			if err == nil {
+				t.Fatal("NewCipher() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	client, server := newCipherPair(t, "secret", "secret")
+	tests := []struct {
+		name  string
+		seal  *Cipher
+		open  *Cipher
+		frame *Frame
+	}{
+		{"client to server", client, server, NewFrame(FRAME_OPEN, 1, []byte(`{"tunnelId":"a"}`))},
+		{"server to client", server, client, NewFrame(FRAME_DATA, 1, []byte("hello"))},
+		{"empty payload", client, server, NewFrame(FRAME_CLOSE, 2, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed := tt.seal.SealFrame(tt.frame)
+			if bytes.Contains(sealed.Payload, tt.frame.Payload) && len(tt.frame.Payload) > 0 {
+				t.Fatal("sealed payload contains plaintext")
+			}
+			opened, err := tt.open.OpenFrame(sealed)
+			if err != nil {
+				t.Fatalf("OpenFrame() error = %v", err)
+			}
+			assertFrame(t, opened, tt.frame)
+		})
+	}
+}
+
+func TestCipherOpenInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(sealed *Frame) *Frame
+		wantErr error
+	}{
+		{"short payload", func(sealed *Frame) *Frame {
+			return NewFrame(sealed.Type, sealed.SessionId, sealed.Payload[:seq_size-1])
+		}, ErrCipherOpen},
+		{"corrupted payload", func(sealed *Frame) *Frame {
+			payload := append([]byte{}, sealed.Payload...)
+			payload[len(payload)-1] ^= 0xFF
+			return NewFrame(sealed.Type, sealed.SessionId, payload)
+		}, ErrCipherOpen},
+		{"corrupted sequence", func(sealed *Frame) *Frame {
+			payload := append([]byte{}, sealed.Payload...)
+			payload[seq_size-1]++
+			return NewFrame(sealed.Type, sealed.SessionId, payload)
+		}, ErrCipherOpen},
+		{"other session", func(sealed *Frame) *Frame {
+			return NewFrame(sealed.Type, sealed.SessionId+1, sealed.Payload)
+		}, ErrCipherOpen},
+		{"other type", func(sealed *Frame) *Frame {
+			return NewFrame(FRAME_CLOSE, sealed.SessionId, sealed.Payload)
+		}, ErrCipherOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newCipherPair(t, "secret", "secret")
+			sealed := client.SealFrame(NewFrame(FRAME_DATA, 1, []byte("hello")))
+			_, err := server.OpenFrame(tt.mutate(sealed))
+			if err != tt.wantErr {
+				t.Fatalf("OpenFrame() error = %v, want %v", err, tt.wantErr)
+			}
+			// 被篡改的帧不影响后续正常的帧
+			_, err = server.OpenFrame(sealed)
+			if err != nil {
+				t.Fatalf("OpenFrame() of original error = %v", err)
+			}
+		})
+	}
+}
+
+func TestCipherWrongSecret(t *testing.T) {
+	client, server := newCipherPair(t, "secret", "other")
+	_, err := server.OpenFrame(client.SealFrame(NewFrame(FRAME_DATA, 1, []byte("hello"))))
+	if err != ErrCipherOpen {
+		t.Fatalf("OpenFrame() error = %v, want %v", err, ErrCipherOpen)
+	}
+}
+
+func TestCipherReplay(t *testing.T) {
+	client, server := newCipherPair(t, "secret", "secret")
+	first := client.SealFrame(NewFrame(FRAME_DATA, 1, []byte("first")))
+	second := client.SealFrame(NewFrame(FRAME_DATA, 1, []byte("second")))
+	third := client.SealFrame(NewFrame(FRAME_DATA, 1, []byte("third")))
+
+	steps := []struct {
+		name    string
+		frame   *Frame
+		wantErr error
+	}{
+		{"first", first, nil},
+		{"replay first", first, ErrCipherReplay},
+		// 序号可跳过，如中间的帧丢失
+		{"third", third, nil},
+		{"older second", second, ErrCipherReplay},
+		{"replay third", third, ErrCipherReplay},
+	}
+	for _, step := range steps {
+		_, err := server.OpenFrame(step.frame)
+		if err != step.wantErr {
+			t.Fatalf("%v: OpenFrame() error = %v, want %v", step.name, err, step.wantErr)
+		}
+	}
+}
+
+func TestCipherLinkKeys(t *testing.T) {
+	frame := NewFrame(FRAME_DATA, 1, []byte("hello"))
+	// 同一个共享密钥，不同链路的密钥不同，一条链路的帧不能在另一条链路上重放
+	client, _ := newCipherPair(t, "secret", "secret")
+	_, otherServer := newCipherPair(t, "secret", "secret")
+	_, err := otherServer.OpenFrame(client.SealFrame(frame))
+	if err != ErrCipherOpen {
+		t.Fatalf("OpenFrame() on other link error = %v, want %v", err, ErrCipherOpen)
+	}
+
+	// 两个方向的密钥不同，发出的帧不能被反射回发送方
+	client, _ = newCipherPair(t, "secret", "secret")
+	_, err = client.OpenFrame(client.SealFrame(frame))
+	if err != ErrCipherOpen {
+		t.Fatalf("OpenFrame() of reflected frame error = %v, want %v", err, ErrCipherOpen)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * 多路复用的分帧协议，多个agent端的会话共用一个dst连接，每个消息都带上会话id
+ *
+ * 帧格式(大端)：
+ *   +--------+--------------+--------------+-------------+
+ *   | type 1 | sessionId 4  | length 4     | payload ... |
+ *   +--------+--------------+--------------+-------------+
+ * type：FRAME_OPEN会话打开，payload为agent端参数的json；FRAME_DATA会话消息；FRAME_CLOSE会话关闭，payload为空；
+ *       FRAME_HELLO只用于tunnel链路的握手，sessionId为0，payload为握手nonce
+ *
+ * dst端可直接使用本包进行解帧：按消息收发的协议(ws/kcp/udp)，一个消息即一帧，使用Decode；
+ * 按流收发的协议(tcp)，使用Decoder累积数据后解出完整的帧，或者使用ReadFrame从io.Reader中读取；
+ * 跨网络的tunnel链路使用Cipher加密payload，见cipher.go
+ * Author:slive
+ * DATE:2021/4/19
+ */
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameType 帧类型
+type FrameType byte
+
+const (
+	// FRAME_OPEN 会话打开
+	FRAME_OPEN = FrameType(1)
+	// FRAME_DATA 会话消息
+	FRAME_DATA = FrameType(2)
+	// FRAME_CLOSE 会话关闭
+	FRAME_CLOSE = FrameType(3)
+	// FRAME_HELLO tunnel链路握手
+	FRAME_HELLO = FrameType(4)
+)
+
+func (ft FrameType) String() string {
+	switch ft {
+	case FRAME_OPEN:
+		return "open"
+	case FRAME_DATA:
+		return "data"
+	case FRAME_CLOSE:
+		return "close"
+	case FRAME_HELLO:
+		return "hello"
+	default:
+		return fmt.Sprintf("unknown(%v)", byte(ft))
+	}
+}
+
+const (
+	// HEADER_SIZE 帧头长度
+	HEADER_SIZE = 9
+
+	// MAX_PAYLOAD_SIZE 最大payload长度
+	MAX_PAYLOAD_SIZE = 16 * 1024 * 1024
+)
+
+var ErrFrameTooLarge = errors.New("mux frame payload is too large")
+
+var ErrShortFrame = errors.New("mux frame is incomplete")
+
+// Frame 帧
+type Frame struct {
+	Type FrameType
+
+	SessionId uint32
+
+	Payload []byte
+}
+
+func NewFrame(frameType FrameType, sessionId uint32, payload []byte) *Frame {
+	return &Frame{Type: frameType, SessionId: sessionId, Payload: payload}
+}
+
+// Encode 编码为字节
+func (f *Frame) Encode() []byte {
+	buf := make([]byte, HEADER_SIZE+len(f.Payload))
+	buf[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(buf[1:5], f.SessionId)
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(f.Payload)))
+	copy(buf[HEADER_SIZE:], f.Payload)
+	return buf
+}
+
+// Decode 从一个完整的消息中解出一帧，适用于按消息收发的协议
+func Decode(data []byte) (*Frame, error) {
+	frame, n, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(data) {
+		return nil, fmt.Errorf("mux frame has %v trailing bytes", len(data)-n)
+	}
+	return frame, nil
+}
+
+// decode 解出一帧，返回已使用的字节数，数据不完整则返回ErrShortFrame
+func decode(data []byte) (*Frame, int, error) {
+	if len(data) < HEADER_SIZE {
+		return nil, 0, ErrShortFrame
+	}
+	length := binary.BigEndian.Uint32(data[5:9])
+	if length > MAX_PAYLOAD_SIZE {
+		return nil, 0, ErrFrameTooLarge
+	}
+	total := HEADER_SIZE + int(length)
+	if len(data) < total {
+		return nil, 0, ErrShortFrame
+	}
+	payload := make([]byte, length)
+	copy(payload, data[HEADER_SIZE:total])
+	frame := &Frame{
+		Type:      FrameType(data[0]),
+		SessionId: binary.BigEndian.Uint32(data[1:5]),
+		Payload:   payload,
+	}
+	return frame, total, nil
+}
+
+// Decoder 流式解帧，累积收到的数据，解出所有完整的帧，非并发安全
+type Decoder struct {
+	buf []byte
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// Feed 追加收到的数据，返回已完整的帧，不完整的数据留到下次
+func (d *Decoder) Feed(data []byte) ([]*Frame, error) {
+	d.buf = append(d.buf, data...)
+	var frames []*Frame
+	for {
+		frame, n, err := decode(d.buf)
+		if err == ErrShortFrame {
+			break
+		}
+		if err != nil {
+			d.buf = nil
+			return frames, err
+		}
+		frames = append(frames, frame)
+		d.buf = d.buf[n:]
+	}
+	if len(d.buf) == 0 {
+		d.buf = nil
+	}
+	return frames, nil
+}
+
+// ReadFrame 从io.Reader中读取一帧
+func ReadFrame(r io.Reader) (*Frame, error) {
+	header := make([]byte, HEADER_SIZE)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > MAX_PAYLOAD_SIZE {
+		return nil, ErrFrameTooLarge
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Frame{
+		Type:      FrameType(header[0]),
+		SessionId: binary.BigEndian.Uint32(header[1:5]),
+		Payload:   payload,
+	}, nil
+}
+
+// WriteFrame 写一帧到io.Writer
+func WriteFrame(w io.Writer, frame *Frame) error {
+	_, err := w.Write(frame.Encode())
+	return err
+}
@@ -0,0 +1,152 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestFrameEncodeDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+	}{
+		{"open", NewFrame(FRAME_OPEN, 1, []byte(`{"uid":"1"}`))},
+		{"data", NewFrame(FRAME_DATA, 0xFFFFFFFF, []byte("hello"))},
+		{"close without payload", NewFrame(FRAME_CLOSE, 7, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.frame.Encode()
+			if len(data) != HEADER_SIZE+len(tt.frame.Payload) {
+				t.Fatalf("encoded length = %v, want %v", len(data), HEADER_SIZE+len(tt.frame.Payload))
+			}
+			got, err := Decode(data)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			assertFrame(t, got, tt.frame)
+		})
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	oversized := make([]byte, HEADER_SIZE)
+	oversized[0] = byte(FRAME_DATA)
+	binary.BigEndian.PutUint32(oversized[5:9], MAX_PAYLOAD_SIZE+1)
+	full := NewFrame(FRAME_DATA, 1, []byte("hello")).Encode()
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"empty", nil, ErrShortFrame},
+		{"short header", full[:HEADER_SIZE-1], ErrShortFrame},
+		{"short payload", full[:len(full)-1], ErrShortFrame},
+		{"oversized", oversized, ErrFrameTooLarge},
+		{"trailing bytes", append(append([]byte{}, full...), 0), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.data)
+			if err == nil {
+				t.Fatal("Decode() error = nil, want error")
+			}
+			if tt.wantErr != nil && err != tt.wantErr {
+				t.Fatalf("Decode() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecoderFeed(t *testing.T) {
+	first := NewFrame(FRAME_OPEN, 1, []byte("{}"))
+	second := NewFrame(FRAME_DATA, 1, []byte("hello"))
+	third := NewFrame(FRAME_CLOSE, 1, nil)
+	stream := append(append(first.Encode(), second.Encode()...), third.Encode()...)
+
+	tests := []struct {
+		name  string
+		sizes []int
+	}{
+		{"whole stream", []int{len(stream)}},
+		{"byte by byte", repeatSize(1, len(stream))},
+		{"split in header", []int{3, 10, len(stream) - 13}},
+		{"split in payload", []int{HEADER_SIZE + 1, len(stream) - HEADER_SIZE - 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder := NewDecoder()
+			var frames []*Frame
+			offset := 0
+			for _, size := range tt.sizes {
+				got, err := decoder.Feed(stream[offset : offset+size])
+				if err != nil {
+					t.Fatalf("Feed() error = %v", err)
+				}
+				frames = append(frames, got...)
+				offset += size
+			}
+			if len(frames) != 3 {
+				t.Fatalf("frames = %v, want 3", len(frames))
+			}
+			assertFrame(t, frames[0], first)
+			assertFrame(t, frames[1], second)
+			assertFrame(t, frames[2], third)
+		})
+	}
+}
+
+func TestDecoderFeedOversized(t *testing.T) {
+	oversized := make([]byte, HEADER_SIZE)
+	binary.BigEndian.PutUint32(oversized[5:9], MAX_PAYLOAD_SIZE+1)
+	valid := NewFrame(FRAME_DATA, 1, []byte("ok"))
+	decoder := NewDecoder()
+	frames, err := decoder.Feed(append(valid.Encode(), oversized...))
+	if err != ErrFrameTooLarge {
+		t.Fatalf("Feed() error = %v, want %v", err, ErrFrameTooLarge)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("frames = %v, want 1", len(frames))
+	}
+	// 出错后丢弃已累积的数据，可继续解帧
+	frames, err = decoder.Feed(valid.Encode())
+	if err != nil || len(frames) != 1 {
+		t.Fatalf("Feed() after error = %v, %v", len(frames), err)
+	}
+}
+
+func TestReadWriteFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	frame := NewFrame(FRAME_DATA, 3, []byte("hello"))
+	err := WriteFrame(buf, frame)
+	if err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+	got, err := ReadFrame(buf)
+	if err != nil {
+		t.Fatalf("ReadFrame() error = %v", err)
+	}
+	assertFrame(t, got, frame)
+
+	_, err = ReadFrame(bytes.NewReader(frame.Encode()[:HEADER_SIZE+2]))
+	if err == nil {
+		t.Fatal("ReadFrame() of short frame error = nil, want error")
+	}
+}
+
+func repeatSize(size int, total int) []int {
+	sizes := make([]int, total/size)
+	for i := range sizes {
+		sizes[i] = size
+	}
+	return sizes
+}
+
+func assertFrame(t *testing.T, got *Frame, want *Frame) {
+	t.Helper()
+	if got.Type != want.Type || got.SessionId != want.SessionId || !bytes.Equal(got.Payload, want.Payload) {
+		t.Fatalf("frame = {%v %v %q}, want {%v %v %q}", got.Type, got.SessionId, got.Payload, want.Type, want.SessionId, want.Payload)
+	}
+}